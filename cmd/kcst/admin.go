@@ -0,0 +1,726 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/keircn/kcst/internal/audit"
+	"github.com/keircn/kcst/internal/backup"
+	"github.com/keircn/kcst/internal/blocklist"
+	"github.com/keircn/kcst/internal/config"
+	"github.com/keircn/kcst/internal/models"
+	"github.com/keircn/kcst/internal/server"
+	"github.com/keircn/kcst/internal/storage"
+	"github.com/keircn/kcst/internal/upload"
+)
+
+// The offline commands work on the database file directly. Run them while
+// the server is stopped: a running server keeps its own copy in memory and
+// overwrites the file on its next write.
+
+type offline struct {
+	db    *storage.DB
+	store *upload.Store
+}
+
+func openOffline(cfg *config.Config) *offline {
+	db, store, err := server.OpenStore(cfg)
+	if err != nil {
+		log.Fatalf("Failed to open store: %v", err)
+	}
+	return &offline{db: db, store: store}
+}
+
+func (o *offline) close() {
+	// Let scans and thumbnails started by the command finish.
+	o.store.Wait()
+	if err := o.db.Close(); err != nil {
+		log.Fatalf("Failed to write database: %v", err)
+	}
+}
+
+func (o *offline) lookup(name string) *storage.FileMetadata {
+	meta, _ := o.db.GetMetadataByStoredName(name)
+	if meta == nil {
+		meta, _ = o.db.GetMetadata(name)
+	}
+	if meta == nil {
+		log.Fatalf("No such file: %s", name)
+	}
+	return meta
+}
+
+func parseFlags(fs *flag.FlagSet, args []string, usage string) {
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: kcst %s\n", usage)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+}
+
+func lsCmd(cfg *config.Config, args []string) {
+	fs := flag.NewFlagSet("ls", flag.ExitOnError)
+	expired := fs.Bool("expired", false, "only list expired files")
+	live := fs.Bool("live", false, "only list files that have not expired")
+	contentType := fs.String("type", "", "only list files whose content type starts with this prefix")
+	name := fs.String("name", "", "only list files whose original name matches this glob")
+	minSize := fs.Int64("min-size", 0, "only list files of at least this many bytes")
+	maxSize := fs.Int64("max-size", 0, "only list files of at most this many bytes")
+	olderThan := fs.Duration("older-than", 0, "only list files uploaded longer ago than this")
+	newerThan := fs.Duration("newer-than", 0, "only list files uploaded more recently than this")
+	parseFlags(fs, args, "ls [flags]")
+
+	o := openOffline(cfg)
+	defer o.close()
+
+	files, err := o.db.ListMetadata()
+	if err != nil {
+		log.Fatal(err)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].UploadedAt.Before(files[j].UploadedAt)
+	})
+
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSIZE\tTYPE\tUPLOADED\tEXPIRES\tORIGINAL")
+	for _, meta := range files {
+		switch {
+		case *expired && !meta.IsExpired(),
+			*live && meta.IsExpired(),
+			*contentType != "" && !strings.HasPrefix(meta.ContentType, *contentType),
+			*minSize > 0 && meta.Size < *minSize,
+			*maxSize > 0 && meta.Size > *maxSize,
+			*olderThan > 0 && now.Sub(meta.UploadedAt) < *olderThan,
+			*newerThan > 0 && now.Sub(meta.UploadedAt) > *newerThan:
+			continue
+		}
+		if *name != "" {
+			if ok, _ := path.Match(*name, meta.OriginalName); !ok {
+				continue
+			}
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			meta.StoredName,
+			models.FormatSize(meta.Size),
+			meta.ContentType,
+			meta.UploadedAt.Format(time.DateTime),
+			meta.ExpiresAt.Format(time.DateTime),
+			meta.OriginalName,
+		)
+	}
+	w.Flush()
+}
+
+func rmCmd(cfg *config.Config, args []string) {
+	fs := flag.NewFlagSet("rm", flag.ExitOnError)
+	purge := fs.Bool("purge", false, "delete immediately instead of moving to the trash")
+	parseFlags(fs, args, "rm [-purge] <name>...")
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	o := openOffline(cfg)
+	defer o.close()
+
+	for _, name := range fs.Args() {
+		meta := o.lookup(name)
+		remove := func() error { return o.store.Trash(meta, upload.TrashDeleted) }
+		if *purge {
+			remove = func() error { return o.store.Delete(meta) }
+		}
+		if err := remove(); err != nil {
+			log.Fatalf("Failed to remove %s: %v", name, err)
+		}
+		fmt.Printf("removed %s\n", meta.StoredName)
+	}
+}
+
+func infoCmd(cfg *config.Config, args []string) {
+	fs := flag.NewFlagSet("info", flag.ExitOnError)
+	parseFlags(fs, args, "info <name>")
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	o := openOffline(cfg)
+	defer o.close()
+
+	meta := o.lookup(fs.Arg(0))
+	status := "live"
+	if meta.IsExpired() {
+		status = "expired"
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "ID:\t%s\n", meta.ID)
+	fmt.Fprintf(w, "Name:\t%s\n", meta.StoredName)
+	fmt.Fprintf(w, "Original name:\t%s\n", meta.OriginalName)
+	fmt.Fprintf(w, "Path:\t%s\n", o.store.Path(meta))
+	fmt.Fprintf(w, "Size:\t%s (%d bytes)\n", models.FormatSize(meta.Size), meta.Size)
+	fmt.Fprintf(w, "Type:\t%s\n", meta.ContentType)
+	fmt.Fprintf(w, "Uploaded:\t%s\n", meta.UploadedAt.Format(time.RFC3339))
+	fmt.Fprintf(w, "Expires:\t%s\n", meta.ExpiresAt.Format(time.RFC3339))
+	fmt.Fprintf(w, "Status:\t%s\n", status)
+	fmt.Fprintf(w, "Thumbnail:\t%t\n", meta.Thumbnail)
+	fmt.Fprintf(w, "Metadata stripped:\t%t\n", meta.Stripped)
+	if meta.Scan != "" {
+		scan := meta.Scan
+		if meta.ScanSignature != "" {
+			scan += " (" + meta.ScanSignature + ")"
+		}
+		if meta.ScanAttempts > 0 && (meta.Scan == storage.ScanPending || meta.Scan == storage.ScanError) {
+			scan += fmt.Sprintf(" after %d failed attempts", meta.ScanAttempts)
+		}
+		fmt.Fprintf(w, "Scan:\t%s\n", scan)
+	}
+	w.Flush()
+
+	if _, err := os.Stat(o.store.Path(meta)); err != nil {
+		fmt.Printf("warning: blob is missing: %v\n", err)
+	}
+}
+
+func cleanupCmd(cfg *config.Config, args []string) {
+	fs := flag.NewFlagSet("cleanup", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "list expired files without removing them")
+	parseFlags(fs, args, "cleanup [-dry-run]")
+
+	o := openOffline(cfg)
+	defer o.close()
+
+	if !*dryRun {
+		removed, err := o.store.Cleanup()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("removed %d expired files\n", removed)
+		return
+	}
+
+	expired, err := o.db.GetExpired()
+	if err != nil {
+		log.Fatal(err)
+	}
+	var total int64
+	for _, meta := range expired {
+		total += meta.Size
+		fmt.Printf("would remove %s (%s, expired %s)\n",
+			meta.StoredName, models.FormatSize(meta.Size), meta.ExpiresAt.Format(time.RFC3339))
+	}
+	fmt.Printf("%d expired files, %s\n", len(expired), models.FormatSize(total))
+}
+
+func statsCmd(cfg *config.Config, args []string) {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	parseFlags(fs, args, "stats")
+
+	o := openOffline(cfg)
+	defer o.close()
+
+	files, err := o.db.ListMetadata()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	type bucket struct {
+		count int
+		bytes int64
+	}
+	var total, expired bucket
+	byType := make(map[string]*bucket)
+	var oldest, newest time.Time
+	for _, meta := range files {
+		total.count++
+		total.bytes += meta.Size
+		if meta.IsExpired() {
+			expired.count++
+			expired.bytes += meta.Size
+		}
+
+		kind, _, _ := strings.Cut(meta.ContentType, "/")
+		if kind == "" {
+			kind = "unknown"
+		}
+		if byType[kind] == nil {
+			byType[kind] = &bucket{}
+		}
+		byType[kind].count++
+		byType[kind].bytes += meta.Size
+
+		if oldest.IsZero() || meta.UploadedAt.Before(oldest) {
+			oldest = meta.UploadedAt
+		}
+		if meta.UploadedAt.After(newest) {
+			newest = meta.UploadedAt
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Files:\t%d\t%s\n", total.count, models.FormatSize(total.bytes))
+	fmt.Fprintf(w, "Expired:\t%d\t%s\n", expired.count, models.FormatSize(expired.bytes))
+	if total.count > 0 {
+		fmt.Fprintf(w, "Oldest upload:\t%s\n", oldest.Format(time.RFC3339))
+		fmt.Fprintf(w, "Newest upload:\t%s\n", newest.Format(time.RFC3339))
+	}
+
+	kinds := make([]string, 0, len(byType))
+	for kind := range byType {
+		kinds = append(kinds, kind)
+	}
+	sort.Slice(kinds, func(i, j int) bool {
+		return byType[kinds[i]].bytes > byType[kinds[j]].bytes
+	})
+	for _, kind := range kinds {
+		fmt.Fprintf(w, "  %s:\t%d\t%s\n", kind, byType[kind].count, models.FormatSize(byType[kind].bytes))
+	}
+	w.Flush()
+}
+
+func importCmd(cfg *config.Config, args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	slug := fs.String("slug", "", "store the file under this name instead of a random one")
+	keepTime := fs.Bool("keep-mtime", false, "use the file's modification time as the upload time")
+	strip := fs.Bool("strip-metadata", cfg.Upload.StripMetadata, "remove EXIF/XMP/IPTC from images")
+	parseFlags(fs, args, "import [flags] <path>...")
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *slug != "" && fs.NArg() > 1 {
+		log.Fatal("-slug can only be used with a single file")
+	}
+
+	o := openOffline(cfg)
+	defer o.close()
+
+	for _, p := range fs.Args() {
+		opts := upload.Options{StripMetadata: *strip, Slug: *slug, Client: "import"}
+		if *keepTime {
+			info, err := os.Stat(p)
+			if err != nil {
+				log.Fatal(err)
+			}
+			opts.UploadedAt = info.ModTime()
+		}
+
+		filename, meta, err := o.store.Import(p, opts)
+		if err != nil {
+			log.Fatalf("Failed to import %s: %v", p, err)
+		}
+		fmt.Printf("imported %s as %s (%s, expires %s)\n",
+			p, filename, meta.ContentType, meta.ExpiresAt.Format(time.RFC3339))
+	}
+}
+
+func fsckCmd(cfg *config.Config, args []string) {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := fs.Bool("repair", false, "fix problems instead of only reporting them")
+	remove := fs.Bool("delete", cfg.Storage.FsckOrphans == "delete", "delete orphaned and corrupt files instead of quarantining them")
+	verify := fs.Bool("verify", false, "read every file and compare it with its recorded hash")
+	force := fs.Bool("force", false, "repair even if the database is empty but files exist")
+	parseFlags(fs, args, "fsck [-repair [-force]] [-delete] [-verify]")
+
+	o := openOffline(cfg)
+	defer o.close()
+
+	report, err := o.store.Fsck(upload.FsckOptions{
+		Repair:        *repair,
+		DeleteOrphans: *remove,
+		VerifyHashes:  *verify,
+		Force:         *force,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	unrepaired := 0
+	for _, p := range report.Problems {
+		fmt.Println(p)
+		if !p.Repaired {
+			unrepaired++
+		}
+	}
+	fmt.Printf("%d records, %d files, %d problems\n", report.Files, report.Blobs, len(report.Problems))
+	if unrepaired > 0 {
+		o.close()
+		os.Exit(1)
+	}
+}
+
+func backupCmd(cfg *config.Config, args []string) {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	base := fs.String("base", "", "only include files written after this earlier backup was taken")
+	since := fs.String("since", "", "only include files written after this time (RFC 3339)")
+	parseFlags(fs, args, "backup [-base archive | -since time] <archive>")
+	if fs.NArg() != 1 || (*base != "" && *since != "") {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var after time.Time
+	switch {
+	case *base != "":
+		f, err := os.Open(*base)
+		if err != nil {
+			log.Fatal(err)
+		}
+		m, err := backup.ReadManifest(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("Failed to read %s: %v", *base, err)
+		}
+		after = m.Created
+	case *since != "":
+		t, err := time.Parse(time.RFC3339, *since)
+		if err != nil {
+			log.Fatalf("Invalid -since: %v", err)
+		}
+		after = t
+	}
+
+	// Records from before expiry was stored get it from the current policy.
+	storage.SetRetention(server.RetentionPolicy(cfg))
+
+	out := fs.Arg(0)
+	var w io.Writer = os.Stdout
+	var tmp *os.File
+	if out != "-" {
+		var err error
+		tmp, err = os.CreateTemp(filepath.Dir(out), ".backup-*")
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer os.Remove(tmp.Name())
+		w = tmp
+	}
+
+	res, err := backup.Create(w, cfg.Storage.DBPath, cfg.Storage.UploadDir, after)
+	if err != nil {
+		log.Fatalf("Backup failed: %v", err)
+	}
+	if tmp != nil {
+		if err := tmp.Close(); err != nil {
+			log.Fatal(err)
+		}
+		if err := os.Rename(tmp.Name(), out); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	kind := "full"
+	if res.Manifest.Incremental() {
+		kind = "incremental"
+	}
+	fmt.Fprintf(os.Stderr, "%s backup: %d files, %d blobs (%s)\n",
+		kind, res.Files, res.Blobs, models.FormatSize(res.Bytes))
+	if res.Missing > 0 {
+		fmt.Fprintf(os.Stderr, "warning: %d records had no file and were left out\n", res.Missing)
+	}
+}
+
+func restoreCmd(cfg *config.Config, args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	force := fs.Bool("force", false, "restore a full backup over existing data, deleting files not in it")
+	parseFlags(fs, args, "restore [-force] <archive>")
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var r io.Reader = os.Stdin
+	if fs.Arg(0) != "-" {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	o := openOffline(cfg)
+	defer o.close()
+
+	res, err := backup.Restore(r, o.db, cfg.Storage.UploadDir, *force)
+	if errors.Is(err, backup.ErrNotEmpty) {
+		o.close()
+		log.Fatal("The database already has files; use -force to replace it")
+	}
+	if err != nil {
+		o.close()
+		log.Fatalf("Restore failed: %v", err)
+	}
+
+	fmt.Printf("restored %d files, %d blobs (%s) from backup taken %s\n",
+		res.Files, res.Blobs, models.FormatSize(res.Bytes), res.Manifest.Created.Format(time.RFC3339))
+	if res.Removed > 0 {
+		fmt.Printf("removed %d files not in the backup\n", res.Removed)
+	}
+	if res.Missing > 0 {
+		fmt.Printf("warning: %d files are missing; restore the backups this one builds on first\n", res.Missing)
+	}
+}
+
+func applyRetentionCmd(cfg *config.Config, args []string) {
+	fs := flag.NewFlagSet("retention apply", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "report what would change without writing it")
+	parseFlags(fs, args, "retention apply [-dry-run]")
+
+	o := openOffline(cfg)
+	defer o.close()
+
+	changed, expired, err := o.db.ApplyRetention(storage.Retention(), *dryRun)
+	if err != nil {
+		log.Fatal(err)
+	}
+	verb := "updated"
+	if *dryRun {
+		verb = "would update"
+	}
+	fmt.Printf("%s %d files, %d of them now expired\n", verb, changed, expired)
+}
+
+func trashCmd(cfg *config.Config, args []string) {
+	if len(args) > 0 {
+		switch args[0] {
+		case "restore":
+			restoreTrashCmd(cfg, args[1:])
+			return
+		case "purge":
+			purgeTrashCmd(cfg, args[1:])
+			return
+		}
+	}
+
+	fs := flag.NewFlagSet("trash", flag.ExitOnError)
+	parseFlags(fs, args, "trash [restore <name>... | purge [-all]]")
+
+	o := openOffline(cfg)
+	defer o.close()
+
+	entries, err := o.store.TrashList()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSIZE\tREASON\tREMOVED\tPURGE\tORIGINAL")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			e.Metadata.StoredName,
+			models.FormatSize(e.Metadata.Size),
+			e.Reason,
+			e.TrashedAt.Format(time.DateTime),
+			e.PurgeAt.Format(time.DateTime),
+			e.Metadata.OriginalName,
+		)
+	}
+	w.Flush()
+}
+
+func restoreTrashCmd(cfg *config.Config, args []string) {
+	fs := flag.NewFlagSet("trash restore", flag.ExitOnError)
+	parseFlags(fs, args, "trash restore <name>...")
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	o := openOffline(cfg)
+	defer o.close()
+
+	for _, name := range fs.Args() {
+		meta, err := o.store.Restore(name)
+		if err != nil {
+			log.Fatalf("Failed to restore %s: %v", name, err)
+		}
+		fmt.Printf("restored %s, expires %s\n", meta.StoredName, meta.ExpiresAt.Format(time.DateTime))
+	}
+}
+
+func purgeTrashCmd(cfg *config.Config, args []string) {
+	fs := flag.NewFlagSet("trash purge", flag.ExitOnError)
+	all := fs.Bool("all", false, "empty the whole trash, not only files past their grace period")
+	parseFlags(fs, args, "trash purge [-all]")
+
+	o := openOffline(cfg)
+	defer o.close()
+
+	purged, err := o.store.PurgeTrash(*all)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("purged %d files\n", purged)
+}
+
+func blocklistCmd(cfg *config.Config, args []string) {
+	if len(args) > 0 {
+		switch args[0] {
+		case "add":
+			blockCmd(cfg, args[1:])
+			return
+		case "rm":
+			unblockCmd(cfg, args[1:])
+			return
+		case "import":
+			importBlocklistCmd(cfg, args[1:])
+			return
+		}
+	}
+
+	fs := flag.NewFlagSet("blocklist", flag.ExitOnError)
+	parseFlags(fs, args, "blocklist [add <hash|name>... | rm <hash>... | import <file>]")
+
+	bl, _ := openBlocklist(cfg)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "HASH\tADDED\tREASON")
+	for _, e := range bl.Entries() {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", e.Hash, e.AddedAt.Local().Format(time.DateTime), e.Reason)
+	}
+	w.Flush()
+}
+
+// openBlocklist opens the blocklist and audit log. The blocklist commands
+// leave the database alone so they are safe to run next to the server,
+// which removes stored copies when it is sent SIGHUP or next starts.
+func openBlocklist(cfg *config.Config) (*blocklist.List, *audit.Log) {
+	bl, err := blocklist.Open(cfg.Storage.Blocklist)
+	if err != nil {
+		log.Fatalf("Failed to open blocklist: %v", err)
+	}
+	return bl, audit.New(cfg.Storage.AuditLog)
+}
+
+func blockCmd(cfg *config.Config, args []string) {
+	fs := flag.NewFlagSet("blocklist add", flag.ExitOnError)
+	reason := fs.String("reason", "", "why the content is blocked, for the audit log")
+	parseFlags(fs, args, "blocklist add [-reason text] <hash|name>...")
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	hashes, err := resolveHashes(cfg.Storage.DBPath, fs.Args())
+	if err != nil {
+		log.Fatal(err)
+	}
+	block(cfg, hashes, *reason)
+}
+
+// resolveHashes turns each argument into a content hash. Stored files can
+// be named instead of hashes, which is the usual way to take one down;
+// their hash is read from a snapshot of the database at dbPath.
+func resolveHashes(dbPath string, args []string) ([]string, error) {
+	var byName map[string]*storage.FileMetadata
+	hashes := make([]string, 0, len(args))
+	for _, arg := range args {
+		hash, err := blocklist.ParseHash(arg)
+		if err == nil {
+			hashes = append(hashes, hash)
+			continue
+		}
+		if byName == nil {
+			records, err := storage.ReadSnapshot(dbPath)
+			if err != nil {
+				return nil, fmt.Errorf("read %s: %w", dbPath, err)
+			}
+			byName = make(map[string]*storage.FileMetadata, 2*len(records))
+			for _, meta := range records {
+				byName[meta.StoredName] = meta
+				byName[meta.ID] = meta
+			}
+		}
+		meta := byName[arg]
+		if meta == nil {
+			return nil, fmt.Errorf("no such file: %s", arg)
+		}
+		if meta.SHA256 == "" {
+			return nil, fmt.Errorf("%s has no recorded hash", meta.StoredName)
+		}
+		hashes = append(hashes, meta.SHA256)
+	}
+	return hashes, nil
+}
+
+func importBlocklistCmd(cfg *config.Config, args []string) {
+	fs := flag.NewFlagSet("blocklist import", flag.ExitOnError)
+	reason := fs.String("reason", "", "why the content is blocked, for the audit log")
+	parseFlags(fs, args, "blocklist import [-reason text] <file|->")
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var r io.Reader = os.Stdin
+	if fs.Arg(0) != "-" {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		r = f
+	}
+	hashes, err := blocklist.ReadHashes(r)
+	if err != nil {
+		log.Fatalf("Failed to read %s: %v", fs.Arg(0), err)
+	}
+	block(cfg, hashes, *reason)
+}
+
+func block(cfg *config.Config, hashes []string, reason string) {
+	bl, auditLog := openBlocklist(cfg)
+	added, err := bl.Add(hashes, reason)
+	if err != nil {
+		log.Fatalf("Failed to update blocklist: %v", err)
+	}
+	for _, hash := range added {
+		record(auditLog, audit.Entry{Action: audit.BlocklistAdd, Hash: hash, Actor: "cli", Detail: reason})
+	}
+	fmt.Printf("blocked %d new hashes; send the server SIGHUP to remove stored copies\n", len(added))
+}
+
+func unblockCmd(cfg *config.Config, args []string) {
+	fs := flag.NewFlagSet("blocklist rm", flag.ExitOnError)
+	parseFlags(fs, args, "blocklist rm <hash>...")
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	bl, auditLog := openBlocklist(cfg)
+	for _, arg := range fs.Args() {
+		hash, err := blocklist.ParseHash(arg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ok, err := bl.Remove(hash)
+		if err != nil {
+			log.Fatalf("Failed to update blocklist: %v", err)
+		}
+		if !ok {
+			fmt.Printf("%s was not blocked\n", hash)
+			continue
+		}
+		record(auditLog, audit.Entry{Action: audit.BlocklistRemove, Hash: hash, Actor: "cli"})
+		fmt.Printf("unblocked %s\n", hash)
+	}
+}
+
+func record(auditLog *audit.Log, e audit.Entry) {
+	if err := auditLog.Record(e); err != nil {
+		log.Printf("Failed to write audit log: %v", err)
+	}
+}
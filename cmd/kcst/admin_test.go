@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/keircn/kcst/internal/blocklist"
+	"github.com/keircn/kcst/internal/config"
+	"github.com/keircn/kcst/internal/storage"
+)
+
+// TestMain runs the command itself when a test re-executes the binary
+// through runKcst.
+func TestMain(m *testing.M) {
+	if os.Getenv("KCST_TEST_MAIN") == "1" {
+		os.Args = append([]string{"kcst"}, os.Args[1:]...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+const testHash = "a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3"
+
+// testConfig returns a config with every path under a temporary directory.
+func testConfig(t *testing.T) *config.Config {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := config.Default()
+	cfg.Storage.UploadDir = filepath.Join(dir, "uploads")
+	cfg.Storage.DBPath = filepath.Join(dir, "kcst.db")
+	cfg.Storage.Blocklist = filepath.Join(dir, "blocklist.json")
+	cfg.Storage.AuditLog = filepath.Join(dir, "audit.log")
+	cfg.Webhooks.Outbox = filepath.Join(dir, "outbox")
+	return cfg
+}
+
+// runKcst runs kcst with cfg written to a config file and returns its
+// output and exit code.
+func runKcst(t *testing.T, cfg *config.Config, args ...string) (stdout, stderr string, code int) {
+	t.Helper()
+	path := filepath.Join(filepath.Dir(cfg.Storage.DBPath), "config.toml")
+	var buf bytes.Buffer
+	if err := cfg.WriteTOML(&buf, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(os.Args[0], append([]string{"-config", path}, args...)...)
+	cmd.Env = append(os.Environ(), "KCST_TEST_MAIN=1")
+	var out, errOut bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &errOut
+	err := cmd.Run()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		code = exit.ExitCode()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return out.String(), errOut.String(), code
+}
+
+func TestBlocklistLeavesDatabase(t *testing.T) {
+	cfg := testConfig(t)
+	db, err := storage.Open(cfg.Storage.DBPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := &storage.FileMetadata{ID: "abcd", StoredName: "abcd.png", SHA256: testHash, UploadedAt: time.Now()}
+	if err := db.SaveMetadata(meta); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.ReadFile(cfg.Storage.DBPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hashes, err := resolveHashes(cfg.Storage.DBPath, []string{"abcd.png"})
+	if err != nil || len(hashes) != 1 || hashes[0] != testHash {
+		t.Fatalf("resolveHashes = %v, %v", hashes, err)
+	}
+	if _, err := resolveHashes(cfg.Storage.DBPath, []string{"missing.png"}); err == nil {
+		t.Error("resolveHashes of an unknown name succeeded")
+	}
+
+	block(cfg, hashes, "DMCA")
+	bl, err := blocklist.Open(cfg.Storage.Blocklist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := bl.Contains(testHash); !ok || e.Reason != "DMCA" {
+		t.Errorf("blocklist entry = %+v, %v", e, ok)
+	}
+	if log, _ := os.ReadFile(cfg.Storage.AuditLog); !strings.Contains(string(log), `"actor":"cli"`) {
+		t.Errorf("audit log = %q", log)
+	}
+
+	// The database belongs to the server; only the list changed.
+	after, err := os.ReadFile(cfg.Storage.DBPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(after) != string(before) {
+		t.Error("blocking rewrote the database")
+	}
+}
+
+func TestUsageErrors(t *testing.T) {
+	cfg := testConfig(t)
+	tests := []struct {
+		args   []string
+		code   int
+		stderr string
+	}{
+		{[]string{"bogus"}, 2, `unknown command "bogus"`},
+		{[]string{"config"}, 2, "usage: kcst config print"},
+		{[]string{"retention", "now"}, 2, "usage: kcst retention"},
+		{[]string{"rm"}, 2, "usage: kcst rm"},
+		{[]string{"info"}, 2, "usage: kcst info"},
+		{[]string{"info", "a", "b"}, 2, "usage: kcst info"},
+		{[]string{"ls", "-bogus"}, 2, "flag provided but not defined: -bogus"},
+		{[]string{"import"}, 2, "usage: kcst import"},
+		{[]string{"import", "-slug", "x.txt", "a", "b"}, 1, "-slug can only be used with a single file"},
+		{[]string{"backup"}, 2, "usage: kcst backup"},
+		{[]string{"backup", "-base", "a", "-since", "2024-01-01T00:00:00Z", "out"}, 2, "usage: kcst backup"},
+		{[]string{"backup", "-since", "yesterday", "out"}, 1, "Invalid -since"},
+		{[]string{"restore"}, 2, "usage: kcst restore"},
+		{[]string{"trash", "restore"}, 2, "usage: kcst trash restore"},
+		{[]string{"info", "missing.txt"}, 1, "No such file: missing.txt"},
+		{[]string{"rm", "missing.txt"}, 1, "No such file: missing.txt"},
+	}
+	for _, tt := range tests {
+		_, stderr, code := runKcst(t, cfg, tt.args...)
+		if code != tt.code || !strings.Contains(stderr, tt.stderr) {
+			t.Errorf("kcst %s: exit %d, stderr %q; want exit %d and %q",
+				strings.Join(tt.args, " "), code, stderr, tt.code, tt.stderr)
+		}
+	}
+}
+
+func TestOfflineCommands(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Storage.TrashPeriod = time.Hour
+	src := filepath.Join(t.TempDir(), "notes.txt")
+	if err := os.WriteFile(src, []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(want string, args ...string) {
+		t.Helper()
+		stdout, stderr, code := runKcst(t, cfg, args...)
+		if code != 0 {
+			t.Fatalf("kcst %s: exit %d: %s", strings.Join(args, " "), code, stderr)
+		}
+		if !strings.Contains(stdout, want) {
+			t.Errorf("kcst %s: output %q does not contain %q", strings.Join(args, " "), stdout, want)
+		}
+	}
+
+	run("imported "+src+" as readme.txt", "import", "-slug", "readme.txt", src)
+	run("readme.txt", "ls")
+	run("notes.txt", "info", "readme.txt")
+	run("Files:", "stats")
+	if stdout, _, _ := runKcst(t, cfg, "ls", "-type", "image/"); strings.Contains(stdout, "readme.txt") {
+		t.Errorf("ls -type image/ listed a text file:\n%s", stdout)
+	}
+
+	// The import went through the store into the database file.
+	db, err := storage.Open(cfg.Storage.DBPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, _ := db.GetMetadataByStoredName("readme.txt")
+	db.Close()
+	if meta == nil || meta.OriginalName != "notes.txt" || meta.Size != 5 {
+		t.Fatalf("record = %+v", meta)
+	}
+
+	run("removed readme.txt", "rm", "readme.txt")
+	if stdout, _, _ := runKcst(t, cfg, "ls"); strings.Contains(stdout, "readme.txt") {
+		t.Errorf("removed file still listed:\n%s", stdout)
+	}
+	run("readme.txt", "trash")
+	run("restored readme.txt", "trash", "restore", "readme.txt")
+	run("readme.txt", "ls")
+}
+
+// fsck exits non-zero while problems remain, so scripts can act on it.
+func TestFsckExitCode(t *testing.T) {
+	cfg := testConfig(t)
+	if err := os.MkdirAll(cfg.Storage.UploadDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(cfg.Storage.UploadDir, "stray.bin"), []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// Create the database so fsck does not take the files for a lost one.
+	db, err := storage.Open(cfg.Storage.DBPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := &storage.FileMetadata{ID: "abcd", StoredName: "abcd.txt", UploadedAt: time.Now()}
+	if err := db.SaveMetadata(meta); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if err := os.WriteFile(filepath.Join(cfg.Storage.UploadDir, "abcd.txt"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if stdout, _, code := runKcst(t, cfg, "fsck"); code != 1 || !strings.Contains(stdout, "stray.bin") {
+		t.Errorf("fsck: exit %d, output %q", code, stdout)
+	}
+	if _, stderr, code := runKcst(t, cfg, "fsck", "-repair"); code != 0 {
+		t.Errorf("fsck -repair: exit %d: %s", code, stderr)
+	}
+	if stdout, _, code := runKcst(t, cfg, "fsck"); code != 0 {
+		t.Errorf("fsck after repair: exit %d, output %q", code, stdout)
+	}
+}
@@ -1,28 +1,188 @@
 package main
 
 import (
+	"errors"
 	"flag"
+	"fmt"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/keircn/kcst/internal/config"
+	"github.com/keircn/kcst/internal/retention"
 	"github.com/keircn/kcst/internal/server"
 )
 
 func main() {
 	configPath := flag.String("config", "config.toml", "path to config file")
+	overrides := config.RegisterFlags(flag.CommandLine)
+	flag.Usage = usage
 	flag.Parse()
 
-	cfg, err := config.Load(*configPath)
+	cfg, err := config.Load(*configPath, overrides)
 	if err != nil {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
+	args := flag.Args()
+	reload := func() (*config.Config, error) {
+		return config.Load(*configPath, overrides)
+	}
+
+	if len(args) == 0 {
+		serve(cfg, reload)
+		return
+	}
+
+	switch args[0] {
+	case "serve":
+		serve(cfg, reload)
+	case "config":
+		configCmd(cfg, args[1:])
+	case "retention":
+		retentionCmd(cfg, args[1:])
+	case "ls":
+		lsCmd(cfg, args[1:])
+	case "rm":
+		rmCmd(cfg, args[1:])
+	case "info":
+		infoCmd(cfg, args[1:])
+	case "cleanup":
+		cleanupCmd(cfg, args[1:])
+	case "stats":
+		statsCmd(cfg, args[1:])
+	case "import":
+		importCmd(cfg, args[1:])
+	case "fsck":
+		fsckCmd(cfg, args[1:])
+	case "backup":
+		backupCmd(cfg, args[1:])
+	case "restore":
+		restoreCmd(cfg, args[1:])
+	case "trash":
+		trashCmd(cfg, args[1:])
+	case "webhook":
+		webhookCmd(cfg, args[1:])
+	case "blocklist":
+		blocklistCmd(cfg, args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+		usage()
+		os.Exit(2)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: kcst [flags] [command]
+
+Commands:
+  serve          run the server (default)
+  config print   print the effective configuration with secrets redacted
+  retention      print the retention policy as README markdown
+  retention apply
+                 recompute the expiry of stored files under the current policy
+  ls             list stored files (see kcst ls -h for filters)
+  info <name>    show everything known about a file
+  rm <name>...   delete files, moving them to the trash if one is configured
+  cleanup        remove expired files now (-dry-run to only list them)
+  stats          summarise storage usage
+  import <path>  add existing files as if they had been uploaded
+  fsck           check files against metadata (-repair to fix problems)
+  backup <file>  write live files and metadata to a .tar.zst archive
+  restore <file> restore a backup archive
+  trash          list removed files kept in the trash
+  trash restore <name>...
+                 move files back out of the trash
+  trash purge    delete files past their grace period (-all for everything)
+  webhook listen receive webhooks locally and print them, for testing
+  blocklist      list blocked content hashes
+  blocklist add <hash|name>...
+                 block content; the server removes stored copies
+  blocklist rm <hash>...
+                 unblock content
+  blocklist import <file>
+                 block every hash in a plaintext list (sha256sum format)
+
+The maintenance commands other than backup and blocklist edit the database
+directly; stop the server before running them. The blocklist commands only
+edit the blocklist file and may run next to a live server: send it SIGHUP
+afterwards so it rereads the list and removes stored copies, or its next
+blocklist change overwrites yours. A stopped server removes them on start.
+
+Send SIGHUP to reload the config file and blocklist without restarting.
+
+Every config key can be set with a -section.key flag or a KCST_SECTION_KEY
+environment variable. Flags override the environment, which overrides the
+config file.
+
+Flags:
+`)
+	flag.PrintDefaults()
+}
+
+func serve(cfg *config.Config, reload func() (*config.Config, error)) {
 	srv, err := server.New(cfg)
 	if err != nil {
 		log.Fatalf("Failed to create server: %v", err)
 	}
-	defer srv.Close()
 
-	log.Printf("Server starting on %s", cfg.Server.Address)
-	log.Fatal(srv.Run())
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			newCfg, err := reload()
+			if err == nil {
+				err = srv.Reload(newCfg)
+			}
+			if err != nil {
+				log.Printf("Config reload failed, keeping current config: %v", err)
+			}
+		}
+	}()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.Run()
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, http.ErrServerClosed) {
+			srv.Close()
+			log.Fatal(err)
+		}
+	case sig := <-stop:
+		log.Printf("Received %s, shutting down", sig)
+	}
+
+	if err := srv.Shutdown(); err != nil {
+		log.Printf("Shutdown error: %v", err)
+	}
+	log.Printf("Server stopped")
+}
+
+func retentionCmd(cfg *config.Config, args []string) {
+	if len(args) > 0 && args[0] == "apply" {
+		applyRetentionCmd(cfg, args[1:])
+		return
+	}
+	if len(args) != 0 {
+		fmt.Fprintln(os.Stderr, "usage: kcst retention [apply [-dry-run]]")
+		os.Exit(2)
+	}
+	fmt.Print(retention.Markdown(server.RetentionPolicy(cfg), cfg.Retention.MaxFileSize))
+}
+
+func configCmd(cfg *config.Config, args []string) {
+	if len(args) != 1 || args[0] != "print" {
+		fmt.Fprintln(os.Stderr, "usage: kcst config print")
+		os.Exit(2)
+	}
+	if err := cfg.WriteTOML(os.Stdout, true); err != nil {
+		log.Fatal(err)
+	}
 }
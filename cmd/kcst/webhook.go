@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync/atomic"
+
+	"github.com/keircn/kcst/internal/config"
+	"github.com/keircn/kcst/internal/events"
+)
+
+func webhookCmd(cfg *config.Config, args []string) {
+	if len(args) == 0 || args[0] != "listen" {
+		fmt.Fprintln(os.Stderr, "usage: kcst webhook listen [flags]")
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("webhook listen", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:9000", "address to receive webhooks on")
+	fail := fs.Int("fail", 0, "answer the first n requests with 503 to exercise retries")
+	parseFlags(fs, args[1:], "webhook listen [flags]")
+
+	// Signatures are checked against webhooks.secret from the same config
+	// the server uses.
+	secret := cfg.Webhooks.Secret
+	var received atomic.Int64
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		signature := "unsigned"
+		if sig := r.Header.Get(events.SignatureHeader); sig != "" {
+			signature = "signature ok"
+			if !events.Verify(secret, body, sig) {
+				signature = "SIGNATURE INVALID"
+			}
+		}
+
+		var ev events.Event
+		if err := json.Unmarshal(body, &ev); err != nil || ev.File == nil {
+			log.Printf("Unreadable event (%s): %s", signature, body)
+			http.Error(w, "bad event", http.StatusBadRequest)
+			return
+		}
+
+		if n := received.Add(1); n <= int64(*fail) {
+			log.Printf("%s %s %s: failing on purpose (%d/%d)", ev.ID, ev.Type, ev.File.StoredName, n, *fail)
+			http.Error(w, "failing on purpose", http.StatusServiceUnavailable)
+			return
+		}
+		log.Printf("%s %s %s (%s)", ev.ID, ev.Type, ev.File.StoredName, signature)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	log.Printf("Receiving webhooks on http://%s/", *addr)
+	log.Fatal(http.ListenAndServe(*addr, handler))
+}
@@ -1,3 +1,14 @@
 module github.com/keircn/kcst
 
 go 1.25.4
+
+require (
+	github.com/BurntSushi/toml v1.6.0
+	github.com/klauspost/compress v1.18.0
+	golang.org/x/crypto v0.54.0
+)
+
+require (
+	golang.org/x/net v0.56.0 // indirect
+	golang.org/x/text v0.40.0 // indirect
+)
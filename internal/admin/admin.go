@@ -0,0 +1,326 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+
+	"github.com/keircn/kcst/internal/blocklist"
+	"github.com/keircn/kcst/internal/health"
+	"github.com/keircn/kcst/internal/metrics"
+	"github.com/keircn/kcst/internal/storage"
+	"github.com/keircn/kcst/internal/upload"
+)
+
+// Handler serves operational endpoints. It is meant for a separate,
+// private listener and must never be mounted on the public mux.
+type Handler struct {
+	mux   *http.ServeMux
+	db    *storage.DB
+	store *upload.Store
+	token string
+}
+
+// New returns the admin handler. If token is not empty, every endpoint but
+// /healthz requires it in an "Authorization: Bearer" header.
+func New(db *storage.DB, store *upload.Store, checker *health.Checker, token string) *Handler {
+	h := &Handler{
+		mux:   http.NewServeMux(),
+		db:    db,
+		store: store,
+		token: token,
+	}
+
+	h.mux.HandleFunc("GET /healthz", checker.Healthz)
+	h.mux.HandleFunc("GET /readyz", checker.Readyz)
+	h.mux.HandleFunc("GET /metrics", h.metrics)
+	h.mux.HandleFunc("POST /cleanup", h.cleanup)
+	h.mux.HandleFunc("POST /retention/apply", h.applyRetention)
+	h.mux.HandleFunc("GET /trash", h.trash)
+	h.mux.HandleFunc("POST /trash/restore", h.restoreTrash)
+	h.mux.HandleFunc("POST /trash/purge", h.purgeTrash)
+	h.mux.HandleFunc("GET /blocklist", h.blocklist)
+	h.mux.HandleFunc("POST /blocklist", h.block)
+	h.mux.HandleFunc("POST /blocklist/import", h.importBlocklist)
+	h.mux.HandleFunc("DELETE /blocklist/{hash}", h.unblock)
+
+	h.mux.HandleFunc("/debug/pprof/", pprof.Index)
+	h.mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	h.mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	h.mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	h.mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.token != "" && r.URL.Path != "/healthz" && !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="kcst admin"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *Handler) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) == 1
+}
+
+func (h *Handler) metrics(w http.ResponseWriter, r *http.Request) {
+	files, err := h.db.ListMetadata()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	g := metrics.Gauges{Files: len(files)}
+	for _, meta := range files {
+		g.StoredBytes += meta.Size
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := metrics.Write(w, g); err != nil {
+		log.Printf("Failed to write metrics: %v", err)
+	}
+}
+
+func (h *Handler) cleanup(w http.ResponseWriter, r *http.Request) {
+	removed, err := h.store.Cleanup()
+	if err != nil {
+		h.json(w, http.StatusInternalServerError, map[string]any{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	log.Printf("Manual cleanup removed %d files", removed)
+	h.json(w, http.StatusOK, map[string]any{
+		"success": true,
+		"removed": removed,
+	})
+}
+
+// applyRetention recomputes every file's expiry under the current policy.
+// Pass ?dry_run=true to only count what would change.
+func (h *Handler) applyRetention(w http.ResponseWriter, r *http.Request) {
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+	changed, expired, err := h.db.ApplyRetention(storage.Retention(), dryRun)
+	if err != nil {
+		h.json(w, http.StatusInternalServerError, map[string]any{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	if !dryRun {
+		log.Printf("Re-applied retention policy: %d files updated, %d now expired", changed, expired)
+		if err := h.store.Reschedule(); err != nil {
+			log.Printf("Failed to schedule expiry: %v", err)
+		}
+	}
+	h.json(w, http.StatusOK, map[string]any{
+		"success": true,
+		"dry_run": dryRun,
+		"changed": changed,
+		"expired": expired,
+	})
+}
+
+func (h *Handler) trash(w http.ResponseWriter, r *http.Request) {
+	entries, err := h.store.TrashList()
+	if err != nil {
+		h.json(w, http.StatusInternalServerError, map[string]any{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	if entries == nil {
+		entries = []*upload.TrashEntry{}
+	}
+	h.json(w, http.StatusOK, map[string]any{
+		"success": true,
+		"files":   entries,
+	})
+}
+
+// restoreTrash moves the file given by ?name= (stored name or ID) out of
+// the trash.
+func (h *Handler) restoreTrash(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		h.json(w, http.StatusBadRequest, map[string]any{
+			"success": false,
+			"error":   "name is required",
+		})
+		return
+	}
+
+	meta, err := h.store.Restore(name)
+	if err != nil {
+		code := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, upload.ErrNotInTrash):
+			code = http.StatusNotFound
+		case errors.Is(err, upload.ErrNameInUse):
+			code = http.StatusConflict
+		case errors.Is(err, upload.ErrBlocked):
+			code = http.StatusUnavailableForLegalReasons
+		}
+		h.json(w, code, map[string]any{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	log.Printf("Restored %s from the trash", meta.StoredName)
+	h.json(w, http.StatusOK, map[string]any{
+		"success": true,
+		"file":    meta,
+	})
+}
+
+// purgeTrash deletes files past their grace period, or everything in the
+// trash with ?all=true.
+func (h *Handler) purgeTrash(w http.ResponseWriter, r *http.Request) {
+	purged, err := h.store.PurgeTrash(r.URL.Query().Get("all") == "true")
+	if err != nil {
+		h.json(w, http.StatusInternalServerError, map[string]any{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	log.Printf("Purged %d files from the trash", purged)
+	h.json(w, http.StatusOK, map[string]any{
+		"success": true,
+		"purged":  purged,
+	})
+}
+
+func (h *Handler) blocklist(w http.ResponseWriter, r *http.Request) {
+	h.json(w, http.StatusOK, map[string]any{
+		"success": true,
+		"hashes":  h.store.Blocklist().Entries(),
+	})
+}
+
+// block adds ?hash= to the blocklist, or the hash of the stored file
+// ?name=, and removes stored copies. ?reason= is kept for the audit log.
+func (h *Handler) block(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var hash string
+	switch {
+	case q.Get("hash") != "":
+		var err error
+		if hash, err = blocklist.ParseHash(q.Get("hash")); err != nil {
+			h.json(w, http.StatusBadRequest, map[string]any{
+				"success": false,
+				"error":   err.Error(),
+			})
+			return
+		}
+	case q.Get("name") != "":
+		meta, _ := h.db.GetMetadataByStoredName(q.Get("name"))
+		if meta == nil {
+			meta, _ = h.db.GetMetadata(q.Get("name"))
+		}
+		if meta == nil || meta.SHA256 == "" {
+			h.json(w, http.StatusNotFound, map[string]any{
+				"success": false,
+				"error":   "no such file, or it has no recorded hash",
+			})
+			return
+		}
+		hash = meta.SHA256
+	default:
+		h.json(w, http.StatusBadRequest, map[string]any{
+			"success": false,
+			"error":   "hash or name is required",
+		})
+		return
+	}
+
+	h.blockHashes(w, []string{hash}, q.Get("reason"))
+}
+
+// importBlocklist blocks every hash in a plaintext list sent as the body.
+func (h *Handler) importBlocklist(w http.ResponseWriter, r *http.Request) {
+	hashes, err := blocklist.ReadHashes(http.MaxBytesReader(w, r.Body, 64<<20))
+	if err != nil {
+		h.json(w, http.StatusBadRequest, map[string]any{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+	h.blockHashes(w, hashes, r.URL.Query().Get("reason"))
+}
+
+func (h *Handler) blockHashes(w http.ResponseWriter, hashes []string, reason string) {
+	added, removed, err := h.store.Block(hashes, reason, "admin")
+	if err != nil {
+		h.json(w, http.StatusInternalServerError, map[string]any{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	names := make([]string, len(removed))
+	for i, meta := range removed {
+		names[i] = meta.StoredName
+	}
+	log.Printf("Blocked %d new hashes, removed %d files", added, len(removed))
+	h.json(w, http.StatusOK, map[string]any{
+		"success": true,
+		"added":   added,
+		"removed": names,
+	})
+}
+
+func (h *Handler) unblock(w http.ResponseWriter, r *http.Request) {
+	hash, err := blocklist.ParseHash(r.PathValue("hash"))
+	if err != nil {
+		h.json(w, http.StatusBadRequest, map[string]any{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	ok, err := h.store.Unblock(hash, "admin")
+	if err != nil {
+		h.json(w, http.StatusInternalServerError, map[string]any{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+	if !ok {
+		h.json(w, http.StatusNotFound, map[string]any{
+			"success": false,
+			"error":   "hash is not blocked",
+		})
+		return
+	}
+
+	log.Printf("Unblocked %s", hash)
+	h.json(w, http.StatusOK, map[string]any{"success": true})
+}
+
+func (h *Handler) json(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,73 @@
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/keircn/kcst/internal/health"
+	"github.com/keircn/kcst/internal/storage"
+	"github.com/keircn/kcst/internal/upload"
+)
+
+func newTestHandler(t *testing.T, token string) *Handler {
+	t.Helper()
+	dir := t.TempDir()
+	db, err := storage.Open(filepath.Join(dir, "data", "kcst.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	uploads := filepath.Join(dir, "uploads")
+	store, err := upload.NewStore(uploads, db, time.Hour, upload.IDGenerator{Length: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(db, store, health.New(uploads, db, store, 0), token)
+}
+
+func TestToken(t *testing.T) {
+	h := newTestHandler(t, "s3cret")
+
+	tests := []struct {
+		path   string
+		header string
+		code   int
+	}{
+		{"/healthz", "", http.StatusOK},
+		{"/metrics", "", http.StatusUnauthorized},
+		{"/metrics", "Bearer wrong", http.StatusUnauthorized},
+		{"/metrics", "s3cret", http.StatusUnauthorized},
+		{"/metrics", "Bearer s3cret", http.StatusOK},
+		{"/readyz", "", http.StatusUnauthorized},
+		{"/debug/pprof/", "", http.StatusUnauthorized},
+		{"/trash", "Bearer s3cret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		if tt.header != "" {
+			req.Header.Set("Authorization", tt.header)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.code {
+			t.Errorf("GET %s with %q: status %d, want %d", tt.path, tt.header, rec.Code, tt.code)
+		}
+		if rec.Code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("GET %s: 401 without WWW-Authenticate", tt.path)
+		}
+	}
+}
+
+func TestNoToken(t *testing.T) {
+	h := newTestHandler(t, "")
+	for _, path := range []string{"/healthz", "/metrics", "/trash"} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("GET %s: status %d", path, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const MaxEntries = 500
+
+// MaxReadBytes bounds how much decompressed data a listing reads, so a
+// huge tarball is cut short instead of being inflated in full.
+const MaxReadBytes = 64 << 20
+
+var errReadLimit = errors.New("archive: read limit reached")
+
+type Entry struct {
+	Name  string
+	Size  int64
+	IsDir bool
+}
+
+type Format int
+
+const (
+	FormatNone Format = iota
+	FormatZip
+	FormatTar
+	FormatTarGz
+)
+
+func Detect(contentType, filename string) Format {
+	ct := strings.ToLower(contentType)
+	name := strings.ToLower(filename)
+
+	switch {
+	case ct == "application/zip" || ct == "application/x-zip-compressed":
+		return FormatZip
+	case ct == "application/x-tar" || ct == "application/x-gtar":
+		return FormatTar
+	case ct == "application/x-compressed-tar":
+		return FormatTarGz
+	}
+
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return FormatZip
+	case strings.HasSuffix(name, ".tar"):
+		return FormatTar
+	case strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz"):
+		return FormatTarGz
+	}
+
+	if (ct == "application/gzip" || ct == "application/x-gzip") && filepath.Ext(strings.TrimSuffix(name, ".gz")) == ".tar" {
+		return FormatTarGz
+	}
+	return FormatNone
+}
+
+// List returns at most MaxEntries entries from the archive. The second
+// return value reports whether the listing was cut short.
+func List(file *os.File, size int64, format Format) ([]Entry, bool, error) {
+	switch format {
+	case FormatZip:
+		return listZip(file, size)
+	case FormatTar:
+		return listTar(file)
+	case FormatTarGz:
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, false, err
+		}
+		defer gz.Close()
+		return listTar(&limitReader{r: gz, n: MaxReadBytes})
+	}
+	return nil, false, nil
+}
+
+func listZip(r io.ReaderAt, size int64) ([]Entry, bool, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, false, err
+	}
+
+	entries := make([]Entry, 0, min(len(zr.File), MaxEntries))
+	for _, f := range zr.File {
+		if len(entries) == MaxEntries {
+			return entries, true, nil
+		}
+		entries = append(entries, Entry{
+			Name:  f.Name,
+			Size:  int64(f.UncompressedSize64),
+			IsDir: f.FileInfo().IsDir(),
+		})
+	}
+	return entries, false, nil
+}
+
+func listTar(r io.Reader) ([]Entry, bool, error) {
+	tr := tar.NewReader(r)
+
+	var entries []Entry
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries, false, nil
+		}
+		if errors.Is(err, errReadLimit) {
+			return entries, true, nil
+		}
+		if err != nil {
+			return entries, false, err
+		}
+		if len(entries) == MaxEntries {
+			return entries, true, nil
+		}
+		entries = append(entries, Entry{
+			Name:  hdr.Name,
+			Size:  hdr.Size,
+			IsDir: hdr.Typeflag == tar.TypeDir,
+		})
+	}
+}
+
+// limitReader is io.LimitReader with a distinct error, so running out of
+// budget can be told apart from a truncated archive.
+type limitReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		return 0, errReadLimit
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+type Listing struct {
+	Entries   []Entry
+	Truncated bool
+	Err       error
+}
+
+// Cache keeps the listings of recently previewed archives so repeated
+// previews do not read the archive again. The oldest listing is dropped
+// once it holds max of them.
+type Cache struct {
+	max int
+
+	mu    sync.Mutex
+	items map[string]*Listing
+	order []string
+}
+
+func NewCache(max int) *Cache {
+	return &Cache{
+		max:   max,
+		items: make(map[string]*Listing),
+	}
+}
+
+// List returns the cached listing for key, reading it from file first if
+// it is not cached. key must change whenever the file's content can.
+func (c *Cache) List(key string, file *os.File, size int64, format Format) *Listing {
+	c.mu.Lock()
+	l, ok := c.items[key]
+	c.mu.Unlock()
+	if ok {
+		return l
+	}
+
+	l = &Listing{}
+	l.Entries, l.Truncated, l.Err = List(file, size, format)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.items[key]; !ok {
+		if len(c.order) == c.max {
+			delete(c.items, c.order[0])
+			c.order = c.order[1:]
+		}
+		c.items[key] = l
+		c.order = append(c.order, key)
+	}
+	return l
+}
@@ -0,0 +1,209 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		contentType, filename string
+		want                  Format
+	}{
+		{"application/zip", "a.bin", FormatZip},
+		{"application/x-zip-compressed", "a", FormatZip},
+		{"application/x-tar", "a", FormatTar},
+		{"application/x-compressed-tar", "a", FormatTarGz},
+		{"application/octet-stream", "A.ZIP", FormatZip},
+		{"application/octet-stream", "a.tar", FormatTar},
+		{"application/octet-stream", "a.tar.gz", FormatTarGz},
+		{"application/octet-stream", "a.tgz", FormatTarGz},
+		{"application/gzip", "a.tar.gz", FormatTarGz},
+		{"application/gzip", "a.gz", FormatNone},
+		{"image/png", "a.png", FormatNone},
+	}
+	for _, tt := range tests {
+		if got := Detect(tt.contentType, tt.filename); got != tt.want {
+			t.Errorf("Detect(%q, %q) = %v, want %v", tt.contentType, tt.filename, got, tt.want)
+		}
+	}
+}
+
+type file struct {
+	name string
+	data []byte
+}
+
+func writeZip(t *testing.T, files []file) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range files {
+		w, err := zw.Create(f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(f.data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func writeTar(t *testing.T, w io.Writer, files []file) {
+	t.Helper()
+	tw := tar.NewWriter(w)
+	for _, f := range files {
+		hdr := &tar.Header{Name: f.name, Mode: 0o644, Size: int64(len(f.data)), Typeflag: tar.TypeReg}
+		if len(f.name) > 0 && f.name[len(f.name)-1] == '/' {
+			hdr.Typeflag = tar.TypeDir
+			hdr.Mode = 0o755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(f.data)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeTarGz(t *testing.T, files []file) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	writeTar(t, gz, files)
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func tempFile(t *testing.T, data []byte) *os.File {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "archive")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func TestList(t *testing.T) {
+	files := []file{
+		{"dir/", nil},
+		{"dir/a.txt", []byte("hello")},
+		{"b.bin", make([]byte, 1000)},
+	}
+	var tarBuf bytes.Buffer
+	writeTar(t, &tarBuf, files)
+
+	tests := []struct {
+		name   string
+		data   []byte
+		format Format
+	}{
+		{"zip", writeZip(t, files), FormatZip},
+		{"tar", tarBuf.Bytes(), FormatTar},
+		{"tar.gz", writeTarGz(t, files), FormatTarGz},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, truncated, err := List(tempFile(t, tt.data), int64(len(tt.data)), tt.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if truncated {
+				t.Error("listing truncated")
+			}
+			want := []Entry{
+				{Name: "dir/", IsDir: true},
+				{Name: "dir/a.txt", Size: 5},
+				{Name: "b.bin", Size: 1000},
+			}
+			if fmt.Sprint(entries) != fmt.Sprint(want) {
+				t.Errorf("entries = %v, want %v", entries, want)
+			}
+		})
+	}
+}
+
+func TestListTruncated(t *testing.T) {
+	var files []file
+	for i := range MaxEntries + 1 {
+		files = append(files, file{name: fmt.Sprintf("f%d", i)})
+	}
+	for _, format := range []Format{FormatZip, FormatTarGz} {
+		var data []byte
+		if format == FormatZip {
+			data = writeZip(t, files)
+		} else {
+			data = writeTarGz(t, files)
+		}
+		entries, truncated, err := List(tempFile(t, data), int64(len(data)), format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !truncated || len(entries) != MaxEntries {
+			t.Errorf("format %v: got %d entries, truncated %v", format, len(entries), truncated)
+		}
+	}
+}
+
+func TestListReadLimit(t *testing.T) {
+	data := writeTarGz(t, []file{
+		{"big", make([]byte, MaxReadBytes+1)},
+		{"after", nil},
+	})
+	entries, truncated, err := List(tempFile(t, data), int64(len(data)), FormatTarGz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !truncated {
+		t.Error("listing not truncated at the read limit")
+	}
+	if len(entries) != 1 || entries[0].Name != "big" {
+		t.Errorf("entries = %v, want only big", entries)
+	}
+}
+
+func TestCache(t *testing.T) {
+	data := writeZip(t, []file{{"a", nil}})
+	c := NewCache(2)
+
+	first := c.List("a", tempFile(t, data), int64(len(data)), FormatZip)
+	if first.Err != nil || len(first.Entries) != 1 {
+		t.Fatalf("listing = %+v", first)
+	}
+	// A cached listing is returned without touching the file.
+	if got := c.List("a", nil, 0, FormatZip); got != first {
+		t.Error("listing was not cached")
+	}
+
+	c.List("b", tempFile(t, data), int64(len(data)), FormatZip)
+	c.List("c", tempFile(t, data), int64(len(data)), FormatZip)
+	if got := c.List("a", tempFile(t, data), int64(len(data)), FormatZip); got == first {
+		t.Error("oldest listing was not evicted")
+	}
+}
+
+func TestCacheError(t *testing.T) {
+	data := []byte("not a zip")
+	c := NewCache(1)
+	if l := c.List("x", tempFile(t, data), int64(len(data)), FormatZip); l.Err == nil {
+		t.Error("expected an error for a corrupt archive")
+	}
+}
@@ -0,0 +1,68 @@
+// Package audit appends a record of moderation actions to a log file, one
+// JSON object per line.
+package audit
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Actions recorded in the log.
+const (
+	BlocklistAdd    = "blocklist.add"
+	BlocklistRemove = "blocklist.remove"
+	UploadRejected  = "upload.rejected"
+	FileRemoved     = "file.removed"
+)
+
+type Entry struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	Hash   string    `json:"hash,omitempty"`
+	File   string    `json:"file,omitempty"`
+	// Actor is who caused the action: a client address, "cli", "admin" or
+	// "reload".
+	Actor  string `json:"actor,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type Log struct {
+	path string
+	mu   sync.Mutex
+}
+
+func New(path string) *Log {
+	return &Log{path: path}
+}
+
+// Record appends e to the log, filling in its time. The file is opened for
+// every record so it can be rotated without signalling the server.
+func (l *Log) Record(e Entry) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(l.path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(line); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
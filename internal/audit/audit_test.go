@@ -0,0 +1,76 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func readLog(t *testing.T, path string) []Entry {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var entries []Entry
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e Entry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatalf("line %q: %v", sc.Text(), err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "audit.log")
+	l := New(path)
+
+	at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := l.Record(Entry{Time: at, Action: BlocklistAdd, Hash: "abc", Actor: "cli", Detail: "DMCA"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Record(Entry{Action: FileRemoved, File: "a.png"}); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := readLog(t, path)
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(entries))
+	}
+	if e := entries[0]; !e.Time.Equal(at) || e.Action != BlocklistAdd || e.Hash != "abc" || e.Actor != "cli" || e.Detail != "DMCA" {
+		t.Errorf("first entry = %+v", e)
+	}
+	if e := entries[1]; e.Time.IsZero() || e.Action != FileRemoved || e.File != "a.png" {
+		t.Errorf("second entry = %+v", e)
+	}
+}
+
+func TestRecordAfterRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l := New(path)
+
+	if err := l.Record(Entry{Action: BlocklistAdd}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Record(Entry{Action: BlocklistRemove}); err != nil {
+		t.Fatal(err)
+	}
+
+	if entries := readLog(t, path); len(entries) != 1 || entries[0].Action != BlocklistRemove {
+		t.Errorf("new log = %+v", entries)
+	}
+	if entries := readLog(t, path+".1"); len(entries) != 1 || entries[0].Action != BlocklistAdd {
+		t.Errorf("rotated log = %+v", entries)
+	}
+}
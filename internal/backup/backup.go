@@ -0,0 +1,393 @@
+// Package backup writes and reads instance archives: a zstd-compressed tar
+// holding a manifest, the blobs and thumbnails of live files, and a
+// snapshot of the metadata database.
+package backup
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/keircn/kcst/internal/storage"
+	"github.com/keircn/kcst/internal/upload"
+)
+
+const (
+	formatVersion = 1
+
+	manifestName = "manifest.json"
+	dbName       = "kcst.db"
+	filesPrefix  = "files/"
+	thumbsPrefix = "thumbs/"
+)
+
+var ErrNotEmpty = errors.New("backup: database is not empty")
+
+// Manifest is the first entry of every archive.
+type Manifest struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	// Since is set on incremental archives, which only hold blobs written
+	// after it. The database snapshot is always complete.
+	Since time.Time `json:"since,omitzero"`
+}
+
+func (m *Manifest) Incremental() bool {
+	return !m.Since.IsZero()
+}
+
+type Result struct {
+	Manifest Manifest
+	Files    int
+	Blobs    int
+	Bytes    int64
+	Missing  int
+	// Removed counts files a forced full restore deleted because the
+	// snapshot does not know them.
+	Removed int
+}
+
+// Create writes an archive of the instance whose database is at dbPath and
+// whose blobs live in uploadDir. Expired files are left out. If since is
+// non-zero only blobs modified after it are included.
+//
+// It is safe to run against a live server: the database is read from its
+// last atomic save, and records whose blob disappears before it is copied
+// are dropped from the snapshot, which is written last.
+func Create(w io.Writer, dbPath, uploadDir string, since time.Time) (*Result, error) {
+	records, err := storage.ReadSnapshot(dbPath)
+	if err != nil {
+		return nil, err
+	}
+
+	zw, err := zstd.NewWriter(w)
+	if err != nil {
+		return nil, err
+	}
+	// Close releases the encoder's goroutines; after the explicit Close
+	// below it is a no-op.
+	defer zw.Close()
+	tw := tar.NewWriter(zw)
+
+	res := &Result{Manifest: Manifest{
+		Version: formatVersion,
+		Created: time.Now().UTC(),
+		Since:   since,
+	}}
+	if err := writeJSON(tw, manifestName, res.Manifest); err != nil {
+		return nil, err
+	}
+
+	live := make(map[string]*storage.FileMetadata, len(records))
+	for _, meta := range records {
+		// Infected content was quarantined or deleted and is not restored.
+		if meta.IsExpired() || meta.Scan == storage.ScanInfected {
+			continue
+		}
+
+		written, err := addFile(tw, filesPrefix+meta.StoredName, filepath.Join(uploadDir, meta.StoredName), since)
+		if os.IsNotExist(err) {
+			res.Missing++
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", meta.StoredName, err)
+		}
+		if written >= 0 {
+			res.Blobs++
+			res.Bytes += written
+		}
+
+		if meta.Thumbnail {
+			if _, err := addFile(tw, thumbsPrefix+meta.ID+".jpg", upload.ThumbnailPath(uploadDir, meta.ID), since); err != nil && !os.IsNotExist(err) {
+				return nil, fmt.Errorf("thumbnail for %s: %w", meta.StoredName, err)
+			}
+		}
+		live[meta.ID] = meta
+	}
+	res.Files = len(live)
+
+	if err := writeJSON(tw, dbName, live); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// addFile copies the file at src into the archive as name and returns its
+// size, or -1 if it was skipped for not being modified after since.
+func addFile(tw *tar.Writer, name, src string, since time.Time) (int64, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if !since.IsZero() && !info.ModTime().After(since) {
+		return -1, nil
+	}
+
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0o644,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return 0, err
+	}
+	return io.Copy(tw, f)
+}
+
+func writeJSON(tw *tar.Writer, name string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0o644,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+// ReadManifest returns the manifest of the archive read from r.
+func ReadManifest(r io.Reader) (*Manifest, error) {
+	zr, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	tr := tar.NewReader(zr)
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, err
+	}
+	if hdr.Name != manifestName {
+		return nil, errors.New("backup: archive does not start with a manifest")
+	}
+	return decodeManifest(tr)
+}
+
+func decodeManifest(r io.Reader) (*Manifest, error) {
+	var m Manifest
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, err
+	}
+	if m.Version != formatVersion {
+		return nil, fmt.Errorf("backup: unsupported archive version %d", m.Version)
+	}
+	return &m, nil
+}
+
+// Restore unpacks an archive into uploadDir and replaces the contents of db
+// with its snapshot. The server must not be running. A full archive is only
+// restored over a non-empty database when force is set, and then files and
+// thumbnails the snapshot does not know are deleted; incremental archives
+// are meant to be applied on top of their base. Missing counts records
+// whose blob is neither in this archive nor already on disk.
+func Restore(r io.Reader, db *storage.DB, uploadDir string, force bool) (*Result, error) {
+	zr, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, err
+	}
+	if hdr.Name != manifestName {
+		return nil, errors.New("backup: archive does not start with a manifest")
+	}
+	manifest, err := decodeManifest(tr)
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{Manifest: *manifest}
+
+	existing, _ := db.ListMetadata()
+	if len(existing) > 0 && !manifest.Incremental() && !force {
+		return nil, ErrNotEmpty
+	}
+
+	var records map[string]*storage.FileMetadata
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case hdr.Name == dbName:
+			if err := json.NewDecoder(tr).Decode(&records); err != nil {
+				return nil, fmt.Errorf("backup: database snapshot: %w", err)
+			}
+		case strings.HasPrefix(hdr.Name, filesPrefix):
+			name, ok := entryName(hdr.Name, filesPrefix)
+			if !ok {
+				log.Printf("Skipping unexpected archive entry %q", hdr.Name)
+				continue
+			}
+			if err := extract(tr, hdr, filepath.Join(uploadDir, name)); err != nil {
+				return nil, err
+			}
+			res.Blobs++
+			res.Bytes += hdr.Size
+		case strings.HasPrefix(hdr.Name, thumbsPrefix):
+			name, ok := entryName(hdr.Name, thumbsPrefix)
+			if !ok {
+				log.Printf("Skipping unexpected archive entry %q", hdr.Name)
+				continue
+			}
+			dst := upload.ThumbnailPath(uploadDir, strings.TrimSuffix(name, ".jpg"))
+			if err := extract(tr, hdr, dst); err != nil {
+				return nil, err
+			}
+		default:
+			log.Printf("Skipping unexpected archive entry %q", hdr.Name)
+		}
+	}
+	if records == nil {
+		return nil, errors.New("backup: archive has no database snapshot")
+	}
+
+	list := make([]*storage.FileMetadata, 0, len(records))
+	for _, meta := range records {
+		// Names from the snapshot become paths under uploadDir.
+		if _, ok := entryName(meta.StoredName, ""); !ok {
+			return nil, fmt.Errorf("backup: database snapshot: invalid stored name %q", meta.StoredName)
+		}
+		if _, ok := entryName(meta.ID, ""); !ok {
+			return nil, fmt.Errorf("backup: database snapshot: invalid id %q", meta.ID)
+		}
+		if _, err := os.Stat(filepath.Join(uploadDir, meta.StoredName)); err != nil {
+			res.Missing++
+		}
+		list = append(list, meta)
+	}
+	res.Files = len(list)
+
+	if err := db.Replace(list); err != nil {
+		return nil, err
+	}
+	if len(existing) > 0 && !manifest.Incremental() {
+		removed, err := removeUnknown(uploadDir, records)
+		res.Removed = removed
+		if err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// removeUnknown deletes the blobs and thumbnails in uploadDir that belong
+// to none of records, so a forced restore does not leave behind the files
+// of the instance it replaced. Hidden entries such as the trash and
+// quarantine are left alone.
+func removeUnknown(uploadDir string, records map[string]*storage.FileMetadata) (int, error) {
+	names := make(map[string]bool, len(records))
+	for _, meta := range records {
+		names[meta.StoredName] = true
+	}
+
+	entries, err := os.ReadDir(uploadDir)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || strings.HasPrefix(name, ".") || names[name] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(uploadDir, name)); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+
+	thumbDir := upload.ThumbnailDir(uploadDir)
+	thumbs, err := os.ReadDir(thumbDir)
+	if os.IsNotExist(err) {
+		return removed, nil
+	}
+	if err != nil {
+		return removed, err
+	}
+	for _, e := range thumbs {
+		if _, ok := records[strings.TrimSuffix(e.Name(), ".jpg")]; ok || e.IsDir() {
+			continue
+		}
+		if err := os.Remove(filepath.Join(thumbDir, e.Name())); err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// entryName strips prefix from an archive path and rejects anything that
+// could escape the target directory.
+func entryName(name, prefix string) (string, bool) {
+	name = strings.TrimPrefix(name, prefix)
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return "", false
+	}
+	return name, true
+}
+
+// extract writes the current entry to dst through a temporary file so an
+// interrupted restore never leaves a truncated blob under its real name.
+func extract(r io.Reader, hdr *tar.Header, dst string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".restore-*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Chtimes(dst, hdr.ModTime, hdr.ModTime)
+}
@@ -0,0 +1,239 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/keircn/kcst/internal/storage"
+	"github.com/keircn/kcst/internal/upload"
+)
+
+type instance struct {
+	dbPath string
+	dir    string
+	db     *storage.DB
+}
+
+func newInstance(t *testing.T) *instance {
+	t.Helper()
+	root := t.TempDir()
+	in := &instance{dbPath: filepath.Join(root, "kcst.db"), dir: filepath.Join(root, "uploads")}
+	db, err := storage.Open(in.dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	in.db = db
+	if err := os.MkdirAll(upload.ThumbnailDir(in.dir), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return in
+}
+
+// add stores a blob and its record and saves the database to disk.
+func (in *instance) add(t *testing.T, id, content string, thumb bool) *storage.FileMetadata {
+	t.Helper()
+	meta := &storage.FileMetadata{
+		ID:         id,
+		StoredName: id + ".txt",
+		Size:       int64(len(content)),
+		UploadedAt: time.Now(),
+		ExpiresAt:  time.Now().Add(time.Hour),
+		Thumbnail:  thumb,
+	}
+	if err := os.WriteFile(filepath.Join(in.dir, meta.StoredName), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if thumb {
+		if err := os.WriteFile(upload.ThumbnailPath(in.dir, id), []byte("jpeg"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := in.db.SaveMetadata(meta); err != nil {
+		t.Fatal(err)
+	}
+	return meta
+}
+
+func backup(t *testing.T, in *instance, since time.Time) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	if _, err := Create(&buf, in.dbPath, in.dir, since); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestRoundTrip(t *testing.T) {
+	src := newInstance(t)
+	src.add(t, "a", "alpha", true)
+	src.add(t, "b", "beta", false)
+	expired := src.add(t, "c", "gone", false)
+	src.db.Update(expired.ID, func(m *storage.FileMetadata) { m.ExpiresAt = time.Now().Add(-time.Minute) })
+
+	archive := backup(t, src, time.Time{})
+	m, err := ReadManifest(bytes.NewReader(archive.Bytes()))
+	if err != nil || m.Incremental() {
+		t.Fatalf("manifest = %+v, %v", m, err)
+	}
+
+	dst := newInstance(t)
+	res, err := Restore(archive, dst.db, dst.dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Files != 2 || res.Blobs != 2 || res.Missing != 0 {
+		t.Errorf("result = %+v", res)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dst.dir, "a.txt")); string(data) != "alpha" {
+		t.Errorf("a.txt = %q", data)
+	}
+	if !exists(upload.ThumbnailPath(dst.dir, "a")) {
+		t.Error("thumbnail not restored")
+	}
+	if exists(filepath.Join(dst.dir, "c.txt")) {
+		t.Error("expired file restored")
+	}
+	if meta, err := dst.db.GetMetadata("b"); err != nil || meta.StoredName != "b.txt" {
+		t.Errorf("record b = %+v, %v", meta, err)
+	}
+}
+
+func TestIncremental(t *testing.T) {
+	src := newInstance(t)
+	src.add(t, "a", "alpha", false)
+	full := backup(t, src, time.Time{})
+
+	since := time.Now().Add(-time.Hour)
+	old := since.Add(-time.Hour)
+	os.Chtimes(filepath.Join(src.dir, "a.txt"), old, old)
+	src.add(t, "b", "beta", false)
+	incr := backup(t, src, since)
+
+	dst := newInstance(t)
+	res, err := Restore(bytes.NewReader(incr.Bytes()), dst.db, dst.dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Blobs != 1 || res.Missing != 1 {
+		t.Errorf("incremental alone: %+v", res)
+	}
+
+	if _, err := Restore(full, dst.db, dst.dir, false); !errors.Is(err, ErrNotEmpty) {
+		t.Fatalf("full restore over data: err = %v, want ErrNotEmpty", err)
+	}
+
+	dst = newInstance(t)
+	if _, err := Restore(backup(t, src, time.Time{}), dst.db, dst.dir, false); err != nil {
+		t.Fatal(err)
+	}
+	res, err = Restore(bytes.NewReader(incr.Bytes()), dst.db, dst.dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Missing != 0 || res.Files != 2 {
+		t.Errorf("incremental on its base: %+v", res)
+	}
+}
+
+func TestForceRemovesUnknown(t *testing.T) {
+	src := newInstance(t)
+	src.add(t, "a", "alpha", false)
+	archive := backup(t, src, time.Time{})
+
+	dst := newInstance(t)
+	dst.add(t, "a", "stale", false)
+	dst.add(t, "z", "newer", true)
+	trashed := filepath.Join(dst.dir, ".trash", "y.txt")
+	os.MkdirAll(filepath.Dir(trashed), 0o755)
+	os.WriteFile(trashed, []byte("x"), 0o644)
+
+	res, err := Restore(archive, dst.db, dst.dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Removed != 1 {
+		t.Errorf("removed %d files, want 1", res.Removed)
+	}
+	if exists(filepath.Join(dst.dir, "z.txt")) || exists(upload.ThumbnailPath(dst.dir, "z")) {
+		t.Error("file not in the backup kept")
+	}
+	if data, _ := os.ReadFile(filepath.Join(dst.dir, "a.txt")); string(data) != "alpha" {
+		t.Errorf("a.txt = %q", data)
+	}
+	if !exists(trashed) {
+		t.Error("trash cleared")
+	}
+	if meta, _ := dst.db.GetMetadata("z"); meta != nil {
+		t.Error("record z kept")
+	}
+}
+
+// craft builds an archive from raw entries.
+func craft(t *testing.T, entries map[string]string) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	zw, _ := zstd.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	write := func(name, data string) {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(data))})
+		tw.Write([]byte(data))
+	}
+	write(manifestName, `{"version": 1}`)
+	for name, data := range entries {
+		write(name, data)
+	}
+	tw.Close()
+	zw.Close()
+	return &buf
+}
+
+func TestRestoreRejectsUnsafeNames(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries map[string]string
+	}{
+		{"stored name with a separator", map[string]string{dbName: `{"a": {"id": "a", "stored_name": "../../etc/passwd"}}`}},
+		{"stored name is dot-dot", map[string]string{dbName: `{"a": {"id": "a", "stored_name": ".."}}`}},
+		{"id with a separator", map[string]string{dbName: `{"a": {"id": "../x", "stored_name": "a.txt"}}`}},
+		{"empty stored name", map[string]string{dbName: `{"a": {"id": "a", "stored_name": ""}}`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := newInstance(t)
+			if _, err := Restore(craft(t, tt.entries), dst.db, dst.dir, false); err == nil {
+				t.Fatal("expected an error")
+			}
+			if files, _ := dst.db.ListMetadata(); len(files) != 0 {
+				t.Errorf("records written: %v", files)
+			}
+		})
+	}
+}
+
+func TestRestoreSkipsUnsafeEntries(t *testing.T) {
+	dst := newInstance(t)
+	_, err := Restore(craft(t, map[string]string{
+		"files/../escape": "x",
+		"files/a/b":       "x",
+		dbName:            `{}`,
+	}), dst.db, dst.dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists(filepath.Join(filepath.Dir(dst.dir), "escape")) || exists(filepath.Join(dst.dir, "a")) {
+		t.Error("unsafe entry extracted")
+	}
+}
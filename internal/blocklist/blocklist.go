@@ -0,0 +1,199 @@
+// Package blocklist keeps the SHA-256 hashes of content that must not be
+// stored, such as files taken down after a complaint.
+package blocklist
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Entry struct {
+	Hash    string    `json:"hash"`
+	Reason  string    `json:"reason,omitempty"`
+	AddedAt time.Time `json:"added_at"`
+}
+
+// List is a set of blocked hashes saved to a JSON file on every change.
+type List struct {
+	path string
+
+	mu      sync.RWMutex
+	entries map[string]*Entry
+}
+
+// Open loads the list at path, creating an empty one if it does not exist.
+func Open(path string) (*List, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+
+	entries, err := load(path)
+	if err != nil {
+		return nil, err
+	}
+	return &List{path: path, entries: entries}, nil
+}
+
+func load(path string) (map[string]*Entry, error) {
+	entries := make(map[string]*Entry)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("blocklist %s: %w", path, err)
+	}
+	if entries == nil {
+		entries = make(map[string]*Entry)
+	}
+	return entries, nil
+}
+
+// Reload replaces the list with the file on disk, picking up changes made
+// by another process, and returns the hashes that were not blocked before.
+func (l *List) Reload() ([]string, error) {
+	entries, err := load(l.path)
+	if err != nil {
+		return nil, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var added []string
+	for hash := range entries {
+		if _, ok := l.entries[hash]; !ok {
+			added = append(added, hash)
+		}
+	}
+	sort.Strings(added)
+	l.entries = entries
+	return added, nil
+}
+
+// ParseHash normalises a hex SHA-256 hash.
+func ParseHash(s string) (string, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if b, err := hex.DecodeString(s); err != nil || len(b) != 32 {
+		return "", fmt.Errorf("%q is not a SHA-256 hash", s)
+	}
+	return s, nil
+}
+
+// ReadHashes parses a plaintext hash list: one hash per line, optionally
+// followed by whitespace and a file name as printed by sha256sum. Blank
+// lines and lines starting with '#' are skipped.
+func ReadHashes(r io.Reader) ([]string, error) {
+	var hashes []string
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hash, err := ParseHash(strings.Fields(line)[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, sc.Err()
+}
+
+// Contains returns the entry for hash if it is blocked.
+func (l *List) Contains(hash string) (*Entry, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	e, ok := l.entries[hash]
+	return e, ok
+}
+
+// Add blocks the given hashes and returns the ones that were not already
+// blocked. The hashes must have been normalised with ParseHash.
+func (l *List) Add(hashes []string, reason string) ([]string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now().UTC()
+	var added []string
+	for _, hash := range hashes {
+		if _, ok := l.entries[hash]; ok {
+			continue
+		}
+		l.entries[hash] = &Entry{Hash: hash, Reason: reason, AddedAt: now}
+		added = append(added, hash)
+	}
+	if len(added) == 0 {
+		return nil, nil
+	}
+	if err := l.save(); err != nil {
+		for _, hash := range added {
+			delete(l.entries, hash)
+		}
+		return nil, err
+	}
+	return added, nil
+}
+
+// Remove unblocks hash and reports whether it was blocked.
+func (l *List) Remove(hash string) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, ok := l.entries[hash]
+	if !ok {
+		return false, nil
+	}
+	delete(l.entries, hash)
+	if err := l.save(); err != nil {
+		l.entries[hash] = e
+		return false, err
+	}
+	return true, nil
+}
+
+// Entries returns every blocked hash, oldest first.
+func (l *List) Entries() []*Entry {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	entries := make([]*Entry, 0, len(l.entries))
+	for _, e := range l.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].AddedAt.Equal(entries[j].AddedAt) {
+			return entries[i].AddedAt.Before(entries[j].AddedAt)
+		}
+		return entries[i].Hash < entries[j].Hash
+	})
+	return entries
+}
+
+// save writes the list through a temporary file so an interrupted save
+// never leaves a truncated list behind. The caller must hold l.mu.
+func (l *List) save() error {
+	data, err := json.MarshalIndent(l.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := l.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, l.path)
+}
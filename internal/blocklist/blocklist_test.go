@@ -0,0 +1,146 @@
+package blocklist
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const (
+	hashA = "a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3"
+	hashB = "b5bb9d8014a0f9b1d61e21e796d78dccdf1352f23cd32812f4850b878ae4944c"
+)
+
+func hashes(l *List) []string {
+	var out []string
+	for _, e := range l.Entries() {
+		out = append(out, e.Hash)
+	}
+	return out
+}
+
+func TestParseHash(t *testing.T) {
+	if got, err := ParseHash("  " + strings.ToUpper(hashA) + "\n"); err != nil || got != hashA {
+		t.Errorf("ParseHash(upper) = %q, %v", got, err)
+	}
+	for _, s := range []string{"", "abc", hashA[:62], hashA + "00", "z" + hashA[1:]} {
+		if _, err := ParseHash(s); err == nil {
+			t.Errorf("ParseHash(%q) succeeded", s)
+		}
+	}
+}
+
+func TestReadHashes(t *testing.T) {
+	in := "# takedown batch\n\n" + hashA + "  file.png\n" + strings.ToUpper(hashB) + "\n"
+	got, err := ReadHashes(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, []string{hashA, hashB}) {
+		t.Errorf("ReadHashes = %v", got)
+	}
+
+	_, err = ReadHashes(strings.NewReader(hashA + "\nnot-a-hash\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("bad line: err = %v", err)
+	}
+}
+
+func TestAddRemove(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data", "blocklist.json")
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Entries()) != 0 {
+		t.Fatal("new list is not empty")
+	}
+
+	added, err := l.Add([]string{hashA, hashB}, "DMCA")
+	if err != nil || !slices.Equal(added, []string{hashA, hashB}) {
+		t.Fatalf("Add = %v, %v", added, err)
+	}
+	if added, err := l.Add([]string{hashA}, "again"); err != nil || added != nil {
+		t.Errorf("Add of a blocked hash = %v, %v", added, err)
+	}
+	e, ok := l.Contains(hashA)
+	if !ok || e.Reason != "DMCA" || e.AddedAt.IsZero() {
+		t.Errorf("Contains = %+v, %v", e, ok)
+	}
+
+	if ok, err := l.Remove(hashA); err != nil || !ok {
+		t.Errorf("Remove = %v, %v", ok, err)
+	}
+	if ok, err := l.Remove(hashA); err != nil || ok {
+		t.Errorf("second Remove = %v, %v", ok, err)
+	}
+
+	// Changes are saved as they are made.
+	l2, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hashes(l2); !slices.Equal(got, []string{hashB}) {
+		t.Errorf("reopened list = %v", got)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+}
+
+func TestOpenDamaged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.json")
+	if err := os.WriteFile(path, []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path); err == nil {
+		t.Error("Open of a damaged list succeeded")
+	}
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.json")
+	server, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Add([]string{hashA}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another process edits the file.
+	cli, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cli.Add([]string{hashB}, "cli"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cli.Remove(hashA); err != nil {
+		t.Fatal(err)
+	}
+
+	added, err := server.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(added, []string{hashB}) {
+		t.Errorf("Reload added %v", added)
+	}
+	if got := hashes(server); !slices.Equal(got, []string{hashB}) {
+		t.Errorf("after Reload = %v", got)
+	}
+
+	// A damaged file leaves the list as it was.
+	if err := os.WriteFile(path, []byte("nope"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Reload(); err == nil {
+		t.Error("Reload of a damaged file succeeded")
+	}
+	if _, ok := server.Contains(hashB); !ok {
+		t.Error("failed Reload dropped entries")
+	}
+}
@@ -1,127 +1,679 @@
 package config
 
 import (
-	"bufio"
+	"errors"
+	"fmt"
+	"net/url"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/BurntSushi/toml"
 )
 
 type Config struct {
 	Server    ServerConfig
 	Storage   StorageConfig
 	Retention RetentionConfig
+	Upload    UploadConfig
+	Auth      AuthConfig
+	TLS       TLSConfig
+	Webhooks  WebhooksConfig
+	Scanner   ScannerConfig
 }
 
 type ServerConfig struct {
-	Address string
-	BaseURL string
+	Address         string
+	ExtraAddresses  []string
+	SocketMode      string
+	SocketOwner     string
+	SocketGroup     string
+	AdminAddress    string
+	AdminToken      string
+	BaseURL         string
+	ShutdownTimeout time.Duration
+	TrustedProxies  []string
+	AllowedHosts    []string
 }
 
 type StorageConfig struct {
-	UploadDir string
-	DBPath    string
+	UploadDir    string
+	DBPath       string
+	MinFreeSpace int64
+	FsckOnStart  string
+	FsckOrphans  string
+	TrashPeriod  time.Duration
+	Blocklist    string
+	AuditLog     string
 }
 
 type RetentionConfig struct {
+	Policy          string
 	MinTTL          time.Duration
 	MaxTTL          time.Duration
 	MaxFileSize     int64
+	HalfSize        int64
+	Steps           []string
+	ContentTypes    []string
+	ExtendOnAccess  time.Duration
+	MaxAge          time.Duration
 	CleanupInterval time.Duration
 }
 
+// AccessMaxAge is the age past which downloads no longer extend a file's
+// life. It defaults to max_ttl.
+func (r RetentionConfig) AccessMaxAge() time.Duration {
+	if r.MaxAge > 0 {
+		return r.MaxAge
+	}
+	return r.MaxTTL
+}
+
+// Step is one "size=ttl" entry of retention.steps.
+type Step struct {
+	MaxSize int64
+	TTL     time.Duration
+}
+
+// ParseSteps parses retention.steps. Sizes must be increasing.
+func (r RetentionConfig) ParseSteps() ([]Step, error) {
+	steps := make([]Step, 0, len(r.Steps))
+	for _, entry := range r.Steps {
+		size, ttl, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("step %q must look like \"10MiB=7d\"", entry)
+		}
+		maxSize, err := parseSize(strings.TrimSpace(size))
+		if err != nil {
+			return nil, fmt.Errorf("step %q: invalid size %q", entry, size)
+		}
+		d, err := parseDuration(ttl)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("step %q: invalid duration %q", entry, ttl)
+		}
+		if len(steps) > 0 && maxSize <= steps[len(steps)-1].MaxSize {
+			return nil, fmt.Errorf("step %q: sizes must be increasing", entry)
+		}
+		steps = append(steps, Step{MaxSize: maxSize, TTL: d})
+	}
+	return steps, nil
+}
+
+// ContentTypeTTL is one "type=ttl" entry of retention.content_types.
+type ContentTypeTTL struct {
+	Pattern string
+	TTL     time.Duration
+}
+
+// ParseContentTypes parses retention.content_types.
+func (r RetentionConfig) ParseContentTypes() ([]ContentTypeTTL, error) {
+	overrides := make([]ContentTypeTTL, 0, len(r.ContentTypes))
+	for _, entry := range r.ContentTypes {
+		pattern, ttl, ok := strings.Cut(entry, "=")
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if !ok || !strings.Contains(pattern, "/") {
+			return nil, fmt.Errorf("entry %q must look like \"image/*=7d\"", entry)
+		}
+		d, err := parseDuration(ttl)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("entry %q: invalid duration %q", entry, ttl)
+		}
+		overrides = append(overrides, ContentTypeTTL{Pattern: pattern, TTL: d})
+	}
+	return overrides, nil
+}
+
+type UploadConfig struct {
+	IDAlphabet      string
+	IDLength        int
+	StripMetadata   bool
+	CustomSlugs     bool
+	SlugsRequireKey bool
+	RateLimit       int
+}
+
+type AuthConfig struct {
+	APIKeys []string
+}
+
+type TLSConfig struct {
+	Mode          string
+	CertFile      string
+	KeyFile       string
+	ACMEDomains   []string
+	ACMEEmail     string
+	ACMEDirectory string
+	ACMECARoot    string
+	CacheDir      string
+	HTTPAddress   string
+}
+
+// WebhookEvents are the event types that can be sent to webhooks.
+var WebhookEvents = []string{"file.uploaded", "file.downloaded", "file.deleted", "file.expired"}
+
+type WebhooksConfig struct {
+	URLs        []string
+	Secret      string
+	Events      []string
+	Outbox      string
+	Timeout     time.Duration
+	MaxAttempts int
+}
+
+type ScannerConfig struct {
+	Mode         string
+	ClamdAddress string
+	Command      []string
+	Timeout      time.Duration
+	MaxAttempts  int
+	// Oversize is what happens to a file the scanner refuses for its
+	// size: "skip", "reject" or "flag".
+	Oversize string
+	// Infected is what happens to the contents of an infected file:
+	// "quarantine" or "delete".
+	Infected string
+}
+
+// Addresses returns the main listen address followed by any extra ones.
+func (s ServerConfig) Addresses() []string {
+	return append([]string{s.Address}, s.ExtraAddresses...)
+}
+
+func (t TLSConfig) Enabled() bool {
+	return t.Mode != "" && t.Mode != "off"
+}
+
 func Default() *Config {
 	return &Config{
 		Server: ServerConfig{
-			Address: ":8080",
+			Address:         ":8080",
+			ShutdownTimeout: 30 * time.Second,
 		},
 		Storage: StorageConfig{
-			UploadDir: "./uploads",
-			DBPath:    "./data/kcst.db",
+			UploadDir:    "./uploads",
+			DBPath:       "./data/kcst.db",
+			MinFreeSpace: 1024 * 1024 * 1024,
+			FsckOnStart:  "off",
+			FsckOrphans:  "quarantine",
+			Blocklist:    "./data/blocklist.json",
+			AuditLog:     "./data/audit.log",
 		},
 		Retention: RetentionConfig{
+			Policy:          "sqrt",
 			MinTTL:          1 * time.Hour,
 			MaxTTL:          28 * 24 * time.Hour,
 			MaxFileSize:     100 * 1024 * 1024,
+			HalfSize:        10 * 1024 * 1024,
 			CleanupInterval: 1 * time.Hour,
 		},
+		Upload: UploadConfig{
+			IDAlphabet: "hex",
+			IDLength:   8,
+		},
+		TLS: TLSConfig{
+			Mode:     "off",
+			CacheDir: "./data/certs",
+		},
+		Webhooks: WebhooksConfig{
+			Outbox:      "./data/outbox",
+			Timeout:     10 * time.Second,
+			MaxAttempts: 10,
+		},
+		Scanner: ScannerConfig{
+			Mode:        "off",
+			Timeout:     time.Minute,
+			MaxAttempts: 10,
+			Oversize:    "flag",
+			Infected:    "quarantine",
+		},
+	}
+}
+
+// Error describes a problem with a config value. File, Line and Key are
+// set when known.
+type Error struct {
+	File string
+	Line int
+	Key  string
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	var sb strings.Builder
+	if e.File != "" {
+		sb.WriteString(e.File)
+		if e.Line > 0 {
+			fmt.Fprintf(&sb, ":%d", e.Line)
+		}
+		sb.WriteString(": ")
+	}
+	if e.Key != "" {
+		sb.WriteString(e.Key)
+		sb.WriteString(": ")
 	}
+	sb.WriteString(e.Msg)
+	return sb.String()
 }
 
-func Load(path string) (*Config, error) {
+// option binds a "section.key" name to the field it sets. The field's
+// pointer type decides how values are parsed: *time.Duration takes a
+// duration string, *int64 takes a size, and *[]string takes an array or a
+// comma-separated string.
+type option struct {
+	section string
+	key     string
+	ptr     any
+}
+
+func (o option) name() string {
+	return o.section + "." + o.key
+}
+
+func (c *Config) options() []option {
+	return []option{
+		{"server", "address", &c.Server.Address},
+		{"server", "extra_addresses", &c.Server.ExtraAddresses},
+		{"server", "socket_mode", &c.Server.SocketMode},
+		{"server", "socket_owner", &c.Server.SocketOwner},
+		{"server", "socket_group", &c.Server.SocketGroup},
+		{"server", "admin_address", &c.Server.AdminAddress},
+		{"server", "admin_token", &c.Server.AdminToken},
+		{"server", "base_url", &c.Server.BaseURL},
+		{"server", "shutdown_timeout", &c.Server.ShutdownTimeout},
+		{"server", "trusted_proxies", &c.Server.TrustedProxies},
+		{"server", "allowed_hosts", &c.Server.AllowedHosts},
+		{"storage", "upload_dir", &c.Storage.UploadDir},
+		{"storage", "db_path", &c.Storage.DBPath},
+		{"storage", "min_free_space", &c.Storage.MinFreeSpace},
+		{"storage", "fsck_on_start", &c.Storage.FsckOnStart},
+		{"storage", "fsck_orphans", &c.Storage.FsckOrphans},
+		{"storage", "trash_period", &c.Storage.TrashPeriod},
+		{"storage", "blocklist", &c.Storage.Blocklist},
+		{"storage", "audit_log", &c.Storage.AuditLog},
+		{"retention", "policy", &c.Retention.Policy},
+		{"retention", "min_ttl", &c.Retention.MinTTL},
+		{"retention", "max_ttl", &c.Retention.MaxTTL},
+		{"retention", "max_file_size", &c.Retention.MaxFileSize},
+		{"retention", "half_size", &c.Retention.HalfSize},
+		{"retention", "steps", &c.Retention.Steps},
+		{"retention", "content_types", &c.Retention.ContentTypes},
+		{"retention", "extend_on_access", &c.Retention.ExtendOnAccess},
+		{"retention", "max_age", &c.Retention.MaxAge},
+		{"retention", "cleanup_interval", &c.Retention.CleanupInterval},
+		{"upload", "id_alphabet", &c.Upload.IDAlphabet},
+		{"upload", "id_length", &c.Upload.IDLength},
+		{"upload", "strip_metadata", &c.Upload.StripMetadata},
+		{"upload", "custom_slugs", &c.Upload.CustomSlugs},
+		{"upload", "slugs_require_key", &c.Upload.SlugsRequireKey},
+		{"upload", "rate_limit", &c.Upload.RateLimit},
+		{"auth", "api_keys", &c.Auth.APIKeys},
+		{"tls", "mode", &c.TLS.Mode},
+		{"tls", "cert_file", &c.TLS.CertFile},
+		{"tls", "key_file", &c.TLS.KeyFile},
+		{"tls", "acme_domains", &c.TLS.ACMEDomains},
+		{"tls", "acme_email", &c.TLS.ACMEEmail},
+		{"tls", "acme_directory", &c.TLS.ACMEDirectory},
+		{"tls", "acme_ca_root", &c.TLS.ACMECARoot},
+		{"tls", "cache_dir", &c.TLS.CacheDir},
+		{"tls", "http_address", &c.TLS.HTTPAddress},
+		{"webhooks", "urls", &c.Webhooks.URLs},
+		{"webhooks", "secret", &c.Webhooks.Secret},
+		{"webhooks", "events", &c.Webhooks.Events},
+		{"webhooks", "outbox", &c.Webhooks.Outbox},
+		{"webhooks", "timeout", &c.Webhooks.Timeout},
+		{"webhooks", "max_attempts", &c.Webhooks.MaxAttempts},
+		{"scanner", "mode", &c.Scanner.Mode},
+		{"scanner", "clamd_address", &c.Scanner.ClamdAddress},
+		{"scanner", "command", &c.Scanner.Command},
+		{"scanner", "timeout", &c.Scanner.Timeout},
+		{"scanner", "max_attempts", &c.Scanner.MaxAttempts},
+		{"scanner", "oversize", &c.Scanner.Oversize},
+		{"scanner", "infected", &c.Scanner.Infected},
+	}
+}
+
+// Load builds the effective configuration. Later sources take precedence:
+// defaults, then the file at path, then KCST_SECTION_KEY environment
+// variables, then flags. A missing file is not an error and flags may be nil.
+func Load(path string, flags *Flags) (*Config, error) {
 	cfg := Default()
 
-	file, err := os.Open(path)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return cfg, nil
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := cfg.decode(path, string(data)); err != nil {
+			return nil, err
 		}
+	}
+
+	if err := cfg.applyEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+	if err := cfg.applyFlags(flags); err != nil {
 		return nil, err
 	}
-	defer file.Close()
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
 
-	section := ""
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
+func (c *Config) decode(path, data string) error {
+	var root map[string]toml.Primitive
+	md, err := toml.Decode(data, &root)
+	if err != nil {
+		var pe toml.ParseError
+		if errors.As(err, &pe) {
+			return &Error{File: path, Line: pe.Position.Line, Msg: pe.Message}
+		}
+		return &Error{File: path, Msg: err.Error()}
+	}
 
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
+	sections := make(map[string]map[string]option)
+	for _, o := range c.options() {
+		if sections[o.section] == nil {
+			sections[o.section] = make(map[string]option)
 		}
+		sections[o.section][o.key] = o
+	}
 
-		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
-			section = strings.Trim(line, "[]")
+	// Keys come in the order they appear in the file, so the first
+	// problem in it is the one reported.
+	tables := make(map[string]map[string]toml.Primitive)
+	for _, key := range md.Keys() {
+		name := key[0]
+		table, ok := tables[name]
+		if !ok {
+			if _, known := sections[name]; !known {
+				return &Error{File: path, Line: lineOf(&md, root[name]), Key: name, Msg: "unknown section"}
+			}
+			var v any
+			if err := md.PrimitiveDecode(root[name], &v); err != nil {
+				return &Error{File: path, Line: lineOf(&md, root[name]), Key: name, Msg: err.Error()}
+			}
+			if _, ok := v.(map[string]any); !ok {
+				return &Error{File: path, Line: lineOf(&md, root[name]), Key: name, Msg: "expected a table, got " + tomlTypeName(v)}
+			}
+			if err := md.PrimitiveDecode(root[name], &table); err != nil {
+				return &Error{File: path, Line: lineOf(&md, root[name]), Key: name, Msg: err.Error()}
+			}
+			tables[name] = table
+		}
+		if len(key) != 2 {
 			continue
 		}
 
-		parts := strings.SplitN(line, "=", 2)
-		if len(parts) != 2 {
-			continue
+		value := table[key[1]]
+		o, ok := sections[name][key[1]]
+		if !ok {
+			return &Error{File: path, Line: lineOf(&md, value), Key: key.String(), Msg: "unknown key"}
+		}
+		var v any
+		err := md.PrimitiveDecode(value, &v)
+		if err == nil {
+			err = setTOML(o.ptr, v)
 		}
+		if err != nil {
+			return &Error{File: path, Line: lineOf(&md, value), Key: o.name(), Msg: err.Error()}
+		}
+	}
+	return nil
+}
 
-		key := strings.TrimSpace(parts[0])
-		value := strings.TrimSpace(parts[1])
-		value = strings.Trim(value, "\"")
+func setTOML(ptr, value any) error {
+	mismatch := func(want string) error {
+		return fmt.Errorf("expected %s, got %s", want, tomlTypeName(value))
+	}
 
-		switch section {
-		case "server":
-			switch key {
-			case "address":
-				cfg.Server.Address = value
-			case "base_url":
-				cfg.Server.BaseURL = value
-			}
-		case "storage":
-			switch key {
-			case "upload_dir":
-				cfg.Storage.UploadDir = value
-			case "db_path":
-				cfg.Storage.DBPath = value
+	switch p := ptr.(type) {
+	case *string:
+		v, ok := value.(string)
+		if !ok {
+			return mismatch("string")
+		}
+		*p = v
+	case *bool:
+		v, ok := value.(bool)
+		if !ok {
+			return mismatch("boolean")
+		}
+		*p = v
+	case *int:
+		v, ok := value.(int64)
+		if !ok {
+			return mismatch("integer")
+		}
+		*p = int(v)
+	case *time.Duration:
+		v, ok := value.(string)
+		if !ok {
+			return mismatch("duration string")
+		}
+		d, err := parseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", v)
+		}
+		*p = d
+	case *int64:
+		switch v := value.(type) {
+		case int64:
+			*p = v
+		case string:
+			size, err := parseSize(v)
+			if err != nil {
+				return fmt.Errorf("invalid size %q", v)
 			}
-		case "retention":
-			switch key {
-			case "min_ttl":
-				if d, err := parseDuration(value); err == nil {
-					cfg.Retention.MinTTL = d
-				}
-			case "max_ttl":
-				if d, err := parseDuration(value); err == nil {
-					cfg.Retention.MaxTTL = d
-				}
-			case "max_file_size":
-				if size, err := parseSize(value); err == nil {
-					cfg.Retention.MaxFileSize = size
-				}
-			case "cleanup_interval":
-				if d, err := parseDuration(value); err == nil {
-					cfg.Retention.CleanupInterval = d
-				}
+			*p = size
+		default:
+			return mismatch("size string or integer")
+		}
+	case *[]string:
+		if v, ok := value.(string); ok {
+			return setString(ptr, v)
+		}
+		arr, ok := value.([]any)
+		if !ok {
+			return mismatch("array of strings")
+		}
+		list := make([]string, 0, len(arr))
+		for _, item := range arr {
+			s, ok := item.(string)
+			if !ok {
+				return fmt.Errorf("expected array of strings, found %s element", tomlTypeName(item))
 			}
+			list = append(list, s)
+		}
+		*p = list
+	default:
+		return fmt.Errorf("unsupported option type %T", ptr)
+	}
+	return nil
+}
+
+func (c *Config) Validate() error {
+	invalid := func(key, format string, args ...any) error {
+		return &Error{Key: key, Msg: fmt.Sprintf(format, args...)}
+	}
+
+	if c.Server.Address == "" {
+		return invalid("server.address", "must not be empty")
+	}
+	if c.Server.SocketMode != "" {
+		if _, err := strconv.ParseUint(c.Server.SocketMode, 8, 32); err != nil {
+			return invalid("server.socket_mode", "must be an octal file mode such as \"0660\", got %q", c.Server.SocketMode)
+		}
+	}
+	if c.Server.ShutdownTimeout < 0 {
+		return invalid("server.shutdown_timeout", "must not be negative")
+	}
+	if c.Storage.UploadDir == "" {
+		return invalid("storage.upload_dir", "must not be empty")
+	}
+	if c.Storage.DBPath == "" {
+		return invalid("storage.db_path", "must not be empty")
+	}
+
+	if c.Storage.MinFreeSpace < 0 {
+		return invalid("storage.min_free_space", "must not be negative")
+	}
+	switch c.Storage.FsckOnStart {
+	case "off", "report", "repair":
+	default:
+		return invalid("storage.fsck_on_start", "must be one of off, report or repair, got %q", c.Storage.FsckOnStart)
+	}
+	switch c.Storage.FsckOrphans {
+	case "quarantine", "delete":
+	default:
+		return invalid("storage.fsck_orphans", "must be quarantine or delete, got %q", c.Storage.FsckOrphans)
+	}
+	if c.Storage.TrashPeriod < 0 {
+		return invalid("storage.trash_period", "must not be negative")
+	}
+	if c.Storage.Blocklist == "" {
+		return invalid("storage.blocklist", "must not be empty")
+	}
+	if c.Storage.AuditLog == "" {
+		return invalid("storage.audit_log", "must not be empty")
+	}
+
+	r := c.Retention
+	if r.MinTTL <= 0 {
+		return invalid("retention.min_ttl", "must be positive")
+	}
+	if r.MaxTTL < r.MinTTL {
+		return invalid("retention.max_ttl", "must not be less than min_ttl (%s)", r.MinTTL)
+	}
+	if r.MaxFileSize <= 0 {
+		return invalid("retention.max_file_size", "must be positive")
+	}
+	if r.CleanupInterval <= 0 {
+		return invalid("retention.cleanup_interval", "must be positive")
+	}
+	if r.ExtendOnAccess < 0 {
+		return invalid("retention.extend_on_access", "must not be negative")
+	}
+	if r.MaxAge < 0 {
+		return invalid("retention.max_age", "must not be negative")
+	}
+	switch r.Policy {
+	case "sqrt", "linear":
+	case "exponential":
+		if r.HalfSize <= 0 {
+			return invalid("retention.half_size", "must be positive")
+		}
+	case "step":
+		if len(r.Steps) == 0 {
+			return invalid("retention.steps", "at least one step is required by the step policy")
+		}
+	default:
+		return invalid("retention.policy", "must be one of sqrt, linear, exponential or step, got %q", r.Policy)
+	}
+	if _, err := r.ParseSteps(); err != nil {
+		return invalid("retention.steps", "%v", err)
+	}
+	if _, err := r.ParseContentTypes(); err != nil {
+		return invalid("retention.content_types", "%v", err)
+	}
+
+	u := c.Upload
+	switch u.IDAlphabet {
+	case "hex", "base62":
+		if u.IDLength < 4 || u.IDLength > 64 {
+			return invalid("upload.id_length", "must be between 4 and 64, got %d", u.IDLength)
+		}
+	case "words":
+		if u.IDLength < 2 || u.IDLength > 8 {
+			return invalid("upload.id_length", "must be between 2 and 8 words, got %d", u.IDLength)
+		}
+	default:
+		return invalid("upload.id_alphabet", "must be one of hex, base62 or words, got %q", u.IDAlphabet)
+	}
+	if u.SlugsRequireKey && len(c.Auth.APIKeys) == 0 {
+		return invalid("upload.slugs_require_key", "requires at least one key in auth.api_keys")
+	}
+	if u.RateLimit < 0 {
+		return invalid("upload.rate_limit", "must not be negative, got %d", u.RateLimit)
+	}
+
+	t := c.TLS
+	switch t.Mode {
+	case "off":
+	case "static":
+		if t.CertFile == "" || t.KeyFile == "" {
+			return invalid("tls.cert_file", "cert_file and key_file are required in static mode")
+		}
+	case "acme":
+		if len(t.ACMEDomains) == 0 {
+			return invalid("tls.acme_domains", "at least one domain is required in acme mode")
 		}
+		if t.CacheDir == "" {
+			return invalid("tls.cache_dir", "must not be empty in acme mode")
+		}
+	default:
+		return invalid("tls.mode", "must be one of off, static or acme, got %q", t.Mode)
+	}
+
+	wh := c.Webhooks
+	for _, raw := range wh.URLs {
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return invalid("webhooks.urls", "%q is not an http or https URL", raw)
+		}
+	}
+	for _, e := range wh.Events {
+		if !slices.Contains(WebhookEvents, e) {
+			return invalid("webhooks.events", "unknown event %q, expected one of %s", e, strings.Join(WebhookEvents, ", "))
+		}
+	}
+	if len(wh.URLs) > 0 && wh.Secret == "" {
+		return invalid("webhooks.secret", "must be set when webhooks.urls is, so receivers can verify events")
+	}
+	if len(wh.URLs) > 0 && wh.Outbox == "" {
+		return invalid("webhooks.outbox", "must not be empty when webhooks are configured")
+	}
+	if wh.Timeout <= 0 {
+		return invalid("webhooks.timeout", "must be positive")
+	}
+	if wh.MaxAttempts < 1 {
+		return invalid("webhooks.max_attempts", "must be at least 1, got %d", wh.MaxAttempts)
+	}
+
+	sc := c.Scanner
+	switch sc.Mode {
+	case "off":
+	case "clamd":
+		if sc.ClamdAddress == "" {
+			return invalid("scanner.clamd_address", "is required in clamd mode")
+		}
+	case "command":
+		if len(sc.Command) == 0 {
+			return invalid("scanner.command", "is required in command mode")
+		}
+	default:
+		return invalid("scanner.mode", "must be one of off, clamd or command, got %q", sc.Mode)
+	}
+	if sc.Timeout <= 0 {
+		return invalid("scanner.timeout", "must be positive")
+	}
+	if sc.MaxAttempts < 1 {
+		return invalid("scanner.max_attempts", "must be at least 1, got %d", sc.MaxAttempts)
+	}
+	switch sc.Oversize {
+	case "skip", "reject", "flag":
+	default:
+		return invalid("scanner.oversize", "must be one of skip, reject or flag, got %q", sc.Oversize)
+	}
+	switch sc.Infected {
+	case "quarantine", "delete":
+	default:
+		return invalid("scanner.infected", "must be one of quarantine or delete, got %q", sc.Infected)
 	}
 
-	return cfg, scanner.Err()
+	return nil
 }
 
 func parseDuration(s string) (time.Duration, error) {
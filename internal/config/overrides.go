@@ -0,0 +1,297 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// secretOptions are redacted when the configuration is printed.
+var secretOptions = map[string]bool{
+	"auth.api_keys":      true,
+	"server.admin_token": true,
+	"webhooks.secret":    true,
+}
+
+// envName returns the environment variable that overrides o, for example
+// KCST_RETENTION_MAX_TTL for retention.max_ttl.
+func (o option) envName() string {
+	return "KCST_" + strings.ToUpper(o.section+"_"+o.key)
+}
+
+// Flags holds the values of the per-option command-line flags that were
+// set, so they can be applied after the file and environment.
+type Flags struct {
+	set   map[string]string
+	order []string
+}
+
+// RegisterFlags defines a -section.key flag on fs for every config option.
+func RegisterFlags(fs *flag.FlagSet) *Flags {
+	f := &Flags{set: make(map[string]string)}
+	defaults := Default()
+	for _, o := range defaults.options() {
+		fs.Var(&flagValue{flags: f, name: o.name(), def: formatValue(o.ptr)}, o.name(),
+			fmt.Sprintf("override %s (env %s)", o.name(), o.envName()))
+	}
+	return f
+}
+
+type flagValue struct {
+	flags *Flags
+	name  string
+	def   string
+}
+
+func (v *flagValue) String() string {
+	if v == nil || v.flags == nil {
+		return ""
+	}
+	if s, ok := v.flags.set[v.name]; ok {
+		return s
+	}
+	return v.def
+}
+
+func (v *flagValue) Set(s string) error {
+	if _, ok := v.flags.set[v.name]; !ok {
+		v.flags.order = append(v.flags.order, v.name)
+	}
+	v.flags.set[v.name] = s
+	return nil
+}
+
+func (c *Config) applyEnv(lookup func(string) (string, bool)) error {
+	for _, o := range c.options() {
+		value, ok := lookup(o.envName())
+		if !ok {
+			continue
+		}
+		if err := setString(o.ptr, value); err != nil {
+			return &Error{Key: o.envName(), Msg: err.Error()}
+		}
+	}
+	return nil
+}
+
+func (c *Config) applyFlags(f *Flags) error {
+	if f == nil {
+		return nil
+	}
+	opts := make(map[string]option)
+	for _, o := range c.options() {
+		opts[o.name()] = o
+	}
+	for _, name := range f.order {
+		if err := setString(opts[name].ptr, f.set[name]); err != nil {
+			return &Error{Key: "-" + name, Msg: err.Error()}
+		}
+	}
+	return nil
+}
+
+func setString(ptr any, value string) error {
+	switch p := ptr.(type) {
+	case *string:
+		*p = value
+	case *bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", value)
+		}
+		*p = b
+	case *int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+		*p = n
+	case *time.Duration:
+		d, err := parseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", value)
+		}
+		*p = d
+	case *int64:
+		size, err := parseSize(value)
+		if err != nil {
+			return fmt.Errorf("invalid size %q", value)
+		}
+		*p = size
+	case *[]string:
+		if strings.HasPrefix(strings.TrimSpace(value), "[") {
+			return setList(p, value)
+		}
+		var list []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		*p = list
+	default:
+		return fmt.Errorf("unsupported option type %T", ptr)
+	}
+	return nil
+}
+
+// setList parses value as a TOML array of strings, which lets items
+// contain commas.
+func setList(p *[]string, value string) error {
+	var root map[string]any
+	if _, err := toml.Decode("list = "+value, &root); err != nil {
+		return fmt.Errorf("invalid array %s", value)
+	}
+	if _, ok := root["list"].([]any); !ok {
+		return fmt.Errorf("invalid array %s", value)
+	}
+	return setTOML(p, root["list"])
+}
+
+// WriteTOML writes the configuration in the same format Load reads.
+// Secret values are replaced with a placeholder when redact is set.
+func (c *Config) WriteTOML(w io.Writer, redact bool) error {
+	section := ""
+	for _, o := range c.options() {
+		if o.section != section {
+			if section != "" {
+				if _, err := fmt.Fprintln(w); err != nil {
+					return err
+				}
+			}
+			section = o.section
+			if _, err := fmt.Fprintf(w, "[%s]\n", section); err != nil {
+				return err
+			}
+		}
+
+		value := tomlValue(o.ptr)
+		if redact && secretOptions[o.name()] && !isEmpty(o.ptr) {
+			value = redacted(o.ptr)
+		}
+		if _, err := fmt.Fprintf(w, "%s = %s\n", o.key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func redacted(ptr any) string {
+	if _, ok := ptr.(*[]string); ok {
+		return "[" + tomlQuote("REDACTED") + "]"
+	}
+	return tomlQuote("REDACTED")
+}
+
+func isEmpty(ptr any) bool {
+	switch p := ptr.(type) {
+	case *string:
+		return *p == ""
+	case *[]string:
+		return len(*p) == 0
+	}
+	return false
+}
+
+func tomlValue(ptr any) string {
+	switch p := ptr.(type) {
+	case *string:
+		return tomlQuote(*p)
+	case *time.Duration, *int64:
+		return tomlQuote(formatValue(ptr))
+	case *[]string:
+		quoted := make([]string, len(*p))
+		for i, s := range *p {
+			quoted[i] = tomlQuote(s)
+		}
+		return "[" + strings.Join(quoted, ", ") + "]"
+	}
+	return formatValue(ptr)
+}
+
+// formatValue renders an option the way it would be written in an
+// environment variable or flag.
+func formatValue(ptr any) string {
+	switch p := ptr.(type) {
+	case *string:
+		return *p
+	case *bool:
+		return strconv.FormatBool(*p)
+	case *int:
+		return strconv.Itoa(*p)
+	case *time.Duration:
+		return formatDuration(*p)
+	case *int64:
+		return formatSize(*p)
+	case *[]string:
+		for _, s := range *p {
+			if strings.Contains(s, ",") || strings.HasPrefix(strings.TrimSpace(s), "[") {
+				return tomlValue(ptr)
+			}
+		}
+		return strings.Join(*p, ",")
+	}
+	return ""
+}
+
+func formatDuration(d time.Duration) string {
+	const day = 24 * time.Hour
+	if d != 0 && d%day == 0 {
+		return fmt.Sprintf("%dd", d/day)
+	}
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+func formatSize(n int64) string {
+	units := []struct {
+		suffix string
+		size   int64
+	}{
+		{"GiB", 1024 * 1024 * 1024},
+		{"MiB", 1024 * 1024},
+		{"KiB", 1024},
+	}
+	for _, u := range units {
+		if n != 0 && n%u.size == 0 {
+			return fmt.Sprintf("%d%s", n/u.size, u.suffix)
+		}
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+func tomlQuote(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"':
+			sb.WriteString(`\"`)
+		case r == '\\':
+			sb.WriteString(`\\`)
+		case r == '\n':
+			sb.WriteString(`\n`)
+		case r == '\t':
+			sb.WriteString(`\t`)
+		case r == '\r':
+			sb.WriteString(`\r`)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&sb, `\u%04x`, r)
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
@@ -0,0 +1,200 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const day = 24 * time.Hour
+
+func loadWith(t *testing.T, path string, args ...string) (*Config, error) {
+	t.Helper()
+	fs := flag.NewFlagSet("kcst", flag.ContinueOnError)
+	flags := RegisterFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return Load(path, flags)
+}
+
+func TestPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte("[retention]\nmax_ttl = \"10d\"\nmin_ttl = \"2d\"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		env  string
+		args []string
+		want time.Duration
+	}{
+		{"file", "", nil, 10 * day},
+		{"env over file", "5d", nil, 5 * day},
+		{"flag over env", "5d", []string{"-retention.max_ttl", "3d"}, 3 * day},
+		{"flag over file", "", []string{"-retention.max_ttl=4d"}, 4 * day},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				t.Setenv("KCST_RETENTION_MAX_TTL", tt.env)
+			}
+			cfg, err := loadWith(t, path, tt.args...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Retention.MaxTTL != tt.want {
+				t.Errorf("max_ttl = %v, want %v", cfg.Retention.MaxTTL, tt.want)
+			}
+			// Options nobody overrode keep the file's value.
+			if cfg.Retention.MinTTL != 2*day {
+				t.Errorf("min_ttl = %v, want %v", cfg.Retention.MinTTL, 2*day)
+			}
+		})
+	}
+}
+
+func TestLoadWithoutFile(t *testing.T) {
+	cfg, err := loadWith(t, filepath.Join(t.TempDir(), "missing.toml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg, Default()) {
+		t.Errorf("config = %+v, want defaults", cfg)
+	}
+}
+
+func TestOverrideErrors(t *testing.T) {
+	t.Setenv("KCST_UPLOAD_ID_LENGTH", "many")
+	_, err := loadWith(t, "")
+	if err == nil || err.Error() != `KCST_UPLOAD_ID_LENGTH: invalid integer "many"` {
+		t.Errorf("env err = %v", err)
+	}
+
+	os.Unsetenv("KCST_UPLOAD_ID_LENGTH")
+	_, err = loadWith(t, "", "-storage.min_free_space", "lots")
+	if err == nil || err.Error() != `-storage.min_free_space: invalid size "lots"` {
+		t.Errorf("flag err = %v", err)
+	}
+}
+
+func TestListOverride(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []string
+		err   string
+	}{
+		{"a,b", []string{"a", "b"}, ""},
+		{" a , b ,", []string{"a", "b"}, ""},
+		{"", nil, ""},
+		{`["sh", "-c", "scan a,b"]`, []string{"sh", "-c", "scan a,b"}, ""},
+		{` ["a"]`, []string{"a"}, ""},
+		{`[]`, []string{}, ""},
+		{`["a"`, nil, `invalid array ["a"`},
+		{`[1]`, nil, "expected array of strings, found integer element"},
+	}
+	for _, tt := range tests {
+		var list []string
+		err := setString(&list, tt.value)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%q: err = %v, want %s", tt.value, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.value, err)
+			continue
+		}
+		if !reflect.DeepEqual(list, tt.want) {
+			t.Errorf("%q: list = %q, want %q", tt.value, list, tt.want)
+		}
+	}
+}
+
+// A list whose items contain commas is shown as an array, so the value
+// printed as a flag default can be passed back unchanged.
+func TestListFormatRoundTrip(t *testing.T) {
+	for _, want := range [][]string{
+		{"a", "b"},
+		{"sh", "-c", "scan a,b"},
+		{"[x]"},
+	} {
+		s := formatValue(&want)
+		var got []string
+		if err := setString(&got, s); err != nil {
+			t.Errorf("%q: %v", s, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: list = %q, want %q", s, got, want)
+		}
+	}
+}
+
+func TestWriteTOMLRedaction(t *testing.T) {
+	cfg := Default()
+	cfg.Auth.APIKeys = []string{"key-one", "key-two"}
+	cfg.Server.AdminToken = "admin-secret"
+	cfg.Webhooks.URLs = []string{"https://example.com/hook"}
+	cfg.Webhooks.Secret = "hook-secret"
+
+	var buf bytes.Buffer
+	if err := cfg.WriteTOML(&buf, true); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, secret := range []string{"key-one", "key-two", "admin-secret", "hook-secret"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("redacted output contains %q", secret)
+		}
+	}
+	for _, line := range []string{
+		`api_keys = ["REDACTED"]`,
+		`admin_token = "REDACTED"`,
+		`secret = "REDACTED"`,
+		`urls = ["https://example.com/hook"]`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("redacted output is missing %s", line)
+		}
+	}
+
+	buf.Reset()
+	if err := cfg.WriteTOML(&buf, false); err != nil {
+		t.Fatal(err)
+	}
+	want := buf.String()
+	got := Default()
+	if err := got.decode("out.toml", want); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := got.WriteTOML(&buf, false); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != want {
+		t.Errorf("output does not round-trip:\n%s\nwant:\n%s", buf.String(), want)
+	}
+	if !reflect.DeepEqual(got.Auth.APIKeys, cfg.Auth.APIKeys) || got.Server.AdminToken != cfg.Server.AdminToken ||
+		got.Webhooks.Secret != cfg.Webhooks.Secret {
+		t.Errorf("unredacted output lost secrets:\n%s", want)
+	}
+}
+
+// Unset secrets are left empty rather than shown as redacted.
+func TestWriteTOMLRedactionEmpty(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Default().WriteTOML(&buf, true); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "REDACTED") {
+		t.Errorf("output redacts unset secrets:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,48 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// errPosition is returned by positionProbe so that the decoder reports
+// where the value it was handed is defined.
+var errPosition = errors.New("position")
+
+type positionProbe struct{}
+
+func (positionProbe) UnmarshalTOML(any) error { return errPosition }
+
+// lineOf returns the line p is defined on, or 0 if it is not known.
+func lineOf(md *toml.MetaData, p toml.Primitive) int {
+	var pe toml.ParseError
+	if errors.As(md.PrimitiveDecode(p, positionProbe{}), &pe) {
+		return pe.Position.Line
+	}
+	return 0
+}
+
+func tomlTypeName(v any) string {
+	switch v.(type) {
+	case string:
+		return "string"
+	case int64:
+		return "integer"
+	case float64:
+		return "float"
+	case bool:
+		return "boolean"
+	case time.Time:
+		return "datetime"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "table"
+	case []map[string]any:
+		return "array of tables"
+	}
+	return fmt.Sprintf("%T", v)
+}
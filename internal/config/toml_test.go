@@ -0,0 +1,146 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TOML syntax is handled by the library; these check that the forms an
+// operator is likely to write reach the config intact.
+func TestDecodeSyntax(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		got  func(*Config) any
+		want any
+	}{
+		{"trailing comment", "[server]\naddress = \":80\" # note", func(c *Config) any { return c.Server.Address }, ":80"},
+		{"hash in string", "[server]\nbase_url = \"https://x/#y\"", func(c *Config) any { return c.Server.BaseURL }, "https://x/#y"},
+		{"escapes", `[webhooks]` + "\n" + `secret = "tab\t\"q\" \u00e9"`, func(c *Config) any { return c.Webhooks.Secret }, "tab\t\"q\" é"},
+		{"literal string", "[storage]\nupload_dir = 'C:\\files\\new'", func(c *Config) any { return c.Storage.UploadDir }, `C:\files\new`},
+		{"multi-line string", "[webhooks]\nsecret = \"\"\"\none \\\n  two\"\"\"", func(c *Config) any { return c.Webhooks.Secret }, "one two"},
+		{"CRLF", "[upload]\r\nid_length = 12\r\n", func(c *Config) any { return c.Upload.IDLength }, 12},
+		{"integer forms", "[upload]\nid_length = 0x10", func(c *Config) any { return c.Upload.IDLength }, 16},
+		{"size with underscores", "[storage]\nmin_free_space = 1_048_576", func(c *Config) any { return c.Storage.MinFreeSpace }, int64(1 << 20)},
+		{"multi-line array", "[auth]\napi_keys = [\n  \"a\", # first\n  \"b\",\n]", func(c *Config) any { return c.Auth.APIKeys }, []string{"a", "b"}},
+		{"dotted keys", "upload.id_length = 10", func(c *Config) any { return c.Upload.IDLength }, 10},
+		{"inline table", "upload = { id_length = 9 }", func(c *Config) any { return c.Upload.IDLength }, 9},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Default()
+			if err := cfg.decode("c.toml", tt.src); err != nil {
+				t.Fatal(err)
+			}
+			if got := tt.got(cfg); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Errors point at the line of the key or section they are about.
+func TestDecodeErrorLines(t *testing.T) {
+	src := "# header\n\n[server]\naddress = \":80\"\n\n[storage]\n\nupload_dir = 1\n"
+	err := Default().decode("c.toml", src)
+	if err == nil || err.Error() != "c.toml:8: storage.upload_dir: expected string, got integer" {
+		t.Errorf("err = %v", err)
+	}
+
+	src = "[server]\naddress = \":80\"\n\n[nope]\n"
+	err = Default().decode("c.toml", src)
+	if err == nil || err.Error() != "c.toml:4: nope: unknown section" {
+		t.Errorf("err = %v", err)
+	}
+
+	// With several problems, the first one in the file is reported.
+	src = "[upload]\nid_length = \"x\"\n[server]\nbogus = 1\n[storage]\nalso_bogus = 2\n"
+	for range 10 {
+		err = Default().decode("c.toml", src)
+		if err == nil || err.Error() != "c.toml:2: upload.id_length: expected integer, got string" {
+			t.Fatalf("err = %v", err)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	cfg := Default()
+	err := cfg.decode("c.toml", strings.Join([]string{
+		`[server]`,
+		`address = "127.0.0.1:9000"`,
+		`shutdown_timeout = "5s"`,
+		`trusted_proxies = ["10.0.0.0/8"]`,
+		`[storage]`,
+		`min_free_space = "2GiB"`,
+		`[retention]`,
+		`max_file_size = 1048576`,
+		`[upload]`,
+		`id_length = 12`,
+		`strip_metadata = true`,
+	}, "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Server.Address != "127.0.0.1:9000" ||
+		cfg.Server.ShutdownTimeout != 5*time.Second ||
+		!reflect.DeepEqual(cfg.Server.TrustedProxies, []string{"10.0.0.0/8"}) ||
+		cfg.Storage.MinFreeSpace != 2<<30 ||
+		cfg.Retention.MaxFileSize != 1<<20 ||
+		cfg.Upload.IDLength != 12 ||
+		!cfg.Upload.StripMetadata {
+		t.Errorf("decoded config = %+v", cfg)
+	}
+}
+
+func TestDecodeAPIKeys(t *testing.T) {
+	tests := []struct {
+		src  string
+		want []string
+	}{
+		{`api_keys = ["a", "b"]`, []string{"a", "b"}},
+		// The comma-separated form documented before the config was TOML.
+		{`api_keys = "a,b"`, []string{"a", "b"}},
+		{`api_keys = " a , b ,"`, []string{"a", "b"}},
+		{`api_keys = []`, []string{}},
+	}
+	for _, tt := range tests {
+		cfg := Default()
+		if err := cfg.decode("c.toml", "[auth]\n"+tt.src); err != nil {
+			t.Errorf("%s: %v", tt.src, err)
+			continue
+		}
+		if !reflect.DeepEqual(cfg.Auth.APIKeys, tt.want) {
+			t.Errorf("%s: api_keys = %q, want %q", tt.src, cfg.Auth.APIKeys, tt.want)
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"syntax", "[server]\naddress = ", "c.toml:2: unexpected EOF; expected value"},
+		{"unknown section", "[nope]\na = 1", "c.toml:1: nope: unknown section"},
+		{"unknown key", "[server]\n\nbogus = 1", "c.toml:3: server.bogus: unknown key"},
+		{"section not a table", "server = 1", "c.toml:1: server: expected a table, got integer"},
+		{"wrong type", "[server]\naddress = 80", "c.toml:2: server.address: expected string, got integer"},
+		{"bad duration", "[server]\nshutdown_timeout = \"soon\"", `c.toml:2: server.shutdown_timeout: invalid duration "soon"`},
+		{"bad size", "[storage]\nmin_free_space = \"lots\"", `c.toml:2: storage.min_free_space: invalid size "lots"`},
+		{"bad list element", "[auth]\napi_keys = [1]", "c.toml:2: auth.api_keys: expected array of strings, found integer element"},
+		{"bad list", "[auth]\napi_keys = 1", "c.toml:2: auth.api_keys: expected array of strings, got integer"},
+		{"duplicate table", "[auth]\n[auth]", "c.toml:2: Key 'auth' has already been defined."},
+		{"duplicate key", "[upload]\nid_length = 8\nid_length = 9", "c.toml:3: Key 'upload.id_length' has already been defined."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Default().decode("c.toml", tt.src)
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("err = %v, want %s", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,454 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/keircn/kcst/internal/storage"
+)
+
+// Retries wait backoffBase, doubling up to backoffMax. They are variables
+// so tests can shorten them.
+var (
+	backoffBase = 10 * time.Second
+	backoffMax  = time.Hour
+)
+
+// Config is the part of the webhook configuration that can change while
+// the dispatcher runs.
+type Config struct {
+	URLs   []string
+	Secret string
+	// Events limits which types are sent. Empty means all of them.
+	Events      []Type
+	Timeout     time.Duration
+	MaxAttempts int
+}
+
+func (c *Config) wants(t Type) bool {
+	return len(c.URLs) > 0 && (len(c.Events) == 0 || slices.Contains(c.Events, t))
+}
+
+// delivery is one event on its way to one URL. It is stored in the outbox
+// as JSON until it succeeds or runs out of attempts.
+type delivery struct {
+	URL         string    `json:"url"`
+	Event       Event     `json:"event"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+}
+
+func (d *delivery) fileName() string {
+	sum := sha256.Sum256([]byte(d.URL))
+	return d.Event.ID + "-" + hex.EncodeToString(sum[:4]) + ".json"
+}
+
+// Dispatcher delivers events to webhooks in the background. Published
+// events are written to the outbox by a single writer, in batches, and
+// then handed to a worker per URL so a slow receiver only delays its own
+// events.
+type Dispatcher struct {
+	dir    string
+	cfg    atomic.Pointer[Config]
+	client *http.Client
+
+	mu      sync.Mutex
+	unsaved []*delivery
+	workers map[string]*worker
+	written chan struct{}
+	closed  bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// worker delivers the events for one URL in order of their next attempt.
+type worker struct {
+	d       *Dispatcher
+	mu      sync.Mutex
+	pending []*delivery
+	wake    chan struct{}
+}
+
+// NewDispatcher loads undelivered events from the outbox directory dir and
+// starts delivering them. The directory is created when the first event
+// is written to it.
+func NewDispatcher(dir string, cfg *Config) (*Dispatcher, error) {
+	d := &Dispatcher{
+		dir:     dir,
+		client:  &http.Client{},
+		workers: make(map[string]*worker),
+		written: make(chan struct{}, 1),
+	}
+	d.cfg.Store(cfg)
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+
+	loaded, err := d.load()
+	if err != nil {
+		return nil, err
+	}
+	if len(loaded) > 0 {
+		log.Printf("Loaded %d undelivered webhook events", len(loaded))
+	}
+	for _, dl := range loaded {
+		d.worker(dl.URL).add(dl)
+	}
+
+	d.wg.Go(d.writeOutbox)
+	return d, nil
+}
+
+// Reconfigure replaces the webhook settings. Events already queued keep
+// their URL but are signed with the new secret.
+func (d *Dispatcher) Reconfigure(cfg *Config) {
+	d.cfg.Store(cfg)
+}
+
+// Close stops delivery once published events are in the outbox.
+// Undelivered events stay there for the next start. Events published
+// afterwards are dropped.
+func (d *Dispatcher) Close() {
+	d.mu.Lock()
+	d.closed = true
+	d.mu.Unlock()
+
+	d.cancel()
+	d.wg.Wait()
+}
+
+// Publish queues an event for every configured URL. It only touches
+// memory; the outbox is written in the background.
+func (d *Dispatcher) Publish(t Type, meta *storage.FileMetadata) {
+	cfg := d.cfg.Load()
+	if !cfg.wants(t) {
+		return
+	}
+
+	ev := Event{
+		ID:   newID(),
+		Type: t,
+		Time: time.Now().UTC(),
+		File: meta,
+	}
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		log.Printf("Dropped webhook %s for %s: published after shutdown", t, meta.StoredName)
+		return
+	}
+	for _, url := range cfg.URLs {
+		d.unsaved = append(d.unsaved, &delivery{URL: url, Event: ev, NextAttempt: ev.Time})
+	}
+	d.mu.Unlock()
+
+	select {
+	case d.written <- struct{}{}:
+	default:
+	}
+}
+
+// writeOutbox saves published events and passes them on to the workers.
+// Events published while a batch is being written go into the next one.
+func (d *Dispatcher) writeOutbox() {
+	for {
+		select {
+		case <-d.written:
+			d.flush()
+		case <-d.ctx.Done():
+			d.flush()
+			return
+		}
+	}
+}
+
+func (d *Dispatcher) flush() {
+	d.mu.Lock()
+	batch := d.unsaved
+	d.unsaved = nil
+	d.mu.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+
+	if err := os.MkdirAll(d.dir, 0o755); err != nil {
+		log.Printf("Failed to create the webhook outbox: %v", err)
+	}
+	// Downloads are too frequent to wait for the disk on each one, and
+	// losing a few in a crash matters less than losing an upload or
+	// deletion, so they are only synced along with other events.
+	durable := false
+	for _, dl := range batch {
+		sync := dl.Event.Type != FileDownloaded
+		durable = durable || sync
+		if err := d.save(dl, sync); err != nil {
+			log.Printf("Failed to write webhook event to the outbox: %v", err)
+		}
+	}
+	if durable {
+		if err := syncDir(d.dir); err != nil {
+			log.Printf("Failed to sync the webhook outbox: %v", err)
+		}
+	}
+	if d.ctx.Err() != nil {
+		// Shutting down: the batch is sent after the next start.
+		return
+	}
+	for _, dl := range batch {
+		d.worker(dl.URL).add(dl)
+	}
+}
+
+// worker returns the worker for url, starting it on first use.
+func (d *Dispatcher) worker(url string) *worker {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	w, ok := d.workers[url]
+	if !ok {
+		w = &worker{d: d, wake: make(chan struct{}, 1)}
+		d.workers[url] = w
+		d.wg.Go(w.run)
+	}
+	return w
+}
+
+func (w *worker) add(dl *delivery) {
+	w.mu.Lock()
+	w.pending = append(w.pending, dl)
+	w.mu.Unlock()
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (w *worker) run() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		for _, dl := range w.due(time.Now()) {
+			w.attempt(dl)
+			if w.d.ctx.Err() != nil {
+				return
+			}
+		}
+
+		var fire <-chan time.Time
+		if next, ok := w.next(); ok {
+			timer.Reset(time.Until(next))
+			fire = timer.C
+		} else {
+			timer.Stop()
+		}
+
+		select {
+		case <-fire:
+		case <-w.wake:
+		case <-w.d.ctx.Done():
+			return
+		}
+	}
+}
+
+// due removes and returns the deliveries whose next attempt has come.
+func (w *worker) due(now time.Time) []*delivery {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var due []*delivery
+	w.pending = slices.DeleteFunc(w.pending, func(dl *delivery) bool {
+		if dl.NextAttempt.After(now) {
+			return false
+		}
+		due = append(due, dl)
+		return true
+	})
+	return due
+}
+
+func (w *worker) next() (time.Time, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.pending) == 0 {
+		return time.Time{}, false
+	}
+	next := w.pending[0].NextAttempt
+	for _, dl := range w.pending[1:] {
+		if dl.NextAttempt.Before(next) {
+			next = dl.NextAttempt
+		}
+	}
+	return next, true
+}
+
+// attempt sends dl once and either removes it from the outbox or schedules
+// a retry.
+func (w *worker) attempt(dl *delivery) {
+	d := w.d
+	cfg := d.cfg.Load()
+	err := d.send(cfg, dl)
+	if d.ctx.Err() != nil {
+		// Shutting down: the delivery stays in the outbox for next time.
+		return
+	}
+	if err == nil {
+		d.remove(dl)
+		return
+	}
+
+	dl.Attempts++
+	if dl.Attempts >= cfg.MaxAttempts {
+		log.Printf("Giving up on webhook %s for %s after %d attempts: %v", dl.Event.Type, dl.URL, dl.Attempts, err)
+		d.remove(dl)
+		return
+	}
+
+	wait := backoff(dl.Attempts)
+	dl.NextAttempt = time.Now().Add(wait)
+	log.Printf("Webhook %s for %s failed, retrying in %s: %v", dl.Event.Type, dl.URL, wait, err)
+	if err := d.save(dl, dl.Event.Type != FileDownloaded); err != nil {
+		log.Printf("Failed to update webhook event in the outbox: %v", err)
+	}
+
+	w.mu.Lock()
+	w.pending = append(w.pending, dl)
+	w.mu.Unlock()
+}
+
+// backoff returns the wait after the given number of failed attempts.
+func backoff(attempts int) time.Duration {
+	return min(backoffBase<<min(attempts-1, 20), backoffMax)
+}
+
+func (d *Dispatcher) send(cfg *Config, dl *delivery) error {
+	body, err := json.Marshal(dl.Event)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(d.ctx, cfg.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, dl.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "kcst-webhook")
+	req.Header.Set(EventHeader, string(dl.Event.Type))
+	req.Header.Set(DeliveryHeader, dl.Event.ID)
+	if cfg.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(cfg.Secret, body))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("receiver returned %s", resp.Status)
+	}
+	return nil
+}
+
+// save writes dl to the outbox through a temporary file. With sync set it
+// is flushed to disk first, so a crash never leaves a truncated entry.
+func (d *Dispatcher) save(dl *delivery, sync bool) error {
+	data, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(d.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if sync {
+		if err := tmp.Sync(); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(d.dir, dl.fileName()))
+}
+
+func (d *Dispatcher) remove(dl *delivery) {
+	if err := os.Remove(filepath.Join(d.dir, dl.fileName())); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove webhook event from the outbox: %v", err)
+	}
+}
+
+func (d *Dispatcher) load() ([]*delivery, error) {
+	entries, err := os.ReadDir(d.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var loaded []*delivery
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasPrefix(name, ".tmp-") {
+			os.Remove(filepath.Join(d.dir, name))
+			continue
+		}
+		if e.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(d.dir, name))
+		if err != nil {
+			return nil, err
+		}
+		var dl delivery
+		if err := json.Unmarshal(data, &dl); err != nil {
+			// Most likely a download event cut short by a crash.
+			log.Printf("Removing unreadable webhook event %s: %v", name, err)
+			os.Remove(filepath.Join(d.dir, name))
+			continue
+		}
+		loaded = append(loaded, &dl)
+	}
+	return loaded, nil
+}
+
+// syncDir makes the renames in dir durable.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
@@ -0,0 +1,64 @@
+// Package events notifies webhooks about what happens to files. Events are
+// written to an outbox directory before delivery and retried with backoff
+// until the receiver accepts them, so they survive restarts.
+package events
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/keircn/kcst/internal/storage"
+)
+
+type Type string
+
+const (
+	FileUploaded   Type = "file.uploaded"
+	FileDownloaded Type = "file.downloaded"
+	FileDeleted    Type = "file.deleted"
+	FileExpired    Type = "file.expired"
+)
+
+// Headers set on every webhook request.
+const (
+	SignatureHeader = "X-Kcst-Signature"
+	EventHeader     = "X-Kcst-Event"
+	DeliveryHeader  = "X-Kcst-Delivery"
+)
+
+// Event is the JSON body of a webhook request.
+type Event struct {
+	ID   string                `json:"id"`
+	Type Type                  `json:"type"`
+	Time time.Time             `json:"time"`
+	File *storage.FileMetadata `json:"file"`
+}
+
+// Publisher accepts events for delivery. Publish must not block on the
+// network.
+type Publisher interface {
+	Publish(t Type, meta *storage.FileMetadata)
+}
+
+// Sign returns the value of the signature header for body: "sha256="
+// followed by the hex HMAC-SHA256 of body keyed with secret.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether signature is a valid signature of body. Receivers
+// should check it before trusting a request.
+func Verify(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, body)), []byte(signature))
+}
+
+func newID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
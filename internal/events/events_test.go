@@ -0,0 +1,389 @@
+package events
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/keircn/kcst/internal/storage"
+)
+
+const secret = "s3cret"
+
+type request struct {
+	event     Event
+	signature string
+	eventType string
+	delivery  string
+	valid     bool
+}
+
+// receiver records webhook requests and answers with the status returned
+// by status, which is called with the 1-based number of the request.
+type receiver struct {
+	mu       sync.Mutex
+	requests []request
+	status   func(n int) int
+}
+
+func newReceiver(t *testing.T, status func(n int) int) (*receiver, *httptest.Server) {
+	rc := &receiver{status: status}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		req := request{
+			signature: r.Header.Get(SignatureHeader),
+			eventType: r.Header.Get(EventHeader),
+			delivery:  r.Header.Get(DeliveryHeader),
+		}
+		req.valid = Verify(secret, body, req.signature)
+		json.Unmarshal(body, &req.event)
+
+		rc.mu.Lock()
+		rc.requests = append(rc.requests, req)
+		n := len(rc.requests)
+		rc.mu.Unlock()
+
+		code := http.StatusNoContent
+		if rc.status != nil {
+			code = rc.status(n)
+		}
+		w.WriteHeader(code)
+	}))
+	t.Cleanup(srv.Close)
+	return rc, srv
+}
+
+func (rc *receiver) received() []request {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return append([]request(nil), rc.requests...)
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func outbox(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func fastBackoff(t *testing.T) {
+	base, max := backoffBase, backoffMax
+	backoffBase, backoffMax = 10*time.Millisecond, 40*time.Millisecond
+	t.Cleanup(func() { backoffBase, backoffMax = base, max })
+}
+
+func newDispatcher(t *testing.T, dir string, urls ...string) *Dispatcher {
+	t.Helper()
+	d, err := NewDispatcher(dir, &Config{URLs: urls, Secret: secret, Timeout: 5 * time.Second, MaxAttempts: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+var file = &storage.FileMetadata{ID: "abc", StoredName: "abc.txt", Size: 3}
+
+func TestSignVerify(t *testing.T) {
+	body := []byte(`{"id":"1"}`)
+	sig := Sign(secret, body)
+	if !Verify(secret, body, sig) {
+		t.Error("valid signature rejected")
+	}
+	if Verify("other", body, sig) || Verify(secret, []byte(`{"id":"2"}`), sig) || Verify(secret, body, "") {
+		t.Error("invalid signature accepted")
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	rc, srv := newReceiver(t, nil)
+	dir := t.TempDir()
+	d := newDispatcher(t, dir, srv.URL)
+	defer d.Close()
+
+	d.Publish(FileUploaded, file)
+	waitFor(t, "delivery", func() bool { return len(rc.received()) == 1 })
+
+	req := rc.received()[0]
+	if !req.valid {
+		t.Errorf("bad signature %q", req.signature)
+	}
+	if req.eventType != string(FileUploaded) || req.event.Type != FileUploaded {
+		t.Errorf("event type %q / %q", req.eventType, req.event.Type)
+	}
+	if req.delivery == "" || req.delivery != req.event.ID {
+		t.Errorf("delivery header %q, event id %q", req.delivery, req.event.ID)
+	}
+	if req.event.File == nil || req.event.File.StoredName != "abc.txt" {
+		t.Errorf("file = %+v", req.event.File)
+	}
+	waitFor(t, "outbox to empty", func() bool { return len(outbox(t, dir)) == 0 })
+}
+
+func TestFilterEvents(t *testing.T) {
+	rc, srv := newReceiver(t, nil)
+	d, err := NewDispatcher(t.TempDir(), &Config{URLs: []string{srv.URL}, Secret: secret,
+		Events: []Type{FileDeleted}, Timeout: time.Second, MaxAttempts: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	d.Publish(FileUploaded, file)
+	d.Publish(FileDeleted, file)
+	waitFor(t, "delivery", func() bool { return len(rc.received()) == 1 })
+	time.Sleep(50 * time.Millisecond)
+	if got := rc.received(); len(got) != 1 || got[0].event.Type != FileDeleted {
+		t.Errorf("received %+v", got)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	fastBackoff(t)
+	rc, srv := newReceiver(t, func(n int) int {
+		if n <= 2 {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	})
+	dir := t.TempDir()
+	d := newDispatcher(t, dir, srv.URL)
+	defer d.Close()
+
+	d.Publish(FileExpired, file)
+	waitFor(t, "three attempts", func() bool { return len(rc.received()) == 3 })
+	waitFor(t, "outbox to empty", func() bool { return len(outbox(t, dir)) == 0 })
+
+	got := rc.received()
+	for _, req := range got[1:] {
+		if req.event.ID != got[0].event.ID {
+			t.Errorf("retry sent event %s, want %s", req.event.ID, got[0].event.ID)
+		}
+	}
+}
+
+func TestGiveUp(t *testing.T) {
+	fastBackoff(t)
+	rc, srv := newReceiver(t, func(int) int { return http.StatusInternalServerError })
+	dir := t.TempDir()
+	d := newDispatcher(t, dir, srv.URL)
+	defer d.Close()
+
+	d.Publish(FileDeleted, file)
+	waitFor(t, "outbox to empty", func() bool { return len(rc.received()) == 3 && len(outbox(t, dir)) == 0 })
+	time.Sleep(100 * time.Millisecond)
+	if n := len(rc.received()); n != 3 {
+		t.Errorf("%d attempts, want max_attempts = 3", n)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{3, 40 * time.Second},
+		{9, 2560 * time.Second},
+		{10, time.Hour},
+		{100, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := backoff(tt.attempts); got != tt.want {
+			t.Errorf("backoff(%d) = %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestOutboxReplay(t *testing.T) {
+	// The receiver is down at first; the event waits in the outbox.
+	var up atomic.Bool
+	rc, srv := newReceiver(t, func(int) int {
+		if up.Load() {
+			return http.StatusOK
+		}
+		return http.StatusServiceUnavailable
+	})
+	dir := t.TempDir()
+	d := newDispatcher(t, dir, srv.URL)
+	d.Publish(FileUploaded, file)
+	waitFor(t, "first attempt", func() bool { return len(rc.received()) == 1 })
+	d.Close()
+
+	names := outbox(t, dir)
+	if len(names) != 1 {
+		t.Fatalf("outbox = %v", names)
+	}
+	path := filepath.Join(dir, names[0])
+	var dl delivery
+	data, _ := os.ReadFile(path)
+	if err := json.Unmarshal(data, &dl); err != nil || dl.Attempts != 1 || !dl.NextAttempt.After(time.Now()) {
+		t.Fatalf("outbox entry = %s, %v", data, err)
+	}
+
+	// Let the retry come due while the server is stopped.
+	dl.NextAttempt = time.Now()
+	data, _ = json.Marshal(dl)
+	os.WriteFile(path, data, 0o644)
+
+	up.Store(true)
+	d = newDispatcher(t, dir, srv.URL)
+	defer d.Close()
+	waitFor(t, "replay", func() bool { return len(rc.received()) == 2 })
+	if got := rc.received()[1]; got.event.ID != dl.Event.ID || !got.valid {
+		t.Errorf("replayed %+v", got)
+	}
+	waitFor(t, "outbox to empty", func() bool { return len(outbox(t, dir)) == 0 })
+}
+
+func TestCloseFlushesOutbox(t *testing.T) {
+	_, srv := newReceiver(t, func(int) int { return http.StatusServiceUnavailable })
+	dir := t.TempDir()
+	d := newDispatcher(t, dir, srv.URL)
+	d.Publish(FileUploaded, file)
+	d.Publish(FileDeleted, file)
+	d.Close()
+
+	// Whether or not the writer got to them before Close, both events are
+	// in the outbox afterwards.
+	names := outbox(t, dir)
+	if len(names) != 2 {
+		t.Fatalf("outbox = %v", names)
+	}
+	for _, name := range names {
+		data, _ := os.ReadFile(filepath.Join(dir, name))
+		var dl delivery
+		if err := json.Unmarshal(data, &dl); err != nil {
+			t.Errorf("outbox entry %s unreadable: %v", name, err)
+		}
+	}
+}
+
+func TestSlowReceiver(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+	fast, fastSrv := newReceiver(t, nil)
+
+	d := newDispatcher(t, t.TempDir(), slow.URL, fastSrv.URL)
+	defer d.Close()
+
+	for range 3 {
+		d.Publish(FileDownloaded, file)
+	}
+	waitFor(t, "fast receiver", func() bool { return len(fast.received()) == 3 })
+}
+
+// Without URLs nothing is written, and the outbox is created once URLs are
+// configured.
+func TestNoURLs(t *testing.T) {
+	rc, srv := newReceiver(t, nil)
+	dir := filepath.Join(t.TempDir(), "outbox")
+	d := newDispatcher(t, dir)
+	defer d.Close()
+
+	d.Publish(FileUploaded, file)
+	d.Publish(FileDownloaded, file)
+	d.mu.Lock()
+	pending := len(d.unsaved)
+	d.mu.Unlock()
+	if pending != 0 {
+		t.Errorf("%d events queued without URLs", pending)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("outbox directory exists without URLs: %v", err)
+	}
+
+	d.Reconfigure(&Config{URLs: []string{srv.URL}, Secret: secret, Timeout: 5 * time.Second, MaxAttempts: 3})
+	d.Publish(FileUploaded, file)
+	waitFor(t, "delivery", func() bool { return len(rc.received()) == 1 })
+	if got := rc.received()[0].eventType; got != string(FileUploaded) {
+		t.Errorf("delivered %s, want %s", got, FileUploaded)
+	}
+}
+
+func TestPublishAfterClose(t *testing.T) {
+	_, srv := newReceiver(t, func(int) int { return http.StatusServiceUnavailable })
+	dir := t.TempDir()
+	d := newDispatcher(t, dir, srv.URL)
+	d.Close()
+
+	d.Publish(FileDeleted, file)
+	d.mu.Lock()
+	pending := len(d.unsaved)
+	d.mu.Unlock()
+	if pending != 0 {
+		t.Errorf("%d events queued after Close", pending)
+	}
+	if names := outbox(t, dir); len(names) != 0 {
+		t.Errorf("outbox = %v", names)
+	}
+}
+
+// Download events skip the fsync but are still kept and replayed.
+func TestDownloadReplay(t *testing.T) {
+	var up atomic.Bool
+	rc, srv := newReceiver(t, func(int) int {
+		if up.Load() {
+			return http.StatusOK
+		}
+		return http.StatusServiceUnavailable
+	})
+	dir := t.TempDir()
+	d := newDispatcher(t, dir, srv.URL)
+	d.Publish(FileDownloaded, file)
+	d.Close()
+	if names := outbox(t, dir); len(names) != 1 {
+		t.Fatalf("outbox = %v", names)
+	}
+
+	up.Store(true)
+	d = newDispatcher(t, dir, srv.URL)
+	defer d.Close()
+	waitFor(t, "replay", func() bool {
+		received := rc.received()
+		return len(received) > 0 && received[len(received)-1].eventType == string(FileDownloaded)
+	})
+	waitFor(t, "outbox to empty", func() bool { return len(outbox(t, dir)) == 0 })
+}
+
+// An entry cut short by a crash is removed rather than skipped on every
+// start.
+func TestLoadTruncated(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "0123.json"), []byte(`{"url":`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	d := newDispatcher(t, dir)
+	d.Close()
+	if names := outbox(t, dir); len(names) != 0 {
+		t.Errorf("outbox = %v", names)
+	}
+}
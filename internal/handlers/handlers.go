@@ -1,31 +1,79 @@
 package handlers
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"math"
 	"net/http"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/keircn/kcst/internal/archive"
+	"github.com/keircn/kcst/internal/config"
+	"github.com/keircn/kcst/internal/events"
+	"github.com/keircn/kcst/internal/imagemeta"
+	"github.com/keircn/kcst/internal/metrics"
 	"github.com/keircn/kcst/internal/models"
+	"github.com/keircn/kcst/internal/proxy"
+	"github.com/keircn/kcst/internal/retention"
 	"github.com/keircn/kcst/internal/storage"
 	"github.com/keircn/kcst/internal/templates"
 	"github.com/keircn/kcst/internal/upload"
 )
 
+const (
+	// formOverhead allows for the multipart framing and the other form
+	// fields on top of the largest accepted file.
+	formOverhead = 1 << 20
+	// formMemory is how much of a form is held in memory; the rest is
+	// buffered in temporary files.
+	formMemory = 32 << 20
+)
+
 type Handler struct {
 	templates *templates.Templates
 	store     *upload.Store
-	baseURL   string
+	events    events.Publisher
+	archives  *archive.Cache
+	limiter   *rateLimiter
+	settings  atomic.Pointer[settings]
+}
+
+// settings are the parts of the config that can change on reload.
+type settings struct {
+	baseURL     string
+	tls         bool
+	uploadCfg   config.UploadConfig
+	apiKeys     []string
+	maxFileSize int64
 }
 
-func New(t *templates.Templates, s *upload.Store, baseURL string) *Handler {
-	return &Handler{
+func New(t *templates.Templates, s *upload.Store, p events.Publisher, cfg *config.Config) *Handler {
+	h := &Handler{
 		templates: t,
 		store:     s,
-		baseURL:   strings.TrimSuffix(baseURL, "/"),
+		events:    p,
+		archives:  archive.NewCache(256),
+		limiter:   newRateLimiter(),
 	}
+	h.Reconfigure(cfg)
+	return h
+}
+
+func (h *Handler) Reconfigure(cfg *config.Config) {
+	h.settings.Store(&settings{
+		baseURL:     strings.TrimSuffix(cfg.Server.BaseURL, "/"),
+		tls:         cfg.TLS.Enabled(),
+		uploadCfg:   cfg.Upload,
+		apiKeys:     cfg.Auth.APIKeys,
+		maxFileSize: cfg.Retention.MaxFileSize,
+	})
 }
 
 func (h *Handler) Root(w http.ResponseWriter, r *http.Request) {
@@ -40,21 +88,31 @@ func (h *Handler) Root(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) getBaseURL(r *http.Request) string {
-	if h.baseURL != "" {
-		return h.baseURL
+	cfg := h.settings.Load()
+	if cfg.baseURL != "" {
+		return cfg.baseURL
+	}
+	info, ok := proxy.FromContext(r.Context())
+	if !ok {
+		info = proxy.Info{Scheme: "http", Host: r.Host}
 	}
-	scheme := "http"
-	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
-		scheme = "https"
+	if cfg.tls || r.TLS != nil {
+		info.Scheme = "https"
 	}
-	return fmt.Sprintf("%s://%s", scheme, r.Host)
+	return fmt.Sprintf("%s://%s", info.Scheme, info.Host)
 }
 
 func (h *Handler) home(w http.ResponseWriter, r *http.Request) {
+	policy := storage.Retention()
+	maxSize := h.settings.Load().maxFileSize
 	data := models.PageData{
-		Title:   "kcst",
-		Message: "Temporary file hosting.",
-		BaseURL: h.getBaseURL(r),
+		Title:             "kcst",
+		Message:           "Temporary file hosting.",
+		BaseURL:           h.getBaseURL(r),
+		MaxFileSize:       retention.SizeLabel(maxSize),
+		RetentionDiagram:  retention.Diagram(policy, maxSize),
+		RetentionSummary:  retention.Summary(policy, maxSize),
+		RetentionExamples: retention.Examples(policy, maxSize),
 	}
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -66,7 +124,20 @@ func (h *Handler) home(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) upload(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 
-	if err := r.ParseMultipartForm(100 << 20); err != nil {
+	cfg := h.settings.Load()
+	if ok, wait := h.limiter.allow(proxy.ClientIP(r), cfg.uploadCfg.RateLimit); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		h.jsonError(w, "Too many uploads, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.maxFileSize+formOverhead)
+	if err := r.ParseMultipartForm(formMemory); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			h.fileTooLarge(w, cfg.maxFileSize)
+			return
+		}
 		h.jsonError(w, "Failed to parse form", http.StatusBadRequest)
 		return
 	}
@@ -77,15 +148,60 @@ func (h *Handler) upload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer file.Close()
+	if header.Size > cfg.maxFileSize {
+		h.fileTooLarge(w, cfg.maxFileSize)
+		return
+	}
+
+	opts := upload.Options{
+		StripMetadata: cfg.uploadCfg.StripMetadata,
+		Client:        proxy.ClientIP(r),
+	}
+	if v := r.FormValue("strip_metadata"); v != "" {
+		strip, err := strconv.ParseBool(v)
+		if err != nil {
+			h.jsonError(w, "Invalid strip_metadata value", http.StatusBadRequest)
+			return
+		}
+		opts.StripMetadata = strip
+	}
 
-	filename, meta, err := h.store.Save(file, header)
+	if slug := r.FormValue("slug"); slug != "" {
+		if !cfg.uploadCfg.CustomSlugs {
+			h.jsonError(w, "Custom slugs are disabled", http.StatusForbidden)
+			return
+		}
+		if cfg.uploadCfg.SlugsRequireKey && !cfg.hasAPIKey(r) {
+			h.jsonError(w, "Custom slugs require an API key", http.StatusUnauthorized)
+			return
+		}
+		opts.Slug = slug
+	}
+
+	filename, meta, err := h.store.Save(file, header, opts)
 	if err != nil {
-		h.jsonError(w, "Failed to save file", http.StatusInternalServerError)
+		metrics.UploadErrors.Add(1)
+		switch {
+		case errors.Is(err, upload.ErrInvalidSlug):
+			h.jsonError(w, "Invalid slug", http.StatusBadRequest)
+		case errors.Is(err, upload.ErrSlugTaken):
+			h.jsonError(w, "Slug already in use", http.StatusConflict)
+		case errors.Is(err, imagemeta.ErrMalformed):
+			h.jsonError(w, "Malformed image, cannot strip its metadata; retry with strip_metadata=false to store it unchanged", http.StatusBadRequest)
+		case errors.Is(err, upload.ErrBlocked):
+			log.Printf("Rejected blocked upload %q from %s", header.Filename, proxy.ClientIP(r))
+			h.jsonError(w, "This content has been blocked", http.StatusUnavailableForLegalReasons)
+		default:
+			h.jsonError(w, "Failed to save file", http.StatusInternalServerError)
+		}
 		return
 	}
 
 	baseURL := h.getBaseURL(r)
 	responseMS := time.Since(start).Milliseconds()
+	log.Printf("Uploaded %s (%d bytes) from %s", filename, meta.Size, proxy.ClientIP(r))
+	metrics.Uploads.Add(1)
+	metrics.UploadBytes.Add(meta.Size)
 
 	resp := models.UploadResponse{
 		Success:      true,
@@ -95,11 +211,13 @@ func (h *Handler) upload(w http.ResponseWriter, r *http.Request) {
 		Filename:     filename,
 		OriginalName: meta.OriginalName,
 		Size:         meta.Size,
-		SizeHuman:    formatSize(meta.Size),
+		SizeHuman:    models.FormatSize(meta.Size),
 		ContentType:  meta.ContentType,
+		Stripped:     meta.Stripped,
 		UploadedAt:   meta.UploadedAt,
-		ExpiresAt:    meta.ExpiresAt(),
-		RetentionMS:  storage.CalculateTTL(meta.Size).Milliseconds(),
+		ExpiresAt:    meta.ExpiresAt,
+		RetentionMS:  meta.ExpiresAt.Sub(meta.UploadedAt).Milliseconds(),
+		ScanStatus:   meta.Scan,
 		ResponseMS:   responseMS,
 	}
 
@@ -107,6 +225,23 @@ func (h *Handler) upload(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(resp)
 }
 
+func (s *settings) hasAPIKey(r *http.Request) bool {
+	key := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if key == "" {
+		return false
+	}
+	for _, k := range s.apiKeys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(k)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Handler) fileTooLarge(w http.ResponseWriter, limit int64) {
+	h.jsonError(w, "File exceeds the maximum size of "+retention.SizeLabel(limit), http.StatusRequestEntityTooLarge)
+}
+
 func (h *Handler) jsonError(w http.ResponseWriter, message string, code int) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
@@ -132,14 +267,81 @@ func (h *Handler) ServeFile(w http.ResponseWriter, r *http.Request) {
 
 	file, meta, err := h.store.Get(filename)
 	if err != nil {
-		http.Error(w, "Not found", http.StatusNotFound)
+		fileError(w, err)
 		return
 	}
 	defer file.Close()
 
+	metrics.Downloads.Add(1)
+	if meta.Scan != "" {
+		w.Header().Set(scanHeader, meta.Scan)
+	}
 	w.Header().Set("Content-Type", meta.ContentType)
 	w.Header().Set("Content-Length", fmt.Sprintf("%d", meta.Size))
-	http.ServeContent(w, r, filename, meta.UploadedAt, file)
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	http.ServeContent(sw, r, filename, meta.UploadedAt, file)
+	if sw.status == http.StatusOK || sw.status == http.StatusPartialContent {
+		h.store.Touch(meta)
+		// A player fetching a file in ranges counts as one download, on
+		// its first range.
+		if sw.status == http.StatusOK || strings.HasPrefix(r.Header.Get("Range"), "bytes=0-") {
+			h.events.Publish(events.FileDownloaded, meta)
+		}
+	}
+}
+
+// scanHeader tells clients the malware scan state of a file.
+const scanHeader = "X-Kcst-Scan-Status"
+
+// fileError answers a request for a file that cannot be served. Files
+// waiting for a scan look missing, with a hint to try again; infected
+// files are refused for legal reasons, and files that could not be
+// scanned as unavailable.
+func fileError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, upload.ErrScanPending):
+		w.Header().Set(scanHeader, storage.ScanPending)
+		w.Header().Set("Retry-After", "30")
+		http.Error(w, "File is being scanned, try again shortly", http.StatusNotFound)
+	case errors.Is(err, upload.ErrInfected):
+		w.Header().Set(scanHeader, storage.ScanInfected)
+		http.Error(w, "File blocked: malware detected", http.StatusUnavailableForLegalReasons)
+	case errors.Is(err, upload.ErrScanFailed):
+		w.Header().Set(scanHeader, storage.ScanError)
+		http.Error(w, "File could not be checked for malware", http.StatusServiceUnavailable)
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// statusWriter remembers the status code written through it.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (h *Handler) Thumbnail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filename := filepath.Base(strings.TrimPrefix(r.URL.Path, "/t/"))
+
+	file, meta, err := h.store.GetThumbnail(filename)
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	http.ServeContent(w, r, meta.ID+".jpg", meta.UploadedAt, file)
 }
 
 func (h *Handler) Preview(w http.ResponseWriter, r *http.Request) {
@@ -156,29 +358,51 @@ func (h *Handler) Preview(w http.ResponseWriter, r *http.Request) {
 
 	filename = filepath.Base(filename)
 
-	_, meta, err := h.store.Get(filename)
+	file, meta, err := h.store.Get(filename)
 	if err != nil {
-		http.Error(w, "Not found", http.StatusNotFound)
+		fileError(w, err)
 		return
 	}
+	defer file.Close()
 
 	baseURL := h.getBaseURL(r)
-	mediaType := getMediaType(meta.ContentType)
+	mediaType := getMediaType(meta.ContentType, meta.StoredName)
+	expiresAt := h.store.ExpiresAt(meta)
 
 	data := models.FilePreviewData{
 		Title:        fmt.Sprintf("%s - kcst", meta.OriginalName),
-		Description:  fmt.Sprintf("Expires %s", meta.ExpiresAt().Format("Jan 02, 2006")),
+		Description:  fmt.Sprintf("Expires %s", expiresAt.Format("Jan 02, 2006")),
 		Filename:     filename,
 		OriginalName: meta.OriginalName,
 		Size:         meta.Size,
-		SizeHuman:    formatSize(meta.Size),
+		SizeHuman:    models.FormatSize(meta.Size),
 		ContentType:  meta.ContentType,
 		MediaType:    mediaType,
 		RawURL:       fmt.Sprintf("%s/%s", baseURL, filename),
 		PreviewURL:   fmt.Sprintf("%s/f/%s", baseURL, filename),
 		BaseURL:      baseURL,
 		UploadedAt:   meta.UploadedAt,
-		ExpiresAt:    meta.ExpiresAt(),
+		ExpiresAt:    expiresAt,
+	}
+	if meta.Thumbnail {
+		data.ThumbnailURL = fmt.Sprintf("%s/t/%s", baseURL, filename)
+	}
+
+	if mediaType == "archive" {
+		key := meta.ID + "@" + strconv.FormatInt(meta.UploadedAt.UnixNano(), 10)
+		listing := h.archives.List(key, file, meta.Size, archive.Detect(meta.ContentType, meta.StoredName))
+		if listing.Err != nil {
+			data.MediaType = ""
+		}
+		for _, e := range listing.Entries {
+			data.Entries = append(data.Entries, models.ArchiveEntry{
+				Name:      e.Name,
+				Size:      e.Size,
+				SizeHuman: models.FormatSize(e.Size),
+				IsDir:     e.IsDir,
+			})
+		}
+		data.Truncated = listing.Truncated
 	}
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -187,7 +411,7 @@ func (h *Handler) Preview(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func getMediaType(contentType string) string {
+func getMediaType(contentType, filename string) string {
 	ct := strings.ToLower(contentType)
 	if strings.HasPrefix(ct, "image/") {
 		return "image"
@@ -195,18 +419,14 @@ func getMediaType(contentType string) string {
 	if strings.HasPrefix(ct, "video/") {
 		return "video"
 	}
-	return ""
-}
-
-func formatSize(bytes int64) string {
-	const unit = 1024
-	if bytes < unit {
-		return fmt.Sprintf("%d B", bytes)
+	if strings.HasPrefix(ct, "audio/") {
+		return "audio"
+	}
+	if ct == "application/pdf" {
+		return "pdf"
 	}
-	div, exp := int64(unit), 0
-	for n := bytes / unit; n >= unit; n /= unit {
-		div *= unit
-		exp++
+	if archive.Detect(contentType, filename) != archive.FormatNone {
+		return "archive"
 	}
-	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+	return ""
 }
@@ -0,0 +1,313 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/keircn/kcst/internal/audit"
+	"github.com/keircn/kcst/internal/blocklist"
+	"github.com/keircn/kcst/internal/config"
+	"github.com/keircn/kcst/internal/events"
+	"github.com/keircn/kcst/internal/proxy"
+	"github.com/keircn/kcst/internal/storage"
+	"github.com/keircn/kcst/internal/templates"
+	"github.com/keircn/kcst/internal/upload"
+)
+
+type discard struct{}
+
+func (discard) Publish(events.Type, *storage.FileMetadata) {}
+
+type testServer struct {
+	h     *Handler
+	db    *storage.DB
+	store *upload.Store
+	cfg   *config.Config
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	dir := t.TempDir()
+	db, err := storage.Open(filepath.Join(dir, "kcst.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	store, err := upload.NewStore(filepath.Join(dir, "uploads"), db, time.Hour, upload.IDGenerator{Alphabet: upload.AlphabetHex, Length: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(store.Wait)
+
+	cfg := config.Default()
+	cfg.Upload.CustomSlugs = true
+	return &testServer{
+		h:     New(templates.New(), store, discard{}, cfg),
+		db:    db,
+		store: store,
+		cfg:   cfg,
+	}
+}
+
+// upload posts content as a multipart upload with the given form fields.
+func (ts *testServer) upload(t *testing.T, content string, fields map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	ts.h.Root(rec, uploadRequest(t, content, fields))
+	return rec
+}
+
+func uploadRequest(t *testing.T, content string, fields map[string]string) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	fw, err := mw.CreateFormFile("file", "note.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte(content))
+	mw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+func (ts *testServer) get(path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	ts.h.ServeFile(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	return rec
+}
+
+func errorMessage(t *testing.T, rec *httptest.ResponseRecorder) string {
+	t.Helper()
+	var resp struct {
+		Success bool   `json:"success"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode error response: %v", err)
+	}
+	if resp.Success {
+		t.Error("error response claims success")
+	}
+	return resp.Error
+}
+
+func TestUploadSlug(t *testing.T) {
+	ts := newTestServer(t)
+
+	rec := ts.upload(t, "first", map[string]string{"slug": "mine.txt"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("first upload: %d %s", rec.Code, rec.Body)
+	}
+	if got := ts.get("/mine.txt"); got.Code != http.StatusOK || got.Body.String() != "first" {
+		t.Errorf("GET /mine.txt = %d %q", got.Code, got.Body)
+	}
+
+	rec = ts.upload(t, "second", map[string]string{"slug": "mine.txt"})
+	if rec.Code != http.StatusConflict {
+		t.Errorf("taken slug: status %d, want 409", rec.Code)
+	}
+	if msg := errorMessage(t, rec); msg != "Slug already in use" {
+		t.Errorf("taken slug: error %q", msg)
+	}
+	if got := ts.get("/mine.txt"); got.Body.String() != "first" {
+		t.Errorf("taken slug overwrote the file with %q", got.Body)
+	}
+
+	if rec := ts.upload(t, "x", map[string]string{"slug": "../escape"}); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid slug: status %d, want 400", rec.Code)
+	}
+
+	ts.cfg.Upload.CustomSlugs = false
+	ts.h.Reconfigure(ts.cfg)
+	if rec := ts.upload(t, "x", map[string]string{"slug": "other"}); rec.Code != http.StatusForbidden {
+		t.Errorf("slugs disabled: status %d, want 403", rec.Code)
+	}
+}
+
+func TestUploadSlugRequiresKey(t *testing.T) {
+	ts := newTestServer(t)
+	ts.cfg.Upload.SlugsRequireKey = true
+	ts.cfg.Auth.APIKeys = []string{"secret"}
+	ts.h.Reconfigure(ts.cfg)
+
+	if rec := ts.upload(t, "x", map[string]string{"slug": "mine"}); rec.Code != http.StatusUnauthorized {
+		t.Errorf("without a key: status %d, want 401", rec.Code)
+	}
+}
+
+func TestUploadBlocked(t *testing.T) {
+	ts := newTestServer(t)
+	dir := t.TempDir()
+	bl, err := blocklist.Open(filepath.Join(dir, "blocklist.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.store.SetBlocklist(bl, audit.New(filepath.Join(dir, "audit.log")))
+	sum := sha256.Sum256([]byte("taken down"))
+	if _, _, err := ts.store.Block([]string{hex.EncodeToString(sum[:])}, "DMCA", "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := ts.upload(t, "taken down", nil)
+	if rec.Code != http.StatusUnavailableForLegalReasons {
+		t.Errorf("status %d, want 451", rec.Code)
+	}
+	if rec := ts.upload(t, "fine", nil); rec.Code != http.StatusOK {
+		t.Errorf("unrelated upload: status %d", rec.Code)
+	}
+}
+
+func TestServeFileErrors(t *testing.T) {
+	ts := newTestServer(t)
+	rec := ts.upload(t, "content", map[string]string{"slug": "file.txt"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("upload: %d %s", rec.Code, rec.Body)
+	}
+	meta, _ := ts.db.GetMetadataByStoredName("file.txt")
+
+	if got := ts.get("/missing.txt"); got.Code != http.StatusNotFound {
+		t.Errorf("missing file: status %d, want 404", got.Code)
+	}
+
+	tests := []struct {
+		scan       string
+		status     int
+		retryAfter bool
+	}{
+		{storage.ScanPending, http.StatusNotFound, true},
+		{storage.ScanInfected, http.StatusUnavailableForLegalReasons, false},
+		{storage.ScanError, http.StatusServiceUnavailable, false},
+		{storage.ScanClean, http.StatusOK, false},
+	}
+	for _, tt := range tests {
+		if err := ts.db.Update(meta.ID, func(m *storage.FileMetadata) { m.Scan = tt.scan }); err != nil {
+			t.Fatal(err)
+		}
+		got := ts.get("/file.txt")
+		if got.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.scan, got.Code, tt.status)
+		}
+		if h := got.Header().Get(scanHeader); h != tt.scan {
+			t.Errorf("%s: %s = %q", tt.scan, scanHeader, h)
+		}
+		if (got.Header().Get("Retry-After") != "") != tt.retryAfter {
+			t.Errorf("%s: Retry-After = %q", tt.scan, got.Header().Get("Retry-After"))
+		}
+	}
+
+	// Expired files are gone even before cleanup removes them.
+	if err := ts.db.Update(meta.ID, func(m *storage.FileMetadata) { m.ExpiresAt = time.Now().Add(-time.Minute) }); err != nil {
+		t.Fatal(err)
+	}
+	if got := ts.get("/file.txt"); got.Code != http.StatusNotFound {
+		t.Errorf("expired file: status %d, want 404", got.Code)
+	}
+}
+
+func TestUploadRateLimit(t *testing.T) {
+	ts := newTestServer(t)
+	ts.cfg.Upload.RateLimit = 2
+	ts.h.Reconfigure(ts.cfg)
+
+	for i := range 2 {
+		if rec := ts.upload(t, "hello", nil); rec.Code != http.StatusOK {
+			t.Fatalf("upload %d: status = %d, body %s", i+1, rec.Code, rec.Body)
+		}
+	}
+	rec := ts.upload(t, "hello", nil)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "30" {
+		t.Errorf("Retry-After = %q, want 30", got)
+	}
+
+	// A reload lifting the limit applies to the next request.
+	ts.cfg.Upload.RateLimit = 0
+	ts.h.Reconfigure(ts.cfg)
+	if rec := ts.upload(t, "hello", nil); rec.Code != http.StatusOK {
+		t.Errorf("status after lifting the limit = %d", rec.Code)
+	}
+}
+
+// Clients behind a trusted proxy are limited by their forwarded address,
+// not the proxy's.
+func TestUploadRateLimitBehindProxy(t *testing.T) {
+	ts := newTestServer(t)
+	ts.cfg.Upload.RateLimit = 1
+	ts.h.Reconfigure(ts.cfg)
+	resolver, err := proxy.New([]string{"192.0.2.0/24"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := resolver.Handler(http.HandlerFunc(ts.h.Root))
+
+	post := func(client string) int {
+		req := uploadRequest(t, "hello", nil)
+		req.Header.Set("X-Forwarded-For", client)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := post("203.0.113.5"); code != http.StatusOK {
+		t.Fatalf("first upload: status = %d", code)
+	}
+	if code := post("203.0.113.5"); code != http.StatusTooManyRequests {
+		t.Errorf("second upload from the same client: status = %d, want %d", code, http.StatusTooManyRequests)
+	}
+	if code := post("203.0.113.6"); code != http.StatusOK {
+		t.Errorf("upload from another client: status = %d", code)
+	}
+}
+
+func TestUploadTooLarge(t *testing.T) {
+	ts := newTestServer(t)
+	ts.cfg.Retention.MaxFileSize = 1024
+	ts.h.Reconfigure(ts.cfg)
+
+	if rec := ts.upload(t, strings.Repeat("x", 1024), nil); rec.Code != http.StatusOK {
+		t.Errorf("file at the limit: status = %d, body %s", rec.Code, rec.Body)
+	}
+	// Just over the limit, within the allowance for the form itself.
+	rec := ts.upload(t, strings.Repeat("x", 1025), nil)
+	if rec.Code != http.StatusRequestEntityTooLarge || errorMessage(t, rec) != "File exceeds the maximum size of 1 KiB" {
+		t.Errorf("file over the limit: status = %d, body %s", rec.Code, rec.Body)
+	}
+	// Far over it, where reading the form stops early.
+	rec = ts.upload(t, strings.Repeat("x", 2<<20), nil)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("large file: status = %d, body %s", rec.Code, rec.Body)
+	}
+	if records, _ := ts.db.ListMetadata(); len(records) != 1 {
+		t.Errorf("records = %d, want 1", len(records))
+	}
+}
+
+func TestUploadMalformedImage(t *testing.T) {
+	ts := newTestServer(t)
+	// A JPEG that ends inside its first segment.
+	jpeg := "\xff\xd8\xff\xe0\x00\x10JFIF"
+
+	rec := ts.upload(t, jpeg, map[string]string{"strip_metadata": "true"})
+	if rec.Code != http.StatusBadRequest || !strings.HasPrefix(errorMessage(t, rec), "Malformed image") {
+		t.Errorf("status = %d, body %s", rec.Code, rec.Body)
+	}
+	if rec := ts.upload(t, jpeg, map[string]string{"strip_metadata": "false"}); rec.Code != http.StatusOK {
+		t.Errorf("without stripping: status = %d, body %s", rec.Code, rec.Body)
+	}
+}
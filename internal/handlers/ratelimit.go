@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter gives each client a bucket of upload tokens that refills
+// over a minute. The rate is passed on every call so that a reload takes
+// effect immediately.
+type rateLimiter struct {
+	mu      sync.Mutex
+	now     func() time.Time
+	buckets map[string]*bucket
+	pruned  time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{now: time.Now, buckets: make(map[string]*bucket)}
+}
+
+// allow takes a token from client's bucket, which holds up to perMinute
+// tokens. When the bucket is empty it returns false and how long until
+// the next token.
+func (l *rateLimiter) allow(client string, perMinute int) (bool, time.Duration) {
+	if perMinute <= 0 {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.prune(now)
+
+	capacity := float64(perMinute)
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &bucket{tokens: capacity, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = min(capacity, b.tokens+now.Sub(b.last).Minutes()*capacity)
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / capacity * float64(time.Minute))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// prune forgets clients idle for a minute, whose buckets would be full
+// again anyway.
+func (l *rateLimiter) prune(now time.Time) {
+	if now.Sub(l.pruned) < time.Minute {
+		return
+	}
+	l.pruned = now
+	for client, b := range l.buckets {
+		if now.Sub(b.last) >= time.Minute {
+			delete(l.buckets, client)
+		}
+	}
+}
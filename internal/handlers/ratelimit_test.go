@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	l := newRateLimiter()
+	l.now = func() time.Time { return now }
+
+	for i := range 3 {
+		if ok, _ := l.allow("a", 3); !ok {
+			t.Fatalf("upload %d refused within the allowance", i+1)
+		}
+	}
+	ok, wait := l.allow("a", 3)
+	if ok {
+		t.Fatal("fourth upload allowed")
+	}
+	if wait != 20*time.Second {
+		t.Errorf("wait = %v, want 20s", wait)
+	}
+	if ok, _ := l.allow("b", 3); !ok {
+		t.Error("other client refused")
+	}
+
+	now = now.Add(20 * time.Second)
+	if ok, _ := l.allow("a", 3); !ok {
+		t.Error("upload refused after a token refilled")
+	}
+	if ok, _ := l.allow("a", 3); ok {
+		t.Error("second upload allowed after one token refilled")
+	}
+
+	// A limit of 0 turns the limiter off, and raising it applies at once.
+	if ok, _ := l.allow("a", 0); !ok {
+		t.Error("upload refused without a limit")
+	}
+
+	now = now.Add(2 * time.Minute)
+	l.allow("c", 3)
+	if _, ok := l.buckets["a"]; ok {
+		t.Error("idle client was not pruned")
+	}
+}
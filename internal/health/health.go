@@ -0,0 +1,121 @@
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/keircn/kcst/internal/storage"
+	"github.com/keircn/kcst/internal/upload"
+)
+
+type Checker struct {
+	dir     string
+	db      *storage.DB
+	store   *upload.Store
+	minFree atomic.Int64
+}
+
+func New(dir string, db *storage.DB, store *upload.Store, minFree int64) *Checker {
+	c := &Checker{dir: dir, db: db, store: store}
+	c.SetMinFree(minFree)
+	return c
+}
+
+// SetMinFree sets the free disk space below which the instance reports
+// itself as not ready. Zero disables the check.
+func (c *Checker) SetMinFree(bytes int64) {
+	c.minFree.Store(bytes)
+}
+
+type result struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// Healthz reports that the process is up and serving requests.
+func (c *Checker) Healthz(w http.ResponseWriter, r *http.Request) {
+	writeResult(w, http.StatusOK, result{Status: "ok"})
+}
+
+// Readyz reports whether the instance can accept uploads, with the outcome
+// of each check.
+func (c *Checker) Readyz(w http.ResponseWriter, r *http.Request) {
+	res, code := c.ready()
+	writeResult(w, code, res)
+}
+
+// PublicReadyz is Readyz without the details of each check, which name
+// paths and disk usage, for when the probes share the public address.
+func (c *Checker) PublicReadyz(w http.ResponseWriter, r *http.Request) {
+	res, code := c.ready()
+	writeResult(w, code, result{Status: res.Status})
+}
+
+func (c *Checker) ready() (result, int) {
+	checks := map[string]error{
+		"upload_dir": checkWritable(c.dir),
+		"disk_space": c.checkDiskSpace(),
+		"database":   c.db.Check(),
+		"cleanup":    c.checkCleanup(),
+	}
+
+	res := result{Status: "ok", Checks: make(map[string]string)}
+	code := http.StatusOK
+	for name, err := range checks {
+		if err != nil {
+			res.Checks[name] = err.Error()
+			res.Status = "unavailable"
+			code = http.StatusServiceUnavailable
+		} else {
+			res.Checks[name] = "ok"
+		}
+	}
+	return res, code
+}
+
+func writeResult(w http.ResponseWriter, code int, res result) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(res)
+}
+
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".readyz-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	f.Close()
+	return os.Remove(name)
+}
+
+func (c *Checker) checkDiskSpace() error {
+	minFree := c.minFree.Load()
+	if minFree <= 0 {
+		return nil
+	}
+	free, err := freeSpace(c.dir)
+	if err != nil {
+		return err
+	}
+	if free < minFree {
+		return fmt.Errorf("%d bytes free, need at least %d", free, minFree)
+	}
+	return nil
+}
+
+func (c *Checker) checkCleanup() error {
+	last := c.store.LastCleanup()
+	if last.IsZero() {
+		return fmt.Errorf("cleanup has not run yet")
+	}
+	if age, limit := time.Since(last), 2*c.store.CleanupInterval(); age > limit {
+		return fmt.Errorf("last run %s ago, expected within %s", age.Round(time.Second), limit)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/keircn/kcst/internal/storage"
+	"github.com/keircn/kcst/internal/upload"
+)
+
+func newChecker(t *testing.T, minFree int64) (*Checker, *upload.Store) {
+	t.Helper()
+	dir := t.TempDir()
+	db, err := storage.Open(filepath.Join(dir, "kcst.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	uploads := filepath.Join(dir, "uploads")
+	store, err := upload.NewStore(uploads, db, time.Hour, upload.IDGenerator{Length: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(uploads, db, store, minFree), store
+}
+
+func get(t *testing.T, h http.HandlerFunc) (int, result) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	var res result
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code, res
+}
+
+func TestHealthz(t *testing.T) {
+	c, _ := newChecker(t, 0)
+	if code, res := get(t, c.Healthz); code != http.StatusOK || res.Status != "ok" {
+		t.Errorf("healthz = %d %q", code, res.Status)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	c, store := newChecker(t, 0)
+
+	code, res := get(t, c.Readyz)
+	if code != http.StatusServiceUnavailable || res.Checks["cleanup"] == "ok" {
+		t.Errorf("before cleanup: %d %v", code, res.Checks)
+	}
+
+	if _, err := store.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	code, res = get(t, c.Readyz)
+	if code != http.StatusOK || res.Status != "ok" {
+		t.Errorf("after cleanup: %d %v", code, res.Checks)
+	}
+	for _, name := range []string{"upload_dir", "disk_space", "database", "cleanup"} {
+		if res.Checks[name] != "ok" {
+			t.Errorf("check %s = %q", name, res.Checks[name])
+		}
+	}
+}
+
+func TestReadyzDiskSpace(t *testing.T) {
+	c, store := newChecker(t, 1<<62)
+	store.Cleanup()
+
+	code, res := get(t, c.Readyz)
+	if code != http.StatusServiceUnavailable || res.Checks["disk_space"] == "ok" {
+		t.Errorf("readyz = %d %v", code, res.Checks)
+	}
+
+	c.SetMinFree(0)
+	if code, _ := get(t, c.Readyz); code != http.StatusOK {
+		t.Errorf("readyz with the check disabled = %d", code)
+	}
+}
+
+func TestPublicReadyz(t *testing.T) {
+	c, _ := newChecker(t, 0)
+	code, res := get(t, c.PublicReadyz)
+	if code != http.StatusServiceUnavailable || res.Status != "unavailable" {
+		t.Errorf("public readyz = %d %q", code, res.Status)
+	}
+	if res.Checks != nil {
+		t.Errorf("public readyz leaks checks: %v", res.Checks)
+	}
+}
@@ -0,0 +1,394 @@
+package imagemeta
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+var ErrMalformed = errors.New("imagemeta: malformed image")
+
+type Format int
+
+const (
+	FormatUnknown Format = iota
+	FormatJPEG
+	FormatPNG
+	FormatWebP
+)
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+func Detect(header []byte) Format {
+	switch {
+	case len(header) >= 3 && header[0] == 0xff && header[1] == 0xd8 && header[2] == 0xff:
+		return FormatJPEG
+	case bytes.HasPrefix(header, pngSignature):
+		return FormatPNG
+	case len(header) >= 12 && string(header[0:4]) == "RIFF" && string(header[8:12]) == "WEBP":
+		return FormatWebP
+	}
+	return FormatUnknown
+}
+
+// Strip copies src to dst, dropping EXIF, XMP and IPTC blocks from JPEG, PNG
+// and WebP images without touching the encoded pixel data. A JPEG or PNG
+// whose EXIF rotates the image keeps a minimal EXIF block holding only the
+// orientation, so it still displays the right way up. Other content is
+// copied unchanged. The boolean result reports whether src was an image
+// format that was processed.
+func Strip(dst io.Writer, src io.ReadSeeker) (int64, bool, error) {
+	header := make([]byte, 12)
+	n, err := io.ReadFull(src, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return 0, false, err
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return 0, false, err
+	}
+
+	cw := &countingWriter{w: dst}
+	switch Detect(header[:n]) {
+	case FormatJPEG:
+		err = stripJPEG(cw, bufio.NewReader(src))
+	case FormatPNG:
+		err = stripPNG(cw, bufio.NewReader(src))
+	case FormatWebP:
+		err = stripWebP(cw, src)
+	default:
+		_, err = io.Copy(cw, src)
+		return cw.n, false, err
+	}
+	// Running out of input before the image ends means it was truncated.
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		err = ErrMalformed
+	}
+	return cw.n, true, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+const (
+	markerSOS   = 0xda
+	markerEOI   = 0xd9
+	markerAPP1  = 0xe1
+	markerAPP13 = 0xed
+)
+
+func stripJPEG(w io.Writer, r *bufio.Reader) error {
+	soi := make([]byte, 2)
+	if _, err := io.ReadFull(r, soi); err != nil {
+		return err
+	}
+	if _, err := w.Write(soi); err != nil {
+		return err
+	}
+
+	for {
+		prefix, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if prefix != 0xff {
+			return ErrMalformed
+		}
+		marker, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		// Fill bytes may precede a marker.
+		for marker == 0xff {
+			if marker, err = r.ReadByte(); err != nil {
+				return err
+			}
+		}
+
+		if marker == markerEOI || (marker >= 0xd0 && marker <= 0xd7) || marker == 0x01 {
+			if _, err := w.Write([]byte{0xff, marker}); err != nil {
+				return err
+			}
+			if marker == markerEOI {
+				_, err = io.Copy(w, r)
+				return err
+			}
+			continue
+		}
+
+		var lenBuf [2]byte
+		if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+			return err
+		}
+		length := int64(binary.BigEndian.Uint16(lenBuf[:]))
+		if length < 2 {
+			return ErrMalformed
+		}
+
+		if marker == markerAPP1 {
+			data := make([]byte, length-2)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return err
+			}
+			tiff, ok := bytes.CutPrefix(data, exifHeader)
+			if !ok {
+				continue
+			}
+			if o := orientation(tiff); o > 1 {
+				seg := append(bytes.Clone(exifHeader), orientationTIFF(o)...)
+				hdr := []byte{0xff, markerAPP1, 0, 0}
+				binary.BigEndian.PutUint16(hdr[2:], uint16(len(seg)+2))
+				if _, err := w.Write(append(hdr, seg...)); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if marker == markerAPP13 {
+			if _, err := r.Discard(int(length - 2)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if _, err := w.Write([]byte{0xff, marker, lenBuf[0], lenBuf[1]}); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, r, length-2); err != nil {
+			return err
+		}
+
+		// Entropy-coded data follows the scan header; the rest of the
+		// file is copied verbatim.
+		if marker == markerSOS {
+			_, err := io.Copy(w, r)
+			return err
+		}
+	}
+}
+
+var pngDropped = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"tIME": true,
+}
+
+func stripPNG(w io.Writer, r *bufio.Reader) error {
+	sig := make([]byte, len(pngSignature))
+	if _, err := io.ReadFull(r, sig); err != nil {
+		return err
+	}
+	if _, err := w.Write(sig); err != nil {
+		return err
+	}
+
+	var hdr [8]byte
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		length := int64(binary.BigEndian.Uint32(hdr[:4]))
+		typ := string(hdr[4:8])
+
+		// Chunk data is followed by a 4-byte CRC.
+		if typ == "eXIf" && length <= maxEXIF {
+			data := make([]byte, length+4)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return err
+			}
+			if o := orientation(data[:length]); o > 1 {
+				if err := writePNGChunk(w, "eXIf", orientationTIFF(o)); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if pngDropped[typ] {
+			if _, err := io.CopyN(io.Discard, r, length+4); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if _, err := w.Write(hdr[:]); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, r, length+4); err != nil {
+			return err
+		}
+		if typ == "IEND" {
+			_, err := io.Copy(w, r)
+			return err
+		}
+	}
+}
+
+func writePNGChunk(w io.Writer, typ string, data []byte) error {
+	chunk := make([]byte, 8, 12+len(data))
+	binary.BigEndian.PutUint32(chunk, uint32(len(data)))
+	copy(chunk[4:], typ)
+	chunk = append(chunk, data...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+	_, err := w.Write(chunk)
+	return err
+}
+
+const (
+	webpFlagXMP  = 0x04
+	webpFlagEXIF = 0x08
+)
+
+func webpDropped(fourCC string) bool {
+	return fourCC == "EXIF" || fourCC == "XMP "
+}
+
+// stripWebP makes two passes over src: the first totals the size of the
+// chunks being removed so the RIFF header can be written up front.
+func stripWebP(w io.Writer, src io.ReadSeeker) error {
+	var riff [12]byte
+	if _, err := io.ReadFull(src, riff[:]); err != nil {
+		return err
+	}
+	riffSize := int64(binary.LittleEndian.Uint32(riff[4:8]))
+
+	var removed int64
+	var hdr [8]byte
+	for {
+		if _, err := io.ReadFull(src, hdr[:]); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		size := padded(int64(binary.LittleEndian.Uint32(hdr[4:8])))
+		if webpDropped(string(hdr[:4])) {
+			removed += 8 + size
+		}
+		if _, err := src.Seek(size, io.SeekCurrent); err != nil {
+			return err
+		}
+	}
+
+	if _, err := src.Seek(12, io.SeekStart); err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint32(riff[4:8], uint32(riffSize-removed))
+	if _, err := w.Write(riff[:]); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(src)
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		fourCC := string(hdr[:4])
+		size := padded(int64(binary.LittleEndian.Uint32(hdr[4:8])))
+
+		if webpDropped(fourCC) {
+			if _, err := r.Discard(int(size)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if _, err := w.Write(hdr[:]); err != nil {
+			return err
+		}
+
+		if fourCC == "VP8X" && size > 0 {
+			flags, err := r.ReadByte()
+			if err != nil {
+				return err
+			}
+			if _, err := w.Write([]byte{flags &^ (webpFlagXMP | webpFlagEXIF)}); err != nil {
+				return err
+			}
+			size--
+		}
+
+		if _, err := io.CopyN(w, r, size); err != nil {
+			return err
+		}
+	}
+}
+
+func padded(size int64) int64 {
+	return size + size&1
+}
+
+var exifHeader = []byte("Exif\x00\x00")
+
+const (
+	tagOrientation = 0x0112
+	typeShort      = 3
+	// maxEXIF bounds the size of a PNG eXIf chunk read into memory; a JPEG
+	// segment cannot exceed 64 KiB anyway.
+	maxEXIF = 1 << 20
+)
+
+// orientation returns the Orientation tag from the first IFD of TIFF
+// structured EXIF data, or 0 if there is none.
+func orientation(tiff []byte) uint16 {
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+
+	ifd := int64(order.Uint32(tiff[4:8]))
+	if ifd+2 > int64(len(tiff)) {
+		return 0
+	}
+	count := int64(order.Uint16(tiff[ifd:]))
+	for i := range count {
+		e := ifd + 2 + i*12
+		if e+12 > int64(len(tiff)) {
+			return 0
+		}
+		entry := tiff[e : e+12]
+		if order.Uint16(entry) == tagOrientation && order.Uint16(entry[2:]) == typeShort {
+			return order.Uint16(entry[8:])
+		}
+	}
+	return 0
+}
+
+// orientationTIFF builds EXIF data whose only entry is the orientation o.
+func orientationTIFF(o uint16) []byte {
+	b := []byte("MM\x00\x2a")
+	b = binary.BigEndian.AppendUint32(b, 8)
+	b = binary.BigEndian.AppendUint16(b, 1)
+	b = binary.BigEndian.AppendUint16(b, tagOrientation)
+	b = binary.BigEndian.AppendUint16(b, typeShort)
+	b = binary.BigEndian.AppendUint32(b, 1)
+	b = binary.BigEndian.AppendUint16(b, o)
+	b = append(b, 0, 0)
+	// No further IFDs.
+	return binary.BigEndian.AppendUint32(b, 0)
+}
@@ -0,0 +1,330 @@
+package imagemeta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"testing"
+)
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		header []byte
+		want   Format
+	}{
+		{[]byte{0xff, 0xd8, 0xff, 0xe0}, FormatJPEG},
+		{pngSignature, FormatPNG},
+		{[]byte("RIFF\x00\x00\x00\x00WEBP"), FormatWebP},
+		{[]byte("RIFF\x00\x00\x00\x00WAVE"), FormatUnknown},
+		{[]byte{0xff, 0xd8}, FormatUnknown},
+		{nil, FormatUnknown},
+	}
+	for _, tt := range tests {
+		if got := Detect(tt.header); got != tt.want {
+			t.Errorf("Detect(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+// exifTIFF builds little-endian EXIF data with a camera make and, unless o
+// is 0, an orientation.
+func exifTIFF(o uint16) []byte {
+	le := binary.LittleEndian
+	entries := 1
+	if o != 0 {
+		entries++
+	}
+	b := []byte("II\x2a\x00")
+	b = le.AppendUint32(b, 8)
+	b = le.AppendUint16(b, uint16(entries))
+	// Make, ASCII, stored after the IFD.
+	b = le.AppendUint16(b, 0x010f)
+	b = le.AppendUint16(b, 2)
+	b = le.AppendUint32(b, 8)
+	b = le.AppendUint32(b, uint32(8+2+12*entries+4))
+	if o != 0 {
+		b = le.AppendUint16(b, tagOrientation)
+		b = le.AppendUint16(b, typeShort)
+		b = le.AppendUint32(b, 1)
+		b = le.AppendUint16(b, o)
+		b = append(b, 0, 0)
+	}
+	b = le.AppendUint32(b, 0)
+	return append(b, "SECRET\x00\x00"...)
+}
+
+func jpegSegment(marker byte, data []byte) []byte {
+	seg := []byte{0xff, marker, 0, 0}
+	binary.BigEndian.PutUint16(seg[2:], uint16(len(data)+2))
+	return append(seg, data...)
+}
+
+// testJPEG encodes a small image and inserts segments after SOI.
+func testJPEG(t *testing.T, segments ...[]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	out := []byte{0xff, 0xd8}
+	for _, seg := range segments {
+		out = append(out, seg...)
+	}
+	return append(out, buf.Bytes()[2:]...)
+}
+
+func strip(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	n, ok, err := Strip(&out, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("image was not processed")
+	}
+	if n != int64(out.Len()) {
+		t.Errorf("Strip reported %d bytes, wrote %d", n, out.Len())
+	}
+	return out.Bytes()
+}
+
+func TestStripJPEG(t *testing.T) {
+	xmp := append([]byte("http://ns.adobe.com/xap/1.0/\x00"), "<x:xmpmeta>SECRET</x:xmpmeta>"...)
+	in := testJPEG(t,
+		jpegSegment(markerAPP1, append(bytes.Clone(exifHeader), exifTIFF(0)...)),
+		jpegSegment(markerAPP1, xmp),
+		jpegSegment(markerAPP13, []byte("Photoshop 3.0\x00SECRET")),
+	)
+	out := strip(t, in)
+
+	if bytes.Contains(out, []byte("SECRET")) {
+		t.Error("metadata left in output")
+	}
+	if bytes.Contains(out, exifHeader) {
+		t.Error("EXIF kept for an image without orientation")
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(out)); err != nil {
+		t.Errorf("stripped JPEG does not decode: %v", err)
+	}
+}
+
+func TestStripJPEGKeepsOrientation(t *testing.T) {
+	in := testJPEG(t, jpegSegment(markerAPP1, append(bytes.Clone(exifHeader), exifTIFF(6)...)))
+	out := strip(t, in)
+
+	if bytes.Contains(out, []byte("SECRET")) {
+		t.Error("camera make left in output")
+	}
+	i := bytes.Index(out, exifHeader)
+	if i < 0 {
+		t.Fatal("orientation dropped")
+	}
+	if got := orientation(out[i+len(exifHeader):]); got != 6 {
+		t.Errorf("orientation = %d, want 6", got)
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(out)); err != nil {
+		t.Errorf("stripped JPEG does not decode: %v", err)
+	}
+}
+
+func TestStripJPEGMalformed(t *testing.T) {
+	// An APP1 segment whose length does not cover its own length field.
+	in := []byte{0xff, 0xd8, 0xff, 0xe1, 0x00, 0x01}
+	_, _, err := Strip(io.Discard, bytes.NewReader(in))
+	if !errors.Is(err, ErrMalformed) {
+		t.Errorf("err = %v, want ErrMalformed", err)
+	}
+}
+
+// Images cut off partway through are reported as malformed rather than
+// as a read error.
+func TestStripTruncated(t *testing.T) {
+	var png8 bytes.Buffer
+	if err := png.Encode(&png8, image.NewGray(image.Rect(0, 0, 8, 8))); err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string][]byte{
+		"jpeg segment": testJPEG(t, jpegSegment(markerAPP1, []byte("SECRET")))[:8],
+		"jpeg marker":  {0xff, 0xd8, 0xff},
+		"png chunk":    png8.Bytes()[:len(pngSignature)+12],
+	}
+	for name, in := range tests {
+		_, _, err := Strip(io.Discard, bytes.NewReader(in))
+		if !errors.Is(err, ErrMalformed) {
+			t.Errorf("%s: err = %v, want ErrMalformed", name, err)
+		}
+	}
+}
+
+func pngChunk(typ string, data []byte) []byte {
+	var buf bytes.Buffer
+	writePNGChunk(&buf, typ, data)
+	return buf.Bytes()
+}
+
+// testPNG encodes a small image and inserts chunks after IHDR.
+func testPNG(t *testing.T, chunks ...[]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8))); err != nil {
+		t.Fatal(err)
+	}
+	enc := buf.Bytes()
+	// Signature, then IHDR: length, type, 13 bytes of data and a CRC.
+	ihdrEnd := len(pngSignature) + 8 + 13 + 4
+	out := bytes.Clone(enc[:ihdrEnd])
+	for _, c := range chunks {
+		out = append(out, c...)
+	}
+	return append(out, enc[ihdrEnd:]...)
+}
+
+func TestStripPNG(t *testing.T) {
+	in := testPNG(t,
+		pngChunk("tEXt", []byte("Author\x00SECRET")),
+		pngChunk("iTXt", []byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00SECRET")),
+		pngChunk("tIME", make([]byte, 7)),
+		pngChunk("eXIf", exifTIFF(0)),
+	)
+	out := strip(t, in)
+
+	for _, typ := range []string{"tEXt", "iTXt", "tIME", "eXIf", "SECRET"} {
+		if bytes.Contains(out, []byte(typ)) {
+			t.Errorf("%s left in output", typ)
+		}
+	}
+	if _, err := png.Decode(bytes.NewReader(out)); err != nil {
+		t.Errorf("stripped PNG does not decode: %v", err)
+	}
+}
+
+func TestStripPNGKeepsOrientation(t *testing.T) {
+	out := strip(t, testPNG(t, pngChunk("eXIf", exifTIFF(8))))
+
+	if bytes.Contains(out, []byte("SECRET")) {
+		t.Error("camera make left in output")
+	}
+	i := bytes.Index(out, []byte("eXIf"))
+	if i < 0 {
+		t.Fatal("orientation dropped")
+	}
+	length := binary.BigEndian.Uint32(out[i-4:])
+	data := out[i+4 : i+4+int(length)]
+	if got := orientation(data); got != 8 {
+		t.Errorf("orientation = %d, want 8", got)
+	}
+	if crc := binary.BigEndian.Uint32(out[i+4+int(length):]); crc != crc32.ChecksumIEEE(out[i:i+4+int(length)]) {
+		t.Error("eXIf chunk has a bad CRC")
+	}
+	if _, err := png.Decode(bytes.NewReader(out)); err != nil {
+		t.Errorf("stripped PNG does not decode: %v", err)
+	}
+}
+
+func webpChunk(fourCC string, data []byte) []byte {
+	c := []byte(fourCC)
+	c = binary.LittleEndian.AppendUint32(c, uint32(len(data)))
+	c = append(c, data...)
+	if len(data)%2 == 1 {
+		c = append(c, 0)
+	}
+	return c
+}
+
+func testWebP(chunks ...[]byte) []byte {
+	var body []byte
+	for _, c := range chunks {
+		body = append(body, c...)
+	}
+	out := []byte("RIFF")
+	out = binary.LittleEndian.AppendUint32(out, uint32(4+len(body)))
+	out = append(out, "WEBP"...)
+	return append(out, body...)
+}
+
+type webpChunkInfo struct {
+	fourCC string
+	data   []byte
+}
+
+func webpChunks(t *testing.T, data []byte) []webpChunkInfo {
+	t.Helper()
+	if got := binary.LittleEndian.Uint32(data[4:8]); int(got) != len(data)-8 {
+		t.Errorf("RIFF size = %d, want %d", got, len(data)-8)
+	}
+	var chunks []webpChunkInfo
+	for rest := data[12:]; len(rest) > 0; {
+		size := int(binary.LittleEndian.Uint32(rest[4:8]))
+		chunks = append(chunks, webpChunkInfo{string(rest[:4]), rest[8 : 8+size]})
+		rest = rest[8+int(padded(int64(size))):]
+	}
+	return chunks
+}
+
+func TestStripWebP(t *testing.T) {
+	const flagICC = 0x20
+	vp8x := make([]byte, 10)
+	vp8x[0] = flagICC | webpFlagEXIF | webpFlagXMP
+	in := testWebP(
+		webpChunk("VP8X", vp8x),
+		webpChunk("ICCP", []byte("icc")),
+		webpChunk("VP8L", []byte("pixels")),
+		webpChunk("EXIF", exifTIFF(6)),
+		webpChunk("XMP ", []byte("<x:xmpmeta>SECRET</x:xmpmeta>")),
+	)
+	out := strip(t, in)
+
+	chunks := webpChunks(t, out)
+	var names []string
+	for _, c := range chunks {
+		names = append(names, c.fourCC)
+	}
+	if len(chunks) != 3 || chunks[0].fourCC != "VP8X" || chunks[1].fourCC != "ICCP" || chunks[2].fourCC != "VP8L" {
+		t.Fatalf("chunks = %q, want VP8X ICCP VP8L", names)
+	}
+	if flags := chunks[0].data[0]; flags != flagICC {
+		t.Errorf("VP8X flags = %#x, want %#x", flags, flagICC)
+	}
+	if !bytes.Equal(chunks[0].data[1:], vp8x[1:]) {
+		t.Error("VP8X canvas fields changed")
+	}
+	if string(chunks[2].data) != "pixels" {
+		t.Errorf("VP8L data = %q", chunks[2].data)
+	}
+}
+
+func TestStripOther(t *testing.T) {
+	in := []byte("just some text")
+	var out bytes.Buffer
+	n, ok, err := Strip(&out, bytes.NewReader(in))
+	if err != nil || ok || n != int64(len(in)) || !bytes.Equal(out.Bytes(), in) {
+		t.Errorf("Strip = %d, %v, %v; output %q", n, ok, err, out.Bytes())
+	}
+}
+
+func TestOrientation(t *testing.T) {
+	tests := []struct {
+		name string
+		tiff []byte
+		want uint16
+	}{
+		{"little endian", exifTIFF(3), 3},
+		{"big endian", orientationTIFF(5), 5},
+		{"missing", exifTIFF(0), 0},
+		{"short", []byte("II\x2a\x00"), 0},
+		{"bad byte order", []byte("XX\x2a\x00\x08\x00\x00\x00"), 0},
+		{"IFD out of range", []byte("MM\x00\x2a\x00\x00\xff\xff"), 0},
+		{"truncated entries", []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x05"), 0},
+	}
+	for _, tt := range tests {
+		if got := orientation(tt.tiff); got != tt.want {
+			t.Errorf("%s: orientation = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
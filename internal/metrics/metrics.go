@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"sync/atomic"
+)
+
+var (
+	Uploads          atomic.Int64
+	UploadBytes      atomic.Int64
+	UploadErrors     atomic.Int64
+	Downloads        atomic.Int64
+	CleanupRuns      atomic.Int64
+	CleanupRemoved   atomic.Int64
+	CleanupLastRunNS atomic.Int64
+)
+
+// Gauges are values computed at scrape time.
+type Gauges struct {
+	Files       int
+	StoredBytes int64
+}
+
+// Write renders all metrics in the Prometheus text exposition format.
+func Write(w io.Writer, g Gauges) error {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	metrics := []struct {
+		name  string
+		kind  string
+		help  string
+		value float64
+	}{
+		{"kcst_uploads_total", "counter", "Files uploaded.", float64(Uploads.Load())},
+		{"kcst_upload_bytes_total", "counter", "Bytes uploaded.", float64(UploadBytes.Load())},
+		{"kcst_upload_errors_total", "counter", "Uploads that failed.", float64(UploadErrors.Load())},
+		{"kcst_downloads_total", "counter", "Files served.", float64(Downloads.Load())},
+		{"kcst_cleanup_runs_total", "counter", "Cleanup runs.", float64(CleanupRuns.Load())},
+		{"kcst_cleanup_removed_total", "counter", "Expired files removed by cleanup.", float64(CleanupRemoved.Load())},
+		{"kcst_cleanup_last_run_timestamp_seconds", "gauge", "Unix time of the last cleanup run.", float64(CleanupLastRunNS.Load()) / 1e9},
+		{"kcst_files", "gauge", "Files currently stored.", float64(g.Files)},
+		{"kcst_stored_bytes", "gauge", "Bytes currently stored.", float64(g.StoredBytes)},
+		{"go_goroutines", "gauge", "Number of goroutines.", float64(runtime.NumGoroutine())},
+		{"go_memstats_heap_alloc_bytes", "gauge", "Heap bytes allocated and in use.", float64(mem.HeapAlloc)},
+	}
+
+	for _, m := range metrics {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", m.name, m.help, m.name, m.kind, m.name, m.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
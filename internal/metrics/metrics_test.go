@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	before := Uploads.Load()
+	Uploads.Add(3)
+	defer Uploads.Store(before)
+
+	var b strings.Builder
+	if err := Write(&b, Gauges{Files: 2, StoredBytes: 1500}); err != nil {
+		t.Fatal(err)
+	}
+
+	values := make(map[string]string)
+	types := make(map[string]string)
+	sc := bufio.NewScanner(strings.NewReader(b.String()))
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		switch {
+		case len(fields) == 4 && fields[1] == "TYPE":
+			types[fields[2]] = fields[3]
+		case len(fields) == 2:
+			values[fields[0]] = fields[1]
+		case fields[0] != "#":
+			t.Errorf("malformed line %q", sc.Text())
+		}
+	}
+
+	tests := []struct {
+		name, kind, value string
+	}{
+		{"kcst_uploads_total", "counter", strconv.FormatInt(before+3, 10)},
+		{"kcst_files", "gauge", "2"},
+		{"kcst_stored_bytes", "gauge", "1500"},
+	}
+	for _, tt := range tests {
+		if types[tt.name] != tt.kind {
+			t.Errorf("%s type = %q, want %q", tt.name, types[tt.name], tt.kind)
+		}
+		if values[tt.name] != tt.value {
+			t.Errorf("%s = %q, want %q", tt.name, values[tt.name], tt.value)
+		}
+	}
+	if _, ok := values["go_goroutines"]; !ok {
+		t.Error("go_goroutines missing")
+	}
+}
@@ -1,11 +1,23 @@
 package models
 
-import "time"
+import (
+	"fmt"
+	"time"
+)
 
 type PageData struct {
-	Title   string
-	Message string
-	BaseURL string
+	Title             string
+	Message           string
+	BaseURL           string
+	MaxFileSize       string
+	RetentionDiagram  string
+	RetentionSummary  string
+	RetentionExamples []RetentionExample
+}
+
+type RetentionExample struct {
+	Size string
+	TTL  string
 }
 
 type FilePreviewData struct {
@@ -19,9 +31,19 @@ type FilePreviewData struct {
 	MediaType    string
 	RawURL       string
 	PreviewURL   string
+	ThumbnailURL string
 	BaseURL      string
 	UploadedAt   time.Time
 	ExpiresAt    time.Time
+	Entries      []ArchiveEntry
+	Truncated    bool
+}
+
+type ArchiveEntry struct {
+	Name      string
+	Size      int64
+	SizeHuman string
+	IsDir     bool
 }
 
 type UploadResponse struct {
@@ -34,8 +56,23 @@ type UploadResponse struct {
 	Size         int64     `json:"size"`
 	SizeHuman    string    `json:"size_human"`
 	ContentType  string    `json:"content_type"`
+	Stripped     bool      `json:"metadata_stripped"`
 	UploadedAt   time.Time `json:"uploaded_at"`
 	ExpiresAt    time.Time `json:"expires_at"`
 	RetentionMS  int64     `json:"retention_ms"`
+	ScanStatus   string    `json:"scan_status,omitempty"`
 	ResponseMS   int64     `json:"response_ms"`
 }
+
+func FormatSize(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,276 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Info is what the server knows about the original client request once
+// headers from trusted proxies have been applied.
+type Info struct {
+	ClientIP netip.Addr
+	Scheme   string
+	Host     string
+}
+
+type contextKey struct{}
+
+func FromContext(ctx context.Context) (Info, bool) {
+	info, ok := ctx.Value(contextKey{}).(Info)
+	return info, ok
+}
+
+// ClientIP returns the resolved client address of r, falling back to the
+// connection's peer address.
+func ClientIP(r *http.Request) string {
+	if info, ok := FromContext(r.Context()); ok && info.ClientIP.IsValid() {
+		return info.ClientIP.String()
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+type Resolver struct {
+	trusted      []netip.Prefix
+	trustUnix    bool
+	allowedHosts map[string]bool
+}
+
+// New parses trusted proxy addresses or CIDR ranges. Forwarding headers are
+// only honoured on connections from these peers; the special entry "unix"
+// trusts every connection over a Unix domain socket. If allowedHosts is not
+// empty, requests for any other host are refused.
+func New(trustedProxies, allowedHosts []string) (*Resolver, error) {
+	r := &Resolver{}
+	for _, s := range trustedProxies {
+		if s == "unix" {
+			r.trustUnix = true
+			continue
+		}
+		prefix, err := parsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", s, err)
+		}
+		r.trusted = append(r.trusted, prefix)
+	}
+	if len(allowedHosts) > 0 {
+		r.allowedHosts = make(map[string]bool)
+		for _, h := range allowedHosts {
+			r.allowedHosts[strings.ToLower(h)] = true
+		}
+	}
+	return r, nil
+}
+
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		return p.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func (r *Resolver) isTrusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range r.trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// HostAllowed reports whether host (with or without a port) may be used.
+func (r *Resolver) HostAllowed(host string) bool {
+	if r.allowedHosts == nil {
+		return true
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return r.allowedHosts[strings.ToLower(host)]
+}
+
+func (r *Resolver) Resolve(req *http.Request) Info {
+	info := Info{Scheme: "http", Host: req.Host}
+	if req.TLS != nil {
+		info.Scheme = "https"
+	}
+
+	// Unix socket peers have no address; Go reports them as "@" or "".
+	peer, err := netip.ParseAddrPort(req.RemoteAddr)
+	if err != nil {
+		if !r.trustUnix || (req.RemoteAddr != "@" && req.RemoteAddr != "") {
+			return info
+		}
+	} else {
+		info.ClientIP = peer.Addr().Unmap()
+		if !r.isTrusted(info.ClientIP) {
+			return info
+		}
+	}
+
+	if fwd := req.Header.Values("Forwarded"); len(fwd) > 0 {
+		r.applyForwarded(&info, fwd)
+	} else {
+		r.applyXForwarded(&info, req.Header)
+	}
+	return info
+}
+
+// applyForwarded walks the RFC 7239 elements from the nearest proxy
+// outwards and stops at the first hop that is not a trusted proxy. That
+// element describes the request as the outermost trusted proxy saw it.
+// An element without a usable "for", such as an obfuscated one, still
+// sets the scheme and host, but ends the walk since the next hop cannot
+// be judged.
+func (r *Resolver) applyForwarded(info *Info, headers []string) {
+	elements := parseForwarded(headers)
+	for i := len(elements) - 1; i >= 0; i-- {
+		e := elements[i]
+		if proto := strings.ToLower(e["proto"]); proto == "http" || proto == "https" {
+			info.Scheme = proto
+		}
+		if host := e["host"]; host != "" {
+			info.Host = host
+		}
+		addr, ok := parseNode(e["for"])
+		if !ok {
+			return
+		}
+		info.ClientIP = addr
+		if !r.isTrusted(addr) {
+			return
+		}
+	}
+}
+
+func (r *Resolver) applyXForwarded(info *Info, h http.Header) {
+	hops := splitList(h.Values("X-Forwarded-For"))
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parseNode(hops[i])
+		if !ok {
+			break
+		}
+		info.ClientIP = addr
+		if !r.isTrusted(addr) {
+			break
+		}
+	}
+
+	// The nearest proxy is the last one to append a value.
+	if protos := splitList(h.Values("X-Forwarded-Proto")); len(protos) > 0 {
+		if proto := strings.ToLower(protos[len(protos)-1]); proto == "http" || proto == "https" {
+			info.Scheme = proto
+		}
+	}
+	if hosts := splitList(h.Values("X-Forwarded-Host")); len(hosts) > 0 {
+		info.Host = hosts[len(hosts)-1]
+	}
+}
+
+func splitList(values []string) []string {
+	var items []string
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+	}
+	return items
+}
+
+func parseForwarded(headers []string) []map[string]string {
+	var elements []map[string]string
+	for _, h := range headers {
+		for _, element := range splitQuoted(h, ',') {
+			pairs := make(map[string]string)
+			for _, pair := range splitQuoted(element, ';') {
+				key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok {
+					continue
+				}
+				value = strings.TrimSpace(value)
+				if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+					value = unquote(value[1 : len(value)-1])
+				}
+				pairs[strings.ToLower(strings.TrimSpace(key))] = value
+			}
+			elements = append(elements, pairs)
+		}
+	}
+	return elements
+}
+
+// unquote resolves the quoted-pairs in the body of a quoted-string.
+func unquote(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
+
+// splitQuoted splits s on sep, ignoring separators inside quoted strings.
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted, start := false, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quoted:
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// parseNode parses an address from X-Forwarded-For or a Forwarded "for"
+// parameter, which may carry a port and brackets around IPv6 addresses.
+func parseNode(node string) (netip.Addr, bool) {
+	node = strings.TrimSpace(node)
+	if ap, err := netip.ParseAddrPort(node); err == nil {
+		return ap.Addr().Unmap(), true
+	}
+	node = strings.TrimSuffix(strings.TrimPrefix(node, "["), "]")
+	addr, err := netip.ParseAddr(node)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// Handler resolves each request, stores the Info in its context and
+// rejects hosts that are not allowed.
+func (r *Resolver) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		info := r.Resolve(req)
+		if !r.HostAllowed(info.Host) {
+			http.Error(w, "Misdirected request", http.StatusMisdirectedRequest)
+			return
+		}
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), contextKey{}, info)))
+	})
+}
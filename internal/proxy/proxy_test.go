@@ -0,0 +1,284 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseForwarded(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers []string
+		want    []map[string]string
+	}{
+		{
+			"single element",
+			[]string{"for=192.0.2.60;proto=https;by=203.0.113.43"},
+			[]map[string]string{{"for": "192.0.2.60", "proto": "https", "by": "203.0.113.43"}},
+		},
+		{
+			"case-insensitive keys and spaces",
+			[]string{" For = 192.0.2.60 ; PROTO=http "},
+			[]map[string]string{{"for": "192.0.2.60", "proto": "http"}},
+		},
+		{
+			"IPv6 in quotes and brackets",
+			[]string{`for="[2001:db8:cafe::17]:4711"`},
+			[]map[string]string{{"for": "[2001:db8:cafe::17]:4711"}},
+		},
+		{
+			"multiple elements in one header",
+			[]string{"for=192.0.2.43, for=198.51.100.17"},
+			[]map[string]string{{"for": "192.0.2.43"}, {"for": "198.51.100.17"}},
+		},
+		{
+			"multiple headers",
+			[]string{"for=192.0.2.43", "for=198.51.100.17;proto=https"},
+			[]map[string]string{{"for": "192.0.2.43"}, {"for": "198.51.100.17", "proto": "https"}},
+		},
+		{
+			"separators inside quotes",
+			[]string{`for=192.0.2.1;host="a.example;b,c", for=192.0.2.2`},
+			[]map[string]string{{"for": "192.0.2.1", "host": "a.example;b,c"}, {"for": "192.0.2.2"}},
+		},
+		{
+			"quoted-pairs",
+			[]string{`host="a\"b\\c\d"`},
+			[]map[string]string{{"host": `a"b\cd`}},
+		},
+		{
+			"pair without value",
+			[]string{"for=192.0.2.1;junk"},
+			[]map[string]string{{"for": "192.0.2.1"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseForwarded(tt.headers); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseNode(t *testing.T) {
+	tests := []struct {
+		node string
+		want string
+	}{
+		{"192.0.2.1", "192.0.2.1"},
+		{"192.0.2.1:8080", "192.0.2.1"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"[2001:db8::1]", "2001:db8::1"},
+		{"[2001:db8::1]:4711", "2001:db8::1"},
+		{"::ffff:192.0.2.1", "192.0.2.1"},
+		{" 192.0.2.1 ", "192.0.2.1"},
+		{"unknown", ""},
+		{"_hidden", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		addr, ok := parseNode(tt.node)
+		got := ""
+		if ok {
+			got = addr.String()
+		}
+		if got != tt.want {
+			t.Errorf("parseNode(%q) = %q, want %q", tt.node, got, tt.want)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	r, err := New([]string{"10.0.0.0/8", "2001:db8:ffff::1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		remote  string
+		headers map[string][]string
+		want    Info
+		ip      string
+	}{
+		{
+			name:   "direct client",
+			ip:     "192.0.2.1",
+			remote: "192.0.2.1:1234",
+			want:   Info{Scheme: "http", Host: "kcst.example"},
+		},
+		{
+			name:    "untrusted peer is ignored",
+			ip:      "192.0.2.1",
+			remote:  "192.0.2.1:1234",
+			headers: map[string][]string{"Forwarded": {"for=198.51.100.1;proto=https;host=evil.example"}},
+			want:    Info{Scheme: "http", Host: "kcst.example"},
+		},
+		{
+			name:    "trusted proxy",
+			ip:      "198.51.100.1",
+			remote:  "10.0.0.1:1234",
+			headers: map[string][]string{"Forwarded": {"for=198.51.100.1;proto=https;host=files.example"}},
+			want:    Info{Scheme: "https", Host: "files.example"},
+		},
+		{
+			name:    "proto and host without for",
+			ip:      "10.0.0.1",
+			remote:  "10.0.0.1:1234",
+			headers: map[string][]string{"Forwarded": {"proto=https;host=files.example"}},
+			want:    Info{Scheme: "https", Host: "files.example"},
+		},
+		{
+			name:    "obfuscated for",
+			ip:      "10.0.0.1",
+			remote:  "10.0.0.1:1234",
+			headers: map[string][]string{"Forwarded": {"for=_hidden;proto=https"}},
+			want:    Info{Scheme: "https", Host: "kcst.example"},
+		},
+		{
+			name:   "chain of trusted proxies",
+			ip:     "198.51.100.1",
+			remote: "10.0.0.1:1234",
+			headers: map[string][]string{"Forwarded": {
+				"for=198.51.100.1;proto=https;host=files.example, for=10.0.0.2;proto=http;host=internal",
+			}},
+			want: Info{Scheme: "https", Host: "files.example"},
+		},
+		{
+			name:   "stops at the first untrusted hop",
+			ip:     "198.51.100.1",
+			remote: "10.0.0.1:1234",
+			headers: map[string][]string{"Forwarded": {
+				"for=203.0.113.9;host=spoofed.example, for=198.51.100.1;host=files.example",
+			}},
+			want: Info{Scheme: "http", Host: "files.example"},
+		},
+		{
+			name:   "element without for ends the walk",
+			ip:     "10.0.0.1",
+			remote: "10.0.0.1:1234",
+			headers: map[string][]string{"Forwarded": {
+				"for=203.0.113.9;host=outer.example, proto=https;host=files.example",
+			}},
+			want: Info{Scheme: "https", Host: "files.example"},
+		},
+		{
+			name:    "trusted IPv6 proxy",
+			ip:      "2001:db8::7",
+			remote:  "[2001:db8:ffff::1]:443",
+			headers: map[string][]string{"Forwarded": {`for="[2001:db8::7]:4711";proto=https`}},
+			want:    Info{Scheme: "https", Host: "kcst.example"},
+		},
+		{
+			name:   "X-Forwarded headers",
+			ip:     "198.51.100.1",
+			remote: "10.0.0.1:1234",
+			headers: map[string][]string{
+				"X-Forwarded-For":   {"203.0.113.9, 198.51.100.1"},
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Host":  {"files.example"},
+			},
+			want: Info{Scheme: "https", Host: "files.example"},
+		},
+		{
+			name:   "Forwarded wins over X-Forwarded",
+			ip:     "198.51.100.1",
+			remote: "10.0.0.1:1234",
+			headers: map[string][]string{
+				"Forwarded":       {"for=198.51.100.1"},
+				"X-Forwarded-For": {"203.0.113.9"},
+			},
+			want: Info{Scheme: "http", Host: "kcst.example"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://kcst.example/", nil)
+			req.RemoteAddr = tt.remote
+			for k, v := range tt.headers {
+				req.Header[k] = v
+			}
+			got := r.Resolve(req)
+			if got.Scheme != tt.want.Scheme || got.Host != tt.want.Host {
+				t.Errorf("scheme %q host %q, want %q %q", got.Scheme, got.Host, tt.want.Scheme, tt.want.Host)
+			}
+			if ip := got.ClientIP.String(); ip != tt.ip {
+				t.Errorf("client IP %s, want %s", ip, tt.ip)
+			}
+		})
+	}
+}
+
+func TestResolveTLS(t *testing.T) {
+	r, _ := New(nil, nil)
+	req := httptest.NewRequest(http.MethodGet, "https://kcst.example/", nil)
+	req.TLS = &tls.ConnectionState{}
+	if got := r.Resolve(req); got.Scheme != "https" {
+		t.Errorf("scheme = %q, want https", got.Scheme)
+	}
+}
+
+func TestResolveUnix(t *testing.T) {
+	headers := map[string][]string{"Forwarded": {"for=198.51.100.1;proto=https"}}
+	for _, trusted := range []bool{false, true} {
+		var proxies []string
+		if trusted {
+			proxies = []string{"unix"}
+		}
+		r, _ := New(proxies, nil)
+		req := httptest.NewRequest(http.MethodGet, "http://kcst.example/", nil)
+		req.RemoteAddr = "@"
+		for k, v := range headers {
+			req.Header[k] = v
+		}
+		got := r.Resolve(req)
+		if trusted != (got.Scheme == "https") {
+			t.Errorf("trust unix %v: scheme %q", trusted, got.Scheme)
+		}
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	if _, err := New([]string{"not-an-ip"}, nil); err == nil {
+		t.Error("expected an error for an invalid trusted proxy")
+	}
+}
+
+func TestHandlerAllowedHosts(t *testing.T) {
+	r, _ := New([]string{"10.0.0.1"}, []string{"Files.Example"})
+	var seen Info
+	h := r.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		seen, _ = FromContext(req.Context())
+	}))
+
+	tests := []struct {
+		host      string
+		forwarded string
+		code      int
+	}{
+		{"files.example", "", http.StatusOK},
+		{"files.example:8080", "", http.StatusOK},
+		{"other.example", "", http.StatusMisdirectedRequest},
+		{"internal", "host=files.example", http.StatusOK},
+		{"files.example", "host=other.example", http.StatusMisdirectedRequest},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://"+tt.host+"/", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		if tt.forwarded != "" {
+			req.Header.Set("Forwarded", tt.forwarded)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.code {
+			t.Errorf("host %q forwarded %q: status %d, want %d", tt.host, tt.forwarded, rec.Code, tt.code)
+		}
+	}
+	if seen.ClientIP.String() != "10.0.0.1" {
+		t.Errorf("client IP in context = %s", seen.ClientIP)
+	}
+}
@@ -0,0 +1,194 @@
+// Package retention renders the active retention policy for people: the
+// formula and chart on the home page and in the README, and the table of
+// example TTLs.
+package retention
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/keircn/kcst/internal/models"
+	"github.com/keircn/kcst/internal/storage"
+)
+
+const (
+	chartWidth  = 50
+	chartHeight = 9
+	labelWidth  = 7
+)
+
+// Diagram returns the policy's description followed by a chart of TTL
+// against file size from 0 to maxSize.
+func Diagram(p storage.RetentionPolicy, maxSize int64) string {
+	var sb strings.Builder
+	for _, line := range p.Describe() {
+		sb.WriteString(line)
+		sb.WriteByte('\n')
+	}
+	sb.WriteByte('\n')
+	sb.WriteString(Chart(p, maxSize))
+	return sb.String()
+}
+
+// Chart plots TTL against file size as ASCII art.
+func Chart(p storage.RetentionPolicy, maxSize int64) string {
+	ttls := make([]time.Duration, chartWidth)
+	lo, hi := time.Duration(math.MaxInt64), time.Duration(0)
+	for col := range ttls {
+		size := maxSize * int64(col) / (chartWidth - 1)
+		ttls[col] = p.TTL(size, "")
+		lo = min(lo, ttls[col])
+		hi = max(hi, ttls[col])
+	}
+
+	grid := make([][]byte, chartHeight)
+	for row := range grid {
+		grid[row] = []byte(strings.Repeat(" ", chartWidth))
+	}
+	for col, ttl := range ttls {
+		row := chartHeight - 1
+		if hi > lo {
+			row = int(math.Round(float64(ttl-lo) / float64(hi-lo) * (chartHeight - 1)))
+		}
+		grid[chartHeight-1-row][col] = '.'
+	}
+
+	unit, unitName := durationUnit(hi)
+	xUnit, xUnitName := sizeUnit(maxSize)
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%*s\n", labelWidth, unitName)
+	for i, row := range grid {
+		label := ""
+		switch i {
+		case 0:
+			label = formatFloat(float64(hi) / float64(unit))
+		case chartHeight - 1:
+			label = formatFloat(float64(lo) / float64(unit))
+		}
+		fmt.Fprintf(&sb, "%*s |%s\n", labelWidth, label, strings.TrimRight(string(row), " "))
+	}
+	fmt.Fprintf(&sb, "%*s+%s>\n", labelWidth+1, "", strings.Repeat("-", chartWidth))
+
+	mid := formatFloat(float64(maxSize) / 2 / float64(xUnit))
+	end := formatFloat(float64(maxSize) / float64(xUnit))
+	axis := []byte(strings.Repeat(" ", labelWidth+2+chartWidth))
+	copy(axis[labelWidth+1:], "0")
+	copy(axis[labelWidth+1+chartWidth/2-len(mid)/2:], mid)
+	copy(axis[labelWidth+1+chartWidth-len(end):], end)
+	sb.WriteString(strings.TrimRight(string(axis), " "))
+	fmt.Fprintf(&sb, "\n%*s\n", labelWidth+1+chartWidth, xUnitName)
+	return sb.String()
+}
+
+// Examples returns the TTL of a few representative sizes up to maxSize,
+// largest first.
+func Examples(p storage.RetentionPolicy, maxSize int64) []models.RetentionExample {
+	sizes := []int64{maxSize, maxSize / 2, maxSize / 4, maxSize / 10, maxSize / 100}
+	examples := make([]models.RetentionExample, 0, len(sizes)+1)
+	last := int64(-1)
+	for _, size := range sizes {
+		if size < 1024 || size == last {
+			continue
+		}
+		last = size
+		examples = append(examples, models.RetentionExample{
+			Size: SizeLabel(size),
+			TTL:  "~" + Humanize(p.TTL(size, "")),
+		})
+	}
+	return append(examples, models.RetentionExample{
+		Size: "<1 KiB",
+		TTL:  "~" + Humanize(p.TTL(512, "")),
+	})
+}
+
+// Summary is a one-sentence explanation of the policy.
+func Summary(p storage.RetentionPolicy, maxSize int64) string {
+	largest := p.TTL(maxSize, "")
+	tiny := p.TTL(1, "")
+	size := SizeLabel(maxSize)
+	if tiny > largest {
+		return fmt.Sprintf("Smaller files are retained longer. A %s file lives ~%s, while tiny files can stay up to %s.",
+			size, Humanize(largest), Humanize(tiny))
+	}
+	return fmt.Sprintf("Files up to %s are kept for ~%s.", size, Humanize(largest))
+}
+
+// Markdown renders the retention sections of the README.
+func Markdown(p storage.RetentionPolicy, maxSize int64) string {
+	var sb strings.Builder
+	sb.WriteString("## Retention Policy\n\n```\n")
+	sb.WriteString(Diagram(p, maxSize))
+	sb.WriteString("```\n\n")
+	sb.WriteString(Summary(p, maxSize))
+	sb.WriteString("\n\n## Example TTLs\n\n| File Size | Retention |\n|-----------|-----------|\n")
+	for _, e := range Examples(p, maxSize) {
+		fmt.Fprintf(&sb, "| %-9s | %-9s |\n", e.Size, e.TTL)
+	}
+	return sb.String()
+}
+
+// SizeLabel formats n like models.FormatSize, without a trailing ".0".
+func SizeLabel(n int64) string {
+	return strings.Replace(models.FormatSize(n), ".0 ", " ", 1)
+}
+
+// Humanize rounds d to the largest unit that keeps it at two or more.
+func Humanize(d time.Duration) string {
+	unit, name := durationUnit(d)
+	// Whole values read better in the larger unit: "1 day", not "24 hours".
+	for _, u := range []struct {
+		size time.Duration
+		name string
+	}{
+		{24 * time.Hour, "days"},
+		{time.Hour, "hours"},
+		{time.Minute, "minutes"},
+	} {
+		if u.size > unit && d >= u.size && d%u.size == 0 {
+			unit, name = u.size, u.name
+			break
+		}
+	}
+	n := int64(math.Round(float64(d) / float64(unit)))
+	if n == 1 {
+		return "1 " + strings.TrimSuffix(name, "s")
+	}
+	return fmt.Sprintf("%d %s", n, name)
+}
+
+func durationUnit(d time.Duration) (time.Duration, string) {
+	const day = 24 * time.Hour
+	switch {
+	case d >= 2*day:
+		return day, "days"
+	case d >= 2*time.Hour:
+		return time.Hour, "hours"
+	case d >= 2*time.Minute:
+		return time.Minute, "minutes"
+	}
+	return time.Second, "seconds"
+}
+
+func sizeUnit(n int64) (int64, string) {
+	switch {
+	case n >= 1<<30:
+		return 1 << 30, "GiB"
+	case n >= 1<<20:
+		return 1 << 20, "MiB"
+	case n >= 1<<10:
+		return 1 << 10, "KiB"
+	}
+	return 1, "B"
+}
+
+func formatFloat(f float64) string {
+	if f > 0 && f < 1 {
+		return strconv.FormatFloat(f, 'g', 2, 64)
+	}
+	return strconv.FormatFloat(math.Round(f*10)/10, 'f', -1, 64)
+}
@@ -0,0 +1,112 @@
+package retention
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/keircn/kcst/internal/storage"
+)
+
+var policy = storage.SqrtPolicy{
+	MinTTL:      3 * time.Hour,
+	MaxTTL:      28 * 24 * time.Hour,
+	MaxFileSize: 100 << 20,
+}
+
+func TestHumanize(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{30 * time.Second, "30 seconds"},
+		{time.Minute, "1 minute"},
+		{90 * time.Minute, "90 minutes"},
+		{24 * time.Hour, "1 day"},
+		{36 * time.Hour, "36 hours"},
+		{3 * time.Hour, "3 hours"},
+		{28 * 24 * time.Hour, "28 days"},
+		{50*time.Hour + 40*time.Minute, "2 days"},
+	}
+	for _, tt := range tests {
+		if got := Humanize(tt.d); got != tt.want {
+			t.Errorf("Humanize(%s) = %q, want %q", tt.d, got, tt.want)
+		}
+	}
+}
+
+func TestSizeLabel(t *testing.T) {
+	tests := map[int64]string{
+		512:       "512 B",
+		1 << 10:   "1 KiB",
+		1536:      "1.5 KiB",
+		100 << 20: "100 MiB",
+	}
+	for n, want := range tests {
+		if got := SizeLabel(n); got != want {
+			t.Errorf("SizeLabel(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
+
+func TestChart(t *testing.T) {
+	lines := strings.Split(strings.TrimSuffix(Chart(policy, policy.MaxFileSize), "\n"), "\n")
+	if len(lines) != chartHeight+4 {
+		t.Fatalf("chart has %d lines:\n%s", len(lines), strings.Join(lines, "\n"))
+	}
+	if strings.TrimSpace(lines[0]) != "days" {
+		t.Errorf("unit line = %q", lines[0])
+	}
+	top, bottom := lines[1], lines[chartHeight]
+	if !strings.HasPrefix(top, "     28 |.") {
+		t.Errorf("top row = %q, want the max TTL at size 0", top)
+	}
+	if !strings.HasSuffix(bottom, ".") || len(bottom) != labelWidth+2+chartWidth {
+		t.Errorf("bottom row = %q, want the min TTL at max size", bottom)
+	}
+	if !strings.HasSuffix(lines[len(lines)-1], "MiB") || !strings.HasSuffix(lines[len(lines)-2], "100") {
+		t.Errorf("axis = %q %q", lines[len(lines)-2], lines[len(lines)-1])
+	}
+}
+
+func TestChartFlat(t *testing.T) {
+	flat := storage.StepPolicy{Steps: []storage.RetentionStep{{MaxSize: 1 << 30, TTL: 24 * time.Hour}}}
+	lines := strings.Split(Chart(flat, 1<<20), "\n")
+	if got := strings.Count(lines[1], "."); got != chartWidth {
+		t.Errorf("top row has %d points, want %d:\n%s", got, chartWidth, strings.Join(lines, "\n"))
+	}
+}
+
+func TestExamples(t *testing.T) {
+	examples := Examples(policy, policy.MaxFileSize)
+	want := []string{"100 MiB", "50 MiB", "25 MiB", "10 MiB", "1 MiB", "<1 KiB"}
+	if len(examples) != len(want) {
+		t.Fatalf("examples = %v", examples)
+	}
+	for i, e := range examples {
+		if e.Size != want[i] {
+			t.Errorf("example %d size = %q, want %q", i, e.Size, want[i])
+		}
+	}
+	if examples[0].TTL != "~3 hours" || examples[len(examples)-1].TTL != "~28 days" {
+		t.Errorf("examples = %v", examples)
+	}
+
+	// Sizes below 1 KiB are left out.
+	if got := Examples(policy, 2048); len(got) != 3 {
+		t.Errorf("examples for 2 KiB = %v", got)
+	}
+}
+
+func TestSummary(t *testing.T) {
+	got := Summary(policy, policy.MaxFileSize)
+	want := "Smaller files are retained longer. A 100 MiB file lives ~3 hours, while tiny files can stay up to 28 days."
+	if got != want {
+		t.Errorf("Summary = %q", got)
+	}
+
+	flat := storage.StepPolicy{Steps: []storage.RetentionStep{{MaxSize: 1 << 30, TTL: 24 * time.Hour}}}
+	if got := Summary(flat, 1<<20); got != "Files up to 1 MiB are kept for ~1 day." {
+		t.Errorf("Summary = %q", got)
+	}
+}
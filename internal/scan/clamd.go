@@ -0,0 +1,109 @@
+package scan
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// clamdChunkSize stays well below clamd's default StreamMaxLength so a
+// single chunk is never rejected on its own.
+const clamdChunkSize = 64 << 10
+
+// Clamd streams files to a ClamAV daemon with the INSTREAM command.
+type Clamd struct {
+	network string
+	address string
+}
+
+// NewClamd connects to clamd at addr: "unix:/run/clamav/clamd.ctl" for a
+// Unix socket or "host:port" for TCP.
+func NewClamd(addr string) *Clamd {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		return &Clamd{network: "unix", address: path}
+	}
+	return &Clamd{network: "tcp", address: addr}
+}
+
+func (c *Clamd) Scan(ctx context.Context, path string) (Result, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Result{}, err
+	}
+	defer f.Close()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, c.network, c.address)
+	if err != nil {
+		return Result{}, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// Cancellation interrupts a scan in progress, not only the dial.
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	if _, err := io.WriteString(conn, "zINSTREAM\x00"); err != nil {
+		return Result{}, err
+	}
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, err := f.Read(buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, err := conn.Write(buf[:4+n]); err != nil {
+				// clamd answers and hangs up once a stream is too long.
+				if res, rerr := readReply(conn); errors.Is(rerr, ErrTooLarge) {
+					return res, rerr
+				}
+				return Result{}, err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return Result{}, err
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		if res, rerr := readReply(conn); errors.Is(rerr, ErrTooLarge) {
+			return res, rerr
+		}
+		return Result{}, err
+	}
+	return readReply(conn)
+}
+
+func readReply(conn net.Conn) (Result, error) {
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && !(errors.Is(err, io.EOF) && reply != "") {
+		return Result{}, err
+	}
+	return parseClamdReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+// parseClamdReply interprets answers such as "stream: OK",
+// "stream: Eicar-Test-Signature FOUND" and
+// "INSTREAM size limit exceeded. ERROR".
+func parseClamdReply(reply string) (Result, error) {
+	_, status, _ := strings.Cut(reply, ": ")
+	switch {
+	case status == "OK":
+		return Result{}, nil
+	case strings.HasSuffix(status, " FOUND"):
+		return Result{Infected: true, Signature: strings.TrimSuffix(status, " FOUND")}, nil
+	case strings.Contains(reply, "size limit exceeded"):
+		return Result{}, fmt.Errorf("clamd: %s: %w", reply, ErrTooLarge)
+	}
+	return Result{}, fmt.Errorf("clamd: %s", reply)
+}
@@ -0,0 +1,51 @@
+package scan
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Command runs an external scanner with the file's path appended to its
+// arguments. Like clamscan, it must exit with 0 for a clean file and 1 for
+// an infected one; the first line it prints is taken as the signature.
+// Any other exit status is an error.
+type Command struct {
+	args []string
+}
+
+func NewCommand(args []string) *Command {
+	return &Command{args: args}
+}
+
+func (c *Command) Scan(ctx context.Context, path string) (Result, error) {
+	cmd := exec.CommandContext(ctx, c.args[0], append(c.args[1:], path)...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return Result{}, nil
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == 1:
+		return Result{Infected: true, Signature: signature(stdout.String(), path)}, nil
+	}
+
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		return Result{}, fmt.Errorf("%s: %w: %s", c.args[0], err, msg)
+	}
+	return Result{}, fmt.Errorf("%s: %w", c.args[0], err)
+}
+
+// signature extracts a name from output such as
+// "/srv/uploads/a.bin: Eicar-Test-Signature FOUND".
+func signature(output, path string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(output), "\n")
+	line = strings.TrimPrefix(line, path+": ")
+	return strings.TrimSuffix(strings.TrimSpace(line), " FOUND")
+}
@@ -0,0 +1,24 @@
+// Package scan checks uploaded files for malware, either with a ClamAV
+// daemon or with an external command.
+package scan
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrTooLarge is returned when the scanner refuses a file for its size,
+// as clamd does past its StreamMaxLength.
+var ErrTooLarge = errors.New("file exceeds the scanner's size limit")
+
+type Result struct {
+	Infected bool
+	// Signature names what was found in an infected file.
+	Signature string
+}
+
+// Scanner checks the file at path. An error means the file could not be
+// scanned, not that it is infected.
+type Scanner interface {
+	Scan(ctx context.Context, path string) (Result, error)
+}
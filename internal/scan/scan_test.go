@@ -0,0 +1,227 @@
+package scan
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClamd answers INSTREAM requests on a Unix socket. reply maps the
+// streamed content to the answer; a nil reply never answers.
+func fakeClamd(t *testing.T, reply func(data []byte) string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "clamd.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				cmd, err := r.ReadString(0)
+				if err != nil || cmd != "zINSTREAM\x00" {
+					return
+				}
+				var data []byte
+				for {
+					var size uint32
+					if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					chunk := make([]byte, size)
+					if _, err := io.ReadFull(r, chunk); err != nil {
+						return
+					}
+					data = append(data, chunk...)
+				}
+				if reply == nil {
+					io.Copy(io.Discard, r)
+					return
+				}
+				io.WriteString(conn, reply(data)+"\x00")
+			}()
+		}
+	}()
+	return "unix:" + path
+}
+
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "upload.bin")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestClamd(t *testing.T) {
+	addr := fakeClamd(t, func(data []byte) string {
+		if strings.Contains(string(data), "EICAR") {
+			return "stream: Eicar-Test-Signature FOUND"
+		}
+		return "stream: OK"
+	})
+	c := NewClamd(addr)
+
+	res, err := c.Scan(context.Background(), writeFile(t, "harmless"))
+	if err != nil || res.Infected {
+		t.Errorf("clean file: %+v, %v", res, err)
+	}
+
+	// Larger than one chunk, with the marker in the second.
+	big := strings.Repeat("x", clamdChunkSize+10) + "EICAR"
+	res, err = c.Scan(context.Background(), writeFile(t, big))
+	if err != nil || !res.Infected || res.Signature != "Eicar-Test-Signature" {
+		t.Errorf("infected file: %+v, %v", res, err)
+	}
+}
+
+func TestClamdError(t *testing.T) {
+	c := NewClamd(fakeClamd(t, func([]byte) string { return "stream: lstat() failed ERROR" }))
+	if _, err := c.Scan(context.Background(), writeFile(t, "x")); err == nil || errors.Is(err, ErrTooLarge) {
+		t.Errorf("err = %v, want a scan error", err)
+	}
+
+	c = NewClamd("unix:" + filepath.Join(t.TempDir(), "missing.sock"))
+	if _, err := c.Scan(context.Background(), writeFile(t, "x")); err == nil {
+		t.Error("expected an error without a daemon")
+	}
+}
+
+func TestClamdTooLarge(t *testing.T) {
+	// Like clamd past StreamMaxLength: answer and hang up while the client
+	// is still sending.
+	path := filepath.Join(t.TempDir(), "clamd.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			io.CopyN(io.Discard, conn, 1<<10)
+			io.WriteString(conn, "INSTREAM size limit exceeded. ERROR\x00")
+			conn.Close()
+		}
+	}()
+
+	c := NewClamd("unix:" + path)
+	_, err = c.Scan(context.Background(), writeFile(t, strings.Repeat("x", 8<<20)))
+	if !errors.Is(err, ErrTooLarge) {
+		t.Errorf("err = %v, want ErrTooLarge", err)
+	}
+}
+
+func TestClamdCancel(t *testing.T) {
+	c := NewClamd(fakeClamd(t, nil))
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	if _, err := c.Scan(ctx, writeFile(t, "x")); err == nil {
+		t.Fatal("expected an error after cancellation")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("scan was not interrupted")
+	}
+}
+
+func TestNewClamd(t *testing.T) {
+	if c := NewClamd("unix:/run/clamav/clamd.ctl"); c.network != "unix" || c.address != "/run/clamav/clamd.ctl" {
+		t.Errorf("unix address: %+v", c)
+	}
+	if c := NewClamd("127.0.0.1:3310"); c.network != "tcp" || c.address != "127.0.0.1:3310" {
+		t.Errorf("tcp address: %+v", c)
+	}
+}
+
+func TestParseClamdReply(t *testing.T) {
+	tests := []struct {
+		reply string
+		want  Result
+		err   bool
+	}{
+		{"stream: OK", Result{}, false},
+		{"stream: Win.Test.EICAR_HDB-1 FOUND", Result{Infected: true, Signature: "Win.Test.EICAR_HDB-1"}, false},
+		{"stream: lstat() failed ERROR", Result{}, true},
+		{"INSTREAM size limit exceeded. ERROR", Result{}, true},
+		{"", Result{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseClamdReply(tt.reply)
+		if got != tt.want || (err != nil) != tt.err {
+			t.Errorf("parseClamdReply(%q) = %+v, %v", tt.reply, got, err)
+		}
+	}
+}
+
+func script(t *testing.T, body string) []string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a POSIX shell")
+	}
+	return []string{"/bin/sh", "-c", body, "scanner"}
+}
+
+func TestCommand(t *testing.T) {
+	c := NewCommand(script(t, `grep -q EICAR "$1" && { echo "$1: Eicar-Test-Signature FOUND"; exit 1; }; exit 0`))
+
+	res, err := c.Scan(context.Background(), writeFile(t, "harmless"))
+	if err != nil || res.Infected {
+		t.Errorf("clean file: %+v, %v", res, err)
+	}
+	res, err = c.Scan(context.Background(), writeFile(t, "EICAR"))
+	if err != nil || !res.Infected || res.Signature != "Eicar-Test-Signature" {
+		t.Errorf("infected file: %+v, %v", res, err)
+	}
+}
+
+func TestCommandError(t *testing.T) {
+	c := NewCommand(script(t, `echo "database missing" >&2; exit 2`))
+	_, err := c.Scan(context.Background(), writeFile(t, "x"))
+	if err == nil || !strings.Contains(err.Error(), "database missing") {
+		t.Errorf("err = %v", err)
+	}
+	var exitErr interface{ ExitCode() int }
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 2 {
+		t.Errorf("err = %v, want the exit status", err)
+	}
+}
+
+func TestCommandTimeout(t *testing.T) {
+	c := NewCommand(script(t, `exec sleep 10`))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := c.Scan(ctx, writeFile(t, "x")); err == nil {
+		t.Fatal("expected an error at the deadline")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("scanner was not killed at the deadline")
+	}
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// socketOptions control the permissions of Unix domain sockets.
+type socketOptions struct {
+	mode  os.FileMode
+	owner string
+	group string
+}
+
+// listen opens a listener for addr, which is one of:
+//
+//	host:port          TCP
+//	unix:/path/to.sock Unix domain socket
+//	systemd            the next socket passed by systemd socket activation
+//	systemd:name       the activated socket with FileDescriptorName=name
+func listen(addr string, opts socketOptions) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(addr, "unix:"):
+		return listenUnix(strings.TrimPrefix(addr, "unix:"), opts)
+	case addr == "systemd":
+		return activatedListener("")
+	case strings.HasPrefix(addr, "systemd:"):
+		return activatedListener(strings.TrimPrefix(addr, "systemd:"))
+	}
+	return net.Listen("tcp", addr)
+}
+
+// isLocal reports whether a listener only accepts connections from this
+// host: a Unix socket or a TCP address on a loopback interface.
+func isLocal(addr net.Addr) bool {
+	switch a := addr.(type) {
+	case *net.UnixAddr:
+		return true
+	case *net.TCPAddr:
+		return a.IP.IsLoopback()
+	}
+	return false
+}
+
+func listenUnix(path string, opts socketOptions) (net.Listener, error) {
+	// A socket left behind by an unclean exit would make Listen fail.
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := applySocketOptions(path, opts); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func applySocketOptions(path string, opts socketOptions) error {
+	if opts.mode != 0 {
+		if err := os.Chmod(path, opts.mode); err != nil {
+			return err
+		}
+	}
+	if opts.owner == "" && opts.group == "" {
+		return nil
+	}
+
+	uid, gid := -1, -1
+	if opts.owner != "" {
+		u, err := user.Lookup(opts.owner)
+		if err != nil {
+			return err
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return err
+		}
+	}
+	if opts.group != "" {
+		g, err := user.LookupGroup(opts.group)
+		if err != nil {
+			return err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return err
+		}
+	}
+	return os.Chown(path, uid, gid)
+}
+
+// listenFDsStart is the first file descriptor passed by systemd.
+const listenFDsStart = 3
+
+var (
+	activationOnce sync.Once
+	activationMu   sync.Mutex
+	activated      []activatedSocket
+	activationErr  error
+)
+
+type activatedSocket struct {
+	name     string
+	listener net.Listener
+}
+
+// activatedListener hands out the sockets passed via LISTEN_FDS. Each one
+// can be claimed once; an empty name claims the next unclaimed socket.
+func activatedListener(name string) (net.Listener, error) {
+	activationOnce.Do(func() {
+		activated, activationErr = loadActivatedSockets(listenFDsStart)
+	})
+	if activationErr != nil {
+		return nil, activationErr
+	}
+
+	activationMu.Lock()
+	defer activationMu.Unlock()
+
+	for i, s := range activated {
+		if s.listener == nil || (name != "" && s.name != name) {
+			continue
+		}
+		activated[i].listener = nil
+		return s.listener, nil
+	}
+	if name != "" {
+		return nil, fmt.Errorf("systemd: no activated socket named %q", name)
+	}
+	return nil, errors.New("systemd: no activated sockets left")
+}
+
+// loadActivatedSockets takes over the sockets described by LISTEN_FDS,
+// numbered from first.
+func loadActivatedSockets(first int) ([]activatedSocket, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, errors.New("systemd: not started with socket activation")
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, errors.New("systemd: LISTEN_FDS not set")
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	// Keep the variables from leaking into child processes.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	sockets := make([]activatedSocket, 0, n)
+	for i := range n {
+		fd := first + i
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("systemd: fd %d: %w", fd, err)
+		}
+		sockets = append(sockets, activatedSocket{name: name, listener: l})
+	}
+	return sockets, nil
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestListenUnixOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing a socket's owner needs root")
+	}
+	u, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("no nobody user")
+	}
+	g, err := user.LookupGroupId(u.Gid)
+	if err != nil {
+		t.Skip(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "kcst.sock")
+	l, err := listenUnix(path, socketOptions{mode: 0o600, owner: u.Username, group: g.Name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := info.Sys().(*syscall.Stat_t)
+	if strconv.Itoa(int(st.Uid)) != u.Uid || strconv.Itoa(int(st.Gid)) != u.Gid {
+		t.Errorf("owner = %d:%d, want %s:%s", st.Uid, st.Gid, u.Uid, u.Gid)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Errorf("mode = %o, want 600", perm)
+	}
+}
+
+// passFDs duplicates the listeners' descriptors to consecutive numbers
+// from first, as systemd would pass them.
+func passFDs(t *testing.T, first int, listeners ...net.Listener) {
+	t.Helper()
+	for i, l := range listeners {
+		f, err := l.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := syscall.Dup3(int(f.Fd()), first+i, syscall.O_CLOEXEC); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+}
+
+func setActivationEnv(t *testing.T, pid, fds, names string) {
+	t.Helper()
+	t.Setenv("LISTEN_PID", pid)
+	t.Setenv("LISTEN_FDS", fds)
+	t.Setenv("LISTEN_FDNAMES", names)
+}
+
+func TestLoadActivatedSockets(t *testing.T) {
+	const first = 200
+	var listeners []net.Listener
+	for range 3 {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		listeners = append(listeners, l)
+	}
+	passFDs(t, first, listeners...)
+
+	// Only two names for three sockets: the last one is unnamed.
+	setActivationEnv(t, strconv.Itoa(os.Getpid()), "3", "web:admin")
+	sockets, err := loadActivatedSockets(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, s := range sockets {
+			s.listener.Close()
+		}
+	}()
+
+	wantNames := []string{"web", "admin", ""}
+	if len(sockets) != len(wantNames) {
+		t.Fatalf("got %d sockets, want %d", len(sockets), len(wantNames))
+	}
+	for i, s := range sockets {
+		if s.name != wantNames[i] {
+			t.Errorf("socket %d: name = %q, want %q", i, s.name, wantNames[i])
+		}
+		if got, want := s.listener.Addr().String(), listeners[i].Addr().String(); got != want {
+			t.Errorf("socket %d: address = %s, want %s", i, got, want)
+		}
+	}
+	for _, name := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		if _, ok := os.LookupEnv(name); ok {
+			t.Errorf("%s is still set", name)
+		}
+	}
+}
+
+func TestLoadActivatedSocketsErrors(t *testing.T) {
+	const first = 210
+	pid := strconv.Itoa(os.Getpid())
+
+	tests := []struct {
+		name      string
+		pid, fds  string
+		wantError string
+	}{
+		{"other process", strconv.Itoa(os.Getpid() + 1), "1", "systemd: not started with socket activation"},
+		{"no pid", "", "1", "systemd: not started with socket activation"},
+		{"no fds", pid, "", "systemd: LISTEN_FDS not set"},
+		{"zero fds", pid, "0", "systemd: LISTEN_FDS not set"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setActivationEnv(t, tt.pid, tt.fds, "")
+			_, err := loadActivatedSockets(first)
+			if err == nil || err.Error() != tt.wantError {
+				t.Errorf("err = %v, want %s", err, tt.wantError)
+			}
+		})
+	}
+
+	// A descriptor that is not a socket is reported.
+	f, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := syscall.Dup3(int(f.Fd()), first, syscall.O_CLOEXEC); err != nil {
+		t.Fatal(err)
+	}
+	// loadActivatedSockets closes the descriptor.
+	setActivationEnv(t, pid, "1", "")
+	if _, err := loadActivatedSockets(first); err == nil {
+		t.Error("a regular file was accepted as a socket")
+	}
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsLocal(t *testing.T) {
+	tests := []struct {
+		addr net.Addr
+		want bool
+	}{
+		{&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9090}, true},
+		{&net.TCPAddr{IP: net.IPv6loopback, Port: 9090}, true},
+		{&net.TCPAddr{IP: net.IPv4zero, Port: 9090}, false},
+		{&net.TCPAddr{IP: net.IPv6unspecified, Port: 9090}, false},
+		{&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 9090}, false},
+		{&net.UnixAddr{Name: "/run/kcst/admin.sock", Net: "unix"}, true},
+	}
+	for _, tt := range tests {
+		if got := isLocal(tt.addr); got != tt.want {
+			t.Errorf("isLocal(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestListenUnixMode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kcst.sock")
+	l, err := listenUnix(path, socketOptions{mode: 0o660})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		t.Errorf("%s is not a socket", path)
+	}
+	if perm := info.Mode().Perm(); perm != 0o660 {
+		t.Errorf("mode = %o, want 660", perm)
+	}
+}
+
+// A socket left behind by an unclean exit is replaced; any other file is
+// left alone.
+func TestListenUnixStale(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "kcst.sock")
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := listenUnix(path, socketOptions{})
+	if err != nil {
+		t.Fatalf("stale socket: %v", err)
+	}
+	l.Close()
+
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if l, err := listenUnix(file, socketOptions{}); err == nil {
+		l.Close()
+		t.Fatal("listened over a regular file")
+	}
+	if data, err := os.ReadFile(file); err != nil || string(data) != "data" {
+		t.Errorf("regular file was touched: %q, %v", data, err)
+	}
+}
+
+func TestListenUnixUnknownOwner(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kcst.sock")
+	for _, opts := range []socketOptions{
+		{owner: "kcst-no-such-user"},
+		{group: "kcst-no-such-group"},
+	} {
+		l, err := listenUnix(path, opts)
+		if err == nil {
+			l.Close()
+			t.Errorf("%+v: no error", opts)
+			continue
+		}
+		// The listener is closed, so the next attempt can bind again.
+		if _, err := os.Lstat(path); !os.IsNotExist(err) {
+			t.Errorf("%+v: socket left behind: %v", opts, err)
+		}
+	}
+}
+
+func TestActivatedListenerClaim(t *testing.T) {
+	// Pretend the sockets were already loaded from the environment.
+	activationOnce.Do(func() {})
+	listeners := make([]net.Listener, 3)
+	for i := range listeners {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		listeners[i] = l
+	}
+	t.Cleanup(func() { activated = nil })
+	activationMu.Lock()
+	activated = []activatedSocket{
+		{name: "web", listener: listeners[0]},
+		{name: "admin", listener: listeners[1]},
+		{name: "web", listener: listeners[2]},
+	}
+	activationMu.Unlock()
+
+	claims := []struct {
+		name string
+		want net.Listener
+	}{
+		{"admin", listeners[1]},
+		{"", listeners[0]},
+		{"web", listeners[2]},
+		{"web", nil},
+		{"", nil},
+	}
+	for _, c := range claims {
+		l, err := activatedListener(c.name)
+		if c.want == nil {
+			if err == nil {
+				t.Errorf("claim %q: got %s, want an error", c.name, l.Addr())
+			}
+			continue
+		}
+		if err != nil || l != c.want {
+			t.Errorf("claim %q = %v, %v, want %s", c.name, l, err, c.want.Addr())
+		}
+	}
+}
@@ -1,76 +1,458 @@
 package server
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
 	"net/http"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 
+	"github.com/keircn/kcst/internal/admin"
+	"github.com/keircn/kcst/internal/audit"
+	"github.com/keircn/kcst/internal/blocklist"
 	"github.com/keircn/kcst/internal/config"
+	"github.com/keircn/kcst/internal/events"
 	"github.com/keircn/kcst/internal/handlers"
+	"github.com/keircn/kcst/internal/health"
+	"github.com/keircn/kcst/internal/proxy"
+	"github.com/keircn/kcst/internal/scan"
 	"github.com/keircn/kcst/internal/storage"
 	"github.com/keircn/kcst/internal/templates"
 	"github.com/keircn/kcst/internal/upload"
 )
 
 type Server struct {
-	addr        string
+	addrs       []string
+	socketOpts  socketOptions
 	mux         *http.ServeMux
 	server      *http.Server
+	httpServer  *http.Server
+	adminAddr   string
+	adminServer *http.Server
 	db          *storage.DB
 	store       *upload.Store
+	events      *events.Dispatcher
+	handler     *handlers.Handler
+	checker     *health.Checker
+	resolver    atomic.Pointer[proxy.Resolver]
 	stopCleanup chan struct{}
+
+	mu  sync.Mutex
+	cfg *config.Config
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// OpenStore applies the retention settings from cfg and opens the metadata
+// database, blocklist and upload store it describes.
+func OpenStore(cfg *config.Config) (*storage.DB, *upload.Store, error) {
+	setRetention(cfg)
+
+	db, err := storage.Open(cfg.Storage.DBPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	store, err := upload.NewStore(cfg.Storage.UploadDir, db, cfg.Retention.CleanupInterval, idGenerator(cfg))
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	bl, err := blocklist.Open(cfg.Storage.Blocklist)
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	store.SetBlocklist(bl, audit.New(cfg.Storage.AuditLog))
+	store.SetAccessExtension(cfg.Retention.ExtendOnAccess, cfg.Retention.AccessMaxAge())
+	store.SetTrashPeriod(cfg.Storage.TrashPeriod)
+	// Maintenance commands scan what they import too, and leave files
+	// they could not scan pending for the server.
+	if sc := scanner(cfg.Scanner); sc != nil {
+		store.SetScanner(sc, cfg.Scanner.Timeout, cfg.Scanner.MaxAttempts)
+		store.SetScanActions(cfg.Scanner.Oversize, cfg.Scanner.Infected)
+	}
+	return db, store, nil
 }
 
 func New(cfg *config.Config) (*Server, error) {
 	mux := http.NewServeMux()
 
-	storage.SetRetention(storage.RetentionConfig{
-		MinTTL:      cfg.Retention.MinTTL,
-		MaxTTL:      cfg.Retention.MaxTTL,
-		MaxFileSize: cfg.Retention.MaxFileSize,
-	})
-
-	db, err := storage.Open(cfg.Storage.DBPath)
+	db, store, err := OpenStore(cfg)
 	if err != nil {
 		return nil, err
 	}
+	if cfg.Storage.FsckOnStart != "off" {
+		fsck(store, cfg)
+	}
+	// `kcst blocklist` only edits the list; copies are removed here.
+	if removed, err := store.RemoveBlocked(); err != nil {
+		log.Printf("Failed to remove blocked files: %v", err)
+	} else {
+		for _, meta := range removed {
+			log.Printf("Removed blocked file %s", meta.StoredName)
+		}
+	}
 
-	tmpl := templates.New()
-	store, err := upload.NewStore(cfg.Storage.UploadDir, db, cfg.Retention.CleanupInterval)
+	dispatcher, err := events.NewDispatcher(cfg.Webhooks.Outbox, webhookConfig(cfg))
 	if err != nil {
 		db.Close()
 		return nil, err
 	}
-	h := handlers.New(tmpl, store, cfg.Server.BaseURL)
+	store.SetPublisher(dispatcher)
+
+	tmpl := templates.New()
+	h := handlers.New(tmpl, store, dispatcher, cfg)
+	checker := health.New(cfg.Storage.UploadDir, db, store, cfg.Storage.MinFreeSpace)
+
+	// Without an admin listener the probes are served publicly so that
+	// orchestrators can still reach them.
+	if cfg.Server.AdminAddress == "" {
+		mux.HandleFunc("GET /healthz", checker.Healthz)
+		mux.HandleFunc("GET /readyz", checker.PublicReadyz)
+	}
 
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path == "/" {
 			h.Root(w, r)
 		} else if strings.HasPrefix(r.URL.Path, "/f/") {
 			h.Preview(w, r)
+		} else if strings.HasPrefix(r.URL.Path, "/t/") {
+			h.Thumbnail(w, r)
 		} else {
 			h.ServeFile(w, r)
 		}
 	})
 
-	return &Server{
-		addr:        cfg.Server.Address,
+	resolver, err := proxy.New(cfg.Server.TrustedProxies, cfg.Server.AllowedHosts)
+	if err != nil {
+		dispatcher.Close()
+		db.Close()
+		return nil, err
+	}
+
+	srv := &http.Server{
+		Addr: cfg.Server.Address,
+	}
+
+	var httpServer *http.Server
+	if cfg.TLS.Enabled() {
+		srv.TLSConfig, httpServer, err = setupTLS(cfg.TLS, cfg.Server.Address)
+		if err != nil {
+			dispatcher.Close()
+			db.Close()
+			return nil, err
+		}
+	}
+
+	socketOpts := socketOptions{
+		owner: cfg.Server.SocketOwner,
+		group: cfg.Server.SocketGroup,
+	}
+	if cfg.Server.SocketMode != "" {
+		mode, _ := strconv.ParseUint(cfg.Server.SocketMode, 8, 32)
+		socketOpts.mode = os.FileMode(mode)
+	}
+
+	s := &Server{
+		addrs:       cfg.Server.Addresses(),
+		adminAddr:   cfg.Server.AdminAddress,
+		socketOpts:  socketOpts,
 		mux:         mux,
 		db:          db,
 		store:       store,
+		events:      dispatcher,
+		handler:     h,
+		checker:     checker,
 		stopCleanup: make(chan struct{}),
-		server: &http.Server{
-			Addr:    cfg.Server.Address,
-			Handler: mux,
-		},
-	}, nil
+		cfg:         cfg,
+		server:      srv,
+		httpServer:  httpServer,
+	}
+	if cfg.Server.AdminAddress != "" {
+		s.adminServer = &http.Server{Handler: admin.New(db, store, checker, cfg.Server.AdminToken)}
+	}
+
+	s.resolver.Store(resolver)
+	srv.Handler = s.resolve(mux)
+	if httpServer != nil {
+		httpServer.Handler = s.resolve(httpServer.Handler)
+	}
+	return s, nil
 }
 
+// Run opens every configured listener and serves until one of them fails
+// or the server is shut down.
 func (s *Server) Run() error {
+	listeners := make([]net.Listener, 0, len(s.addrs))
+	for _, addr := range s.addrs {
+		l, err := listen(addr, s.socketOpts)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return fmt.Errorf("listen on %s: %w", addr, err)
+		}
+		listeners = append(listeners, l)
+	}
+
+	if s.adminServer != nil {
+		l, err := listen(s.adminAddr, s.socketOpts)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return fmt.Errorf("listen on admin address %s: %w", s.adminAddr, err)
+		}
+		// The admin endpoints expose profiling and destructive actions, so
+		// without a token they may only be reachable from this host.
+		if s.cfg.Server.AdminToken == "" && !isLocal(l.Addr()) {
+			l.Close()
+			for _, l := range listeners {
+				l.Close()
+			}
+			return fmt.Errorf("admin address %s is not a loopback address or Unix socket; set server.admin_token to allow it", s.adminAddr)
+		}
+		go func() {
+			log.Printf("Admin endpoints on %s %s", l.Addr().Network(), l.Addr())
+			if err := s.adminServer.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Printf("Admin listener error: %v", err)
+			}
+		}()
+	}
+
 	s.store.StartCleanupRoutine(s.stopCleanup)
-	return s.server.ListenAndServe()
+
+	if s.httpServer != nil {
+		go func() {
+			log.Printf("Redirecting HTTP on %s to HTTPS", s.httpServer.Addr)
+			if err := s.httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Printf("HTTP listener error: %v", err)
+			}
+		}()
+	}
+
+	// Decide once: Serve may fill in TLSConfig for HTTP/2 on its own.
+	useTLS := s.server.TLSConfig != nil
+	errCh := make(chan error, len(listeners))
+	for _, l := range listeners {
+		log.Printf("Listening on %s %s", l.Addr().Network(), l.Addr())
+		go func() {
+			if useTLS {
+				errCh <- s.server.ServeTLS(l, "", "")
+			} else {
+				errCh <- s.server.Serve(l)
+			}
+		}()
+	}
+	return <-errCh
+}
+
+// Shutdown stops accepting connections and waits up to the configured
+// shutdown timeout for in-flight requests before forcing them closed.
+// Background work is then stopped and the metadata store flushed.
+func (s *Server) Shutdown() error {
+	s.mu.Lock()
+	timeout := s.cfg.Server.ShutdownTimeout
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if s.httpServer != nil {
+		s.httpServer.Shutdown(ctx)
+	}
+	if s.adminServer != nil {
+		s.adminServer.Shutdown(ctx)
+	}
+
+	err := s.server.Shutdown(ctx)
+	if err != nil {
+		log.Printf("Shutdown timed out after %s, closing remaining connections", timeout)
+		s.server.Close()
+	}
+	return errors.Join(err, s.Close())
 }
 
 func (s *Server) Close() error {
-	close(s.stopCleanup)
-	return s.db.Close()
+	s.closeOnce.Do(func() {
+		close(s.stopCleanup)
+		s.store.Stop()
+		s.store.Wait()
+		s.store.RemoveIncomplete()
+		if err := s.store.FlushAccess(); err != nil {
+			log.Printf("Failed to record access times: %v", err)
+		}
+		s.events.Close()
+		s.closeErr = s.db.Close()
+	})
+	return s.closeErr
+}
+
+// resolve applies the current proxy settings to each request before
+// passing it on.
+func (s *Server) resolve(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.resolver.Load().Handler(next).ServeHTTP(w, r)
+	})
+}
+
+// Reload applies a new configuration to the running server. Settings that
+// are bound at startup, such as the listen address, keep their old value
+// and are logged so the operator knows a restart is needed. The whole
+// configuration is checked before anything is applied, so an invalid one
+// leaves the server unchanged.
+func (s *Server) Reload(cfg *config.Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	resolver, err := proxy.New(cfg.Server.TrustedProxies, cfg.Server.AllowedHosts)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old := s.cfg
+	restart := []struct {
+		key     string
+		changed bool
+	}{
+		{"server.address", old.Server.Address != cfg.Server.Address},
+		{"server.admin_address", old.Server.AdminAddress != cfg.Server.AdminAddress},
+		{"server.admin_token", old.Server.AdminToken != cfg.Server.AdminToken},
+		{"server.extra_addresses", !slices.Equal(old.Server.ExtraAddresses, cfg.Server.ExtraAddresses)},
+		{"server.socket_*", old.Server.SocketMode != cfg.Server.SocketMode ||
+			old.Server.SocketOwner != cfg.Server.SocketOwner || old.Server.SocketGroup != cfg.Server.SocketGroup},
+		{"storage.upload_dir", old.Storage.UploadDir != cfg.Storage.UploadDir},
+		{"storage.db_path", old.Storage.DBPath != cfg.Storage.DBPath},
+		{"storage.blocklist", old.Storage.Blocklist != cfg.Storage.Blocklist},
+		{"storage.audit_log", old.Storage.AuditLog != cfg.Storage.AuditLog},
+		{"webhooks.outbox", old.Webhooks.Outbox != cfg.Webhooks.Outbox},
+		{"scanner", !reflect.DeepEqual(old.Scanner, cfg.Scanner)},
+		{"tls", !reflect.DeepEqual(old.TLS, cfg.TLS)},
+	}
+	for _, r := range restart {
+		if r.changed {
+			log.Printf("Config reload: %s changed, restart required to apply it", r.key)
+		}
+	}
+
+	s.resolver.Store(resolver)
+	setRetention(cfg)
+	if cfg.Retention.CleanupInterval != old.Retention.CleanupInterval {
+		s.store.SetCleanupInterval(cfg.Retention.CleanupInterval)
+	}
+	s.store.SetIDGenerator(idGenerator(cfg))
+	s.store.SetAccessExtension(cfg.Retention.ExtendOnAccess, cfg.Retention.AccessMaxAge())
+	s.store.SetTrashPeriod(cfg.Storage.TrashPeriod)
+	s.events.Reconfigure(webhookConfig(cfg))
+	s.handler.Reconfigure(cfg)
+	s.checker.SetMinFree(cfg.Storage.MinFreeSpace)
+	if removed, err := s.store.ReloadBlocklist(); err != nil {
+		log.Printf("Config reload: keeping previous blocklist: %v", err)
+	} else {
+		for _, meta := range removed {
+			log.Printf("Removed blocked file %s", meta.StoredName)
+		}
+	}
+
+	s.cfg = cfg
+	log.Printf("Config reloaded")
+	return nil
+}
+
+// scanner returns the configured malware scanner, or nil if scanning is
+// off.
+func scanner(cfg config.ScannerConfig) scan.Scanner {
+	switch cfg.Mode {
+	case "clamd":
+		return scan.NewClamd(cfg.ClamdAddress)
+	case "command":
+		return scan.NewCommand(cfg.Command)
+	}
+	return nil
+}
+
+func webhookConfig(cfg *config.Config) *events.Config {
+	types := make([]events.Type, len(cfg.Webhooks.Events))
+	for i, e := range cfg.Webhooks.Events {
+		types[i] = events.Type(e)
+	}
+	return &events.Config{
+		URLs:        cfg.Webhooks.URLs,
+		Secret:      cfg.Webhooks.Secret,
+		Events:      types,
+		Timeout:     cfg.Webhooks.Timeout,
+		MaxAttempts: cfg.Webhooks.MaxAttempts,
+	}
+}
+
+// fsck checks the store before it starts serving and logs what it finds.
+// Problems are not fatal: the server starts either way.
+func fsck(store *upload.Store, cfg *config.Config) {
+	report, err := store.Fsck(upload.FsckOptions{
+		Repair:        cfg.Storage.FsckOnStart == "repair",
+		DeleteOrphans: cfg.Storage.FsckOrphans == "delete",
+	})
+	if err != nil {
+		log.Printf("Consistency check failed: %v", err)
+		return
+	}
+	for _, p := range report.Problems {
+		log.Printf("Consistency check: %s", p)
+	}
+	log.Printf("Consistency check: %d records, %d files, %d problems",
+		report.Files, report.Blobs, len(report.Problems))
+}
+
+func setRetention(cfg *config.Config) {
+	storage.SetRetention(RetentionPolicy(cfg))
+}
+
+// RetentionPolicy builds the policy selected in cfg. The config must have
+// passed validation.
+func RetentionPolicy(cfg *config.Config) storage.RetentionPolicy {
+	r := cfg.Retention
+
+	var policy storage.RetentionPolicy
+	switch r.Policy {
+	case "linear":
+		policy = storage.LinearPolicy{MinTTL: r.MinTTL, MaxTTL: r.MaxTTL, MaxFileSize: r.MaxFileSize}
+	case "exponential":
+		policy = storage.ExponentialPolicy{MinTTL: r.MinTTL, MaxTTL: r.MaxTTL, MaxFileSize: r.MaxFileSize, HalfSize: r.HalfSize}
+	case "step":
+		steps, _ := r.ParseSteps()
+		p := storage.StepPolicy{}
+		for _, s := range steps {
+			p.Steps = append(p.Steps, storage.RetentionStep{MaxSize: s.MaxSize, TTL: s.TTL})
+		}
+		policy = p
+	default:
+		policy = storage.SqrtPolicy{MinTTL: r.MinTTL, MaxTTL: r.MaxTTL, MaxFileSize: r.MaxFileSize}
+	}
+
+	overrides, _ := r.ParseContentTypes()
+	if len(overrides) == 0 {
+		return policy
+	}
+	p := storage.ContentTypePolicy{Base: policy}
+	for _, o := range overrides {
+		p.Overrides = append(p.Overrides, storage.ContentTypeTTL{Pattern: o.Pattern, TTL: o.TTL})
+	}
+	return p
+}
+
+func idGenerator(cfg *config.Config) upload.IDGenerator {
+	return upload.IDGenerator{Alphabet: cfg.Upload.IDAlphabet, Length: cfg.Upload.IDLength}
 }
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/keircn/kcst/internal/config"
+	"github.com/keircn/kcst/internal/storage"
+	"github.com/keircn/kcst/internal/upload"
+)
+
+// testConfig returns a valid configuration that keeps all state in a
+// temporary directory.
+func testConfig(t *testing.T) *config.Config {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := config.Default()
+	cfg.Server.Address = "127.0.0.1:0"
+	cfg.Storage.UploadDir = filepath.Join(dir, "uploads")
+	cfg.Storage.DBPath = filepath.Join(dir, "kcst.db")
+	cfg.Storage.Blocklist = filepath.Join(dir, "blocklist.json")
+	cfg.Storage.AuditLog = filepath.Join(dir, "audit.log")
+	cfg.Storage.MinFreeSpace = 0
+	cfg.Webhooks.Outbox = filepath.Join(dir, "outbox")
+	return cfg
+}
+
+func newTestServer(t *testing.T, cfg *config.Config) *Server {
+	t.Helper()
+	prev := storage.Retention()
+	t.Cleanup(func() { storage.SetRetention(prev) })
+
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestReload(t *testing.T) {
+	cfg := testConfig(t)
+	s := newTestServer(t, cfg)
+	resolver := s.resolver.Load()
+
+	next := *cfg
+	next.Retention.MaxTTL = 14 * 24 * time.Hour
+	next.Retention.CleanupInterval = 5 * time.Minute
+	next.Server.TrustedProxies = []string{"10.0.0.0/8"}
+	if err := s.Reload(&next); err != nil {
+		t.Fatal(err)
+	}
+	if got := storage.Retention().TTL(next.Retention.MaxFileSize, ""); got != next.Retention.MinTTL {
+		t.Errorf("TTL of the largest file = %v, want %v", got, next.Retention.MinTTL)
+	}
+	if got := storage.Retention().TTL(0, ""); got != next.Retention.MaxTTL {
+		t.Errorf("TTL of an empty file = %v, want %v", got, next.Retention.MaxTTL)
+	}
+	if got := s.store.CleanupInterval(); got != 5*time.Minute {
+		t.Errorf("cleanup interval = %v, want 5m", got)
+	}
+	if s.resolver.Load() == resolver {
+		t.Error("proxy settings were not replaced")
+	}
+}
+
+// A config that fails validation must not be applied in part.
+func TestReloadInvalid(t *testing.T) {
+	cfg := testConfig(t)
+	s := newTestServer(t, cfg)
+	resolver := s.resolver.Load()
+	policy := storage.Retention()
+
+	next := *cfg
+	next.Retention.MaxTTL = 14 * 24 * time.Hour
+	next.Retention.CleanupInterval = 5 * time.Minute
+	next.Server.TrustedProxies = []string{"10.0.0.0/8"}
+	next.Upload.RateLimit = -1
+	if err := s.Reload(&next); err == nil {
+		t.Fatal("invalid config was accepted")
+	}
+
+	if storage.Retention() != policy {
+		t.Error("retention policy changed")
+	}
+	if got := s.store.CleanupInterval(); got != cfg.Retention.CleanupInterval {
+		t.Errorf("cleanup interval = %v, want %v", got, cfg.Retention.CleanupInterval)
+	}
+	if s.resolver.Load() != resolver {
+		t.Error("proxy settings changed")
+	}
+	if s.cfg != cfg {
+		t.Error("server config was replaced")
+	}
+}
+
+// stalledFile hands out one chunk and then blocks until released, like an
+// upload whose client stopped sending.
+type stalledFile struct {
+	started, release chan struct{}
+	sent             bool
+}
+
+func (f *stalledFile) Read(p []byte) (int, error) {
+	if !f.sent {
+		f.sent = true
+		close(f.started)
+		return copy(p, "partial"), nil
+	}
+	<-f.release
+	return 0, errors.New("client went away")
+}
+
+func (f *stalledFile) ReadAt([]byte, int64) (int, error) { return 0, io.EOF }
+func (f *stalledFile) Seek(int64, int) (int64, error)    { return 0, nil }
+func (f *stalledFile) Close() error                      { return nil }
+
+// Shutdown gives up on uploads that do not finish within the timeout and
+// leaves neither their blobs nor records behind.
+func TestShutdownInFlight(t *testing.T) {
+	cfg := testConfig(t)
+	sock := filepath.Join(t.TempDir(), "kcst.sock")
+	cfg.Server.Address = "unix:" + sock
+	cfg.Server.ShutdownTimeout = 100 * time.Millisecond
+	s := newTestServer(t, cfg)
+
+	// One upload stalls while the store writes it, another while its body
+	// is still being sent.
+	file := &stalledFile{started: make(chan struct{}), release: make(chan struct{})}
+	defer close(file.release)
+	saved := make(chan error, 1)
+	s.mux.HandleFunc("POST /stall", func(w http.ResponseWriter, r *http.Request) {
+		_, _, err := s.store.Save(file, &multipart.FileHeader{Filename: "stalled.txt"}, upload.Options{})
+		saved <- err
+	})
+	active := make(chan struct{}, 2)
+	s.server.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateActive {
+			active <- struct{}{}
+		}
+	}
+
+	go s.Run()
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			for {
+				conn, err := d.DialContext(ctx, "unix", sock)
+				if err == nil || ctx.Err() != nil {
+					return conn, err
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		},
+	}}
+
+	done := make(chan error, 2)
+	go func() {
+		_, err := client.Post("http://kcst/stall", "text/plain", strings.NewReader("x"))
+		done <- err
+	}()
+	body, pw := io.Pipe()
+	defer pw.Close()
+	go func() {
+		_, err := client.Post("http://kcst/", "multipart/form-data; boundary=b", body)
+		done <- err
+	}()
+	pw.Write([]byte("--b\r\nContent-Disposition: form-data; name=\"file\"; filename=\"a.txt\"\r\n\r\npartial"))
+
+	<-file.started
+	<-active
+	<-active
+	if temps := tempFiles(t, cfg.Storage.UploadDir); len(temps) != 1 {
+		t.Fatalf("temporary files before shutdown = %q, want one", temps)
+	}
+
+	if err := s.Shutdown(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown() = %v, want a timeout", err)
+	}
+	// The client only gives up on its request once its body ends.
+	pw.CloseWithError(errors.New("client gave up"))
+	for range 2 {
+		if err := <-done; err == nil {
+			t.Error("stalled request succeeded")
+		}
+	}
+	entries, err := os.ReadDir(cfg.Storage.UploadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			t.Errorf("left in the upload directory: %s", e.Name())
+		}
+	}
+
+	// Once the stalled write gives up it must not record anything either.
+	file.release <- struct{}{}
+	if err := <-saved; err == nil {
+		t.Error("stalled upload was saved")
+	}
+	db, err := storage.Open(cfg.Storage.DBPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if records, _ := db.ListMetadata(); len(records) != 0 {
+		t.Errorf("records after shutdown = %d, want 0", len(records))
+	}
+}
+
+func tempFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	matches, err := filepath.Glob(filepath.Join(dir, ".upload-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return matches
+}
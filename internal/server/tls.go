@@ -0,0 +1,179 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/keircn/kcst/internal/config"
+)
+
+const certCheckInterval = 10 * time.Second
+
+// certReloader serves a static certificate and key pair, reloading them
+// when either file changes on disk.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	return nil
+}
+
+func (r *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.lastCheck) < certCheckInterval {
+		return r.cert, nil
+	}
+	r.lastCheck = time.Now()
+
+	modTime, err := r.latestModTime()
+	if err != nil || !modTime.After(r.modTime) {
+		return r.cert, nil
+	}
+	// Keep serving the old pair if the new one is half-written or invalid.
+	if err := r.load(); err != nil {
+		log.Printf("Failed to reload TLS certificate: %v", err)
+		return r.cert, nil
+	}
+	log.Printf("Reloaded TLS certificate from %s", r.certFile)
+	return r.cert, nil
+}
+
+// setupTLS builds the TLS config for the main listener and, if an HTTP
+// address is configured, a plain HTTP server that answers ACME HTTP-01
+// challenges and redirects everything else to HTTPS.
+func setupTLS(cfg config.TLSConfig, httpsAddr string) (*tls.Config, *http.Server, error) {
+	tlsCfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	redirect := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		redirectHTTPS(w, r, httpsAddr)
+	}))
+
+	switch cfg.Mode {
+	case "static":
+		reloader, err := newCertReloader(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsCfg.GetCertificate = reloader.GetCertificate
+
+	case "acme":
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(cfg.CacheDir),
+			HostPolicy: autocert.HostWhitelist(cfg.ACMEDomains...),
+			Email:      cfg.ACMEEmail,
+		}
+		if cfg.ACMEDirectory != "" || cfg.ACMECARoot != "" {
+			client, err := acmeClient(cfg)
+			if err != nil {
+				return nil, nil, err
+			}
+			manager.Client = client
+		}
+		tlsCfg.GetCertificate = manager.GetCertificate
+		tlsCfg.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
+		redirect = manager.HTTPHandler(redirect)
+
+	default:
+		return nil, nil, errors.New("tls: unknown mode " + cfg.Mode)
+	}
+
+	if cfg.HTTPAddress == "" {
+		return tlsCfg, nil, nil
+	}
+	return tlsCfg, &http.Server{
+		Addr:              cfg.HTTPAddress,
+		Handler:           redirect,
+		ReadHeaderTimeout: 10 * time.Second,
+	}, nil
+}
+
+// acmeClient returns a client for a non-default ACME directory, such as a
+// local Pebble instance whose API is served with its own CA.
+func acmeClient(cfg config.TLSConfig) (*acme.Client, error) {
+	client := &acme.Client{DirectoryURL: cfg.ACMEDirectory}
+	if cfg.ACMEDirectory == "" {
+		client.DirectoryURL = autocert.DefaultACMEDirectory
+	}
+
+	if cfg.ACMECARoot != "" {
+		pem, err := os.ReadFile(cfg.ACMECARoot)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("tls: no certificates found in " + cfg.ACMECARoot)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		client.HTTPClient = &http.Client{Transport: transport}
+	}
+	return client, nil
+}
+
+func redirectHTTPS(w http.ResponseWriter, r *http.Request, httpsAddr string) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if _, port, err := net.SplitHostPort(httpsAddr); err == nil && port != "443" && port != "" {
+		host = net.JoinHostPort(host, port)
+	}
+
+	target := "https://" + host + r.URL.RequestURI()
+	http.Redirect(w, r, target, http.StatusMovedPermanently)
+}
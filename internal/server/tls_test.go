@@ -0,0 +1,467 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+
+	"github.com/keircn/kcst/internal/config"
+)
+
+// acmeStub is a minimal RFC 8555 server for one domain. It offers a single
+// challenge of the given type and checks the response through validate
+// before issuing a certificate signed by its own CA. Signatures on requests
+// are not checked.
+type acmeStub struct {
+	t        *testing.T
+	srv      *httptest.Server
+	domain   string
+	chalType string
+	validate func(token, keyAuth string) error
+
+	mu          sync.Mutex
+	nonce       int
+	thumbprint  string
+	authzStatus string
+	orderStatus string
+	certPEM     []byte
+	finalized   int
+}
+
+const stubToken = "stub-token"
+
+func newACMEStub(t *testing.T, domain, chalType string) *acmeStub {
+	s := &acmeStub{
+		t:           t,
+		domain:      domain,
+		chalType:    chalType,
+		authzStatus: "pending",
+		orderStatus: "pending",
+	}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.srv.Close)
+	return s
+}
+
+type jws struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+}
+
+func (s *acmeStub) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nonce++
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", s.nonce))
+	url := s.srv.URL
+
+	if r.URL.Path == "/dir" {
+		s.json(w, http.StatusOK, map[string]string{
+			"newNonce":   url + "/nonce",
+			"newAccount": url + "/account",
+			"newOrder":   url + "/order",
+			"revokeCert": url + "/revoke",
+			"keyChange":  url + "/key-change",
+		})
+		return
+	}
+	if r.URL.Path == "/nonce" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var req jws
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	payload, _ := base64.RawURLEncoding.DecodeString(req.Payload)
+
+	switch r.URL.Path {
+	case "/account":
+		protected, _ := base64.RawURLEncoding.DecodeString(req.Protected)
+		var hdr struct {
+			JWK map[string]string `json:"jwk"`
+		}
+		json.Unmarshal(protected, &hdr)
+		s.thumbprint = thumbprint(s.t, hdr.JWK)
+		w.Header().Set("Location", url+"/account/1")
+		s.json(w, http.StatusCreated, map[string]string{"status": "valid"})
+	case "/order":
+		w.Header().Set("Location", url+"/order/1")
+		s.json(w, http.StatusCreated, s.order())
+	case "/order/1":
+		s.json(w, http.StatusOK, s.order())
+	case "/authz/1":
+		s.json(w, http.StatusOK, s.authz())
+	case "/chal/1":
+		if len(payload) > 0 && s.authzStatus == "pending" {
+			// Validation talks back to the server under test, which
+			// must not block on this stub.
+			s.mu.Unlock()
+			err := s.validate(stubToken, stubToken+"."+s.thumbprint)
+			s.mu.Lock()
+			if err != nil {
+				s.t.Errorf("%s validation: %v", s.chalType, err)
+				s.authzStatus = "invalid"
+				s.orderStatus = "invalid"
+			} else {
+				s.authzStatus = "valid"
+				s.orderStatus = "ready"
+			}
+		}
+		s.json(w, http.StatusOK, s.authz()["challenges"].([]any)[0])
+	case "/finalize/1":
+		var fin struct {
+			CSR string `json:"csr"`
+		}
+		json.Unmarshal(payload, &fin)
+		der, _ := base64.RawURLEncoding.DecodeString(fin.CSR)
+		s.certPEM = s.issue(der)
+		s.finalized++
+		s.orderStatus = "valid"
+		w.Header().Set("Location", url+"/order/1")
+		s.json(w, http.StatusOK, s.order())
+	case "/cert/1":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(s.certPEM)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *acmeStub) json(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *acmeStub) order() map[string]any {
+	o := map[string]any{
+		"status":         s.orderStatus,
+		"identifiers":    []any{map[string]string{"type": "dns", "value": s.domain}},
+		"authorizations": []string{s.srv.URL + "/authz/1"},
+		"finalize":       s.srv.URL + "/finalize/1",
+	}
+	if s.certPEM != nil {
+		o["certificate"] = s.srv.URL + "/cert/1"
+	}
+	return o
+}
+
+func (s *acmeStub) authz() map[string]any {
+	return map[string]any{
+		"status":     s.authzStatus,
+		"identifier": map[string]string{"type": "dns", "value": s.domain},
+		"challenges": []any{map[string]string{
+			"type":   s.chalType,
+			"url":    s.srv.URL + "/chal/1",
+			"token":  stubToken,
+			"status": s.authzStatus,
+		}},
+	}
+}
+
+// issue signs the CSR with a throwaway CA and returns the leaf and CA as
+// a PEM chain.
+func (s *acmeStub) issue(csrDER []byte) []byte {
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		s.t.Errorf("parse CSR: %v", err)
+		return nil
+	}
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "stub CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, _ := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	ca, _ := x509.ParseCertificate(caDER)
+
+	leaf := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: csr.DNSNames[0]},
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leaf, ca, csr.PublicKey, caKey)
+	if err != nil {
+		s.t.Errorf("sign certificate: %v", err)
+		return nil
+	}
+	return append(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leafDER}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})...,
+	)
+}
+
+// thumbprint computes the RFC 7638 thumbprint of an EC or RSA JWK.
+func thumbprint(t *testing.T, jwk map[string]string) string {
+	var canonical string
+	switch jwk["kty"] {
+	case "EC":
+		canonical = fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, jwk["crv"], jwk["x"], jwk["y"])
+	case "RSA":
+		canonical = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, jwk["e"], jwk["n"])
+	default:
+		t.Errorf("unexpected account key type %q", jwk["kty"])
+	}
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+var idPeAcmeIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+func TestACME(t *testing.T) {
+	const domain = "kcst.example"
+
+	for _, chalType := range []string{"http-01", "tls-alpn-01"} {
+		t.Run(chalType, func(t *testing.T) {
+			stub := newACMEStub(t, domain, chalType)
+			cfg := config.TLSConfig{
+				Mode:          "acme",
+				ACMEDomains:   []string{domain},
+				CacheDir:      t.TempDir(),
+				ACMEDirectory: stub.srv.URL + "/dir",
+				HTTPAddress:   "127.0.0.1:0",
+			}
+			tlsCfg, httpSrv, err := setupTLS(cfg, ":443")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if httpSrv == nil {
+				t.Fatal("no HTTP server for http-01 challenges")
+			}
+
+			stub.validate = func(token, keyAuth string) error {
+				switch chalType {
+				case "http-01":
+					rec := httptest.NewRecorder()
+					req := httptest.NewRequest(http.MethodGet, "http://"+domain+"/.well-known/acme-challenge/"+token, nil)
+					httpSrv.Handler.ServeHTTP(rec, req)
+					if body := rec.Body.String(); rec.Code != http.StatusOK || body != keyAuth {
+						return fmt.Errorf("challenge response %d %q, want %q", rec.Code, body, keyAuth)
+					}
+				case "tls-alpn-01":
+					cert, err := tlsCfg.GetCertificate(&tls.ClientHelloInfo{
+						ServerName:      domain,
+						SupportedProtos: []string{acme.ALPNProto},
+					})
+					if err != nil {
+						return err
+					}
+					leaf, err := x509.ParseCertificate(cert.Certificate[0])
+					if err != nil {
+						return err
+					}
+					sum := sha256.Sum256([]byte(keyAuth))
+					want, _ := asn1.Marshal(sum[:])
+					for _, ext := range leaf.Extensions {
+						if ext.Id.Equal(idPeAcmeIdentifier) && bytes.Equal(ext.Value, want) {
+							return nil
+						}
+					}
+					return fmt.Errorf("challenge certificate has no matching acmeIdentifier")
+				}
+				return nil
+			}
+
+			hello := &tls.ClientHelloInfo{ServerName: domain}
+			cert, err := tlsCfg.GetCertificate(hello)
+			if err != nil {
+				t.Fatal(err)
+			}
+			leaf, err := x509.ParseCertificate(cert.Certificate[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := leaf.VerifyHostname(domain); err != nil {
+				t.Error(err)
+			}
+
+			// The certificate is cached and served without a new order.
+			if _, err := tlsCfg.GetCertificate(hello); err != nil {
+				t.Fatal(err)
+			}
+			if stub.finalized != 1 {
+				t.Errorf("finalized %d orders, want 1", stub.finalized)
+			}
+			if entries, _ := os.ReadDir(cfg.CacheDir); len(entries) < 2 {
+				t.Errorf("cache dir holds %d entries, want the account key and certificate", len(entries))
+			}
+		})
+	}
+}
+
+func TestACMEHostPolicy(t *testing.T) {
+	stub := newACMEStub(t, "kcst.example", "http-01")
+	tlsCfg, _, err := setupTLS(config.TLSConfig{
+		Mode:          "acme",
+		ACMEDomains:   []string{"kcst.example"},
+		CacheDir:      t.TempDir(),
+		ACMEDirectory: stub.srv.URL + "/dir",
+	}, ":443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tlsCfg.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.example"}); err == nil {
+		t.Error("issued a certificate for a host outside acme_domains")
+	}
+}
+
+func TestACMEHTTPRedirect(t *testing.T) {
+	stub := newACMEStub(t, "kcst.example", "http-01")
+	_, httpSrv, err := setupTLS(config.TLSConfig{
+		Mode:          "acme",
+		ACMEDomains:   []string{"kcst.example"},
+		CacheDir:      t.TempDir(),
+		ACMEDirectory: stub.srv.URL + "/dir",
+		HTTPAddress:   ":80",
+	}, ":8443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	httpSrv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://kcst.example/a.png?x=1", nil))
+	if loc := rec.Header().Get("Location"); rec.Code != http.StatusMovedPermanently || loc != "https://kcst.example:8443/a.png?x=1" {
+		t.Errorf("got %d to %q", rec.Code, loc)
+	}
+}
+
+// writeCert writes a self-signed certificate for name and its key.
+func writeCert(t *testing.T, certFile, keyFile, name string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+}
+
+func servedName(t *testing.T, get func(*tls.ClientHelloInfo) (*tls.Certificate, error)) string {
+	t.Helper()
+	cert, err := get(&tls.ClientHelloInfo{ServerName: "kcst.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+// touch moves the modification time of paths forward by d so a rewrite
+// within the file system's timestamp resolution is still noticed.
+func touch(t *testing.T, d time.Duration, paths ...string) {
+	t.Helper()
+	future := time.Now().Add(d)
+	for _, p := range paths {
+		if err := os.Chtimes(p, future, future); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestStaticCert(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCert(t, certFile, keyFile, "first")
+
+	tlsCfg, httpSrv, err := setupTLS(config.TLSConfig{Mode: "static", CertFile: certFile, KeyFile: keyFile}, ":443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if httpSrv != nil {
+		t.Error("HTTP server started without tls.http_address")
+	}
+	if got := servedName(t, tlsCfg.GetCertificate); got != "first" {
+		t.Errorf("serving %q, want first", got)
+	}
+}
+
+func TestStaticCertReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCert(t, certFile, keyFile, "first")
+
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := servedName(t, r.GetCertificate); got != "first" {
+		t.Fatalf("serving %q, want first", got)
+	}
+
+	writeCert(t, certFile, keyFile, "second")
+	touch(t, time.Minute, certFile, keyFile)
+	// Files are checked at most every certCheckInterval.
+	if got := servedName(t, r.GetCertificate); got != "first" {
+		t.Errorf("serving %q before the check interval passed, want first", got)
+	}
+
+	r.lastCheck = time.Time{}
+	if got := servedName(t, r.GetCertificate); got != "second" {
+		t.Errorf("serving %q after the files changed, want second", got)
+	}
+
+	// A broken pair, such as one caught half-written, is ignored.
+	os.WriteFile(keyFile, []byte("not a key"), 0o600)
+	touch(t, 2*time.Minute, keyFile)
+	r.lastCheck = time.Time{}
+	if got := servedName(t, r.GetCertificate); got != "second" {
+		t.Errorf("serving %q after a bad update, want second", got)
+	}
+}
+
+func TestStaticCertMissing(t *testing.T) {
+	_, _, err := setupTLS(config.TLSConfig{Mode: "static", CertFile: "/nonexistent/cert.pem", KeyFile: "/nonexistent/key.pem"}, ":443")
+	if err == nil {
+		t.Error("expected an error for missing certificate files")
+	}
+}
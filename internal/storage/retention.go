@@ -0,0 +1,244 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"mime"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// RetentionPolicy decides how long a file is kept.
+type RetentionPolicy interface {
+	TTL(size int64, contentType string) time.Duration
+	// Describe returns the policy's parameters and formula, one per line,
+	// for display on the home page and in the README.
+	Describe() []string
+}
+
+func DefaultRetention() RetentionPolicy {
+	return SqrtPolicy{
+		MinTTL:      1 * time.Hour,
+		MaxTTL:      28 * 24 * time.Hour,
+		MaxFileSize: 100 * 1024 * 1024,
+	}
+}
+
+var retention atomic.Pointer[RetentionPolicy]
+
+func init() {
+	SetRetention(DefaultRetention())
+}
+
+// SetRetention replaces the policy used by CalculateTTL. It is safe to call
+// while requests are being served.
+func SetRetention(p RetentionPolicy) {
+	retention.Store(&p)
+}
+
+func Retention() RetentionPolicy {
+	return *retention.Load()
+}
+
+func CalculateTTL(size int64, contentType string) time.Duration {
+	return Retention().TTL(size, contentType)
+}
+
+// curve maps a file size to a TTL between MinTTL and MaxTTL. shape receives
+// size/MaxFileSize in (0, 1) and returns the share of the range to keep.
+func curve(minTTL, maxTTL time.Duration, maxSize, size int64, shape func(ratio float64) float64) time.Duration {
+	if size <= 0 {
+		return maxTTL
+	}
+	if size >= maxSize {
+		return minTTL
+	}
+	ratio := float64(size) / float64(maxSize)
+	return minTTL + time.Duration(shape(ratio)*float64(maxTTL-minTTL))
+}
+
+func describeRange(minTTL, maxTTL time.Duration, maxSize int64) []string {
+	return []string{
+		"min_age  = " + describeDuration(minTTL),
+		"max_age  = " + describeDuration(maxTTL),
+		"max_size = " + describeSize(maxSize),
+		"",
+	}
+}
+
+// SqrtPolicy keeps small files much longer than large ones:
+// TTL = MinTTL + (MaxTTL - MinTTL) * (1 - sqrt(size/MaxFileSize)).
+type SqrtPolicy struct {
+	MinTTL      time.Duration
+	MaxTTL      time.Duration
+	MaxFileSize int64
+}
+
+func (p SqrtPolicy) TTL(size int64, _ string) time.Duration {
+	return curve(p.MinTTL, p.MaxTTL, p.MaxFileSize, size, func(r float64) float64 {
+		return 1 - math.Sqrt(r)
+	})
+}
+
+func (p SqrtPolicy) Describe() []string {
+	return append(describeRange(p.MinTTL, p.MaxTTL, p.MaxFileSize),
+		"retention = min_age + (max_age - min_age) * (1 - sqrt(size/max_size))")
+}
+
+// LinearPolicy shortens the TTL in proportion to the file size.
+type LinearPolicy struct {
+	MinTTL      time.Duration
+	MaxTTL      time.Duration
+	MaxFileSize int64
+}
+
+func (p LinearPolicy) TTL(size int64, _ string) time.Duration {
+	return curve(p.MinTTL, p.MaxTTL, p.MaxFileSize, size, func(r float64) float64 {
+		return 1 - r
+	})
+}
+
+func (p LinearPolicy) Describe() []string {
+	return append(describeRange(p.MinTTL, p.MaxTTL, p.MaxFileSize),
+		"retention = min_age + (max_age - min_age) * (1 - size/max_size)")
+}
+
+// ExponentialPolicy halves the TTL above MinTTL for every HalfSize bytes.
+// The curve is shifted and scaled so that it still reaches MinTTL exactly
+// at MaxFileSize.
+type ExponentialPolicy struct {
+	MinTTL      time.Duration
+	MaxTTL      time.Duration
+	MaxFileSize int64
+	HalfSize    int64
+}
+
+func (p ExponentialPolicy) TTL(size int64, _ string) time.Duration {
+	halves := float64(p.MaxFileSize) / float64(p.HalfSize)
+	floor := math.Pow(0.5, halves)
+	return curve(p.MinTTL, p.MaxTTL, p.MaxFileSize, size, func(r float64) float64 {
+		return (math.Pow(0.5, r*halves) - floor) / (1 - floor)
+	})
+}
+
+func (p ExponentialPolicy) Describe() []string {
+	lines := describeRange(p.MinTTL, p.MaxTTL, p.MaxFileSize)
+	lines = slices.Insert(lines, len(lines)-1, "half_size = "+describeSize(p.HalfSize))
+	return append(lines, "retention = min_age + (max_age - min_age) * (0.5^(size/half_size) - f) / (1 - f)",
+		"f         = 0.5^(max_size/half_size)")
+}
+
+// RetentionStep keeps files of up to MaxSize bytes for TTL.
+type RetentionStep struct {
+	MaxSize int64
+	TTL     time.Duration
+}
+
+// StepPolicy looks the TTL up in a table of size buckets sorted by MaxSize.
+// Files larger than the last bucket get its TTL. Without any buckets the
+// default policy applies.
+type StepPolicy struct {
+	Steps []RetentionStep
+}
+
+func (p StepPolicy) TTL(size int64, contentType string) time.Duration {
+	if len(p.Steps) == 0 {
+		return DefaultRetention().TTL(size, contentType)
+	}
+	for _, s := range p.Steps {
+		if size <= s.MaxSize {
+			return s.TTL
+		}
+	}
+	return p.Steps[len(p.Steps)-1].TTL
+}
+
+func (p StepPolicy) Describe() []string {
+	lines := make([]string, 0, len(p.Steps))
+	for _, s := range p.Steps {
+		lines = append(lines, fmt.Sprintf("size <= %-10s retention = %s", describeSize(s.MaxSize), describeDuration(s.TTL)))
+	}
+	return lines
+}
+
+// ContentTypeTTL gives files whose content type matches Pattern a fixed
+// TTL. Pattern is a media type such as "image/png" or a wildcard such as
+// "image/*".
+type ContentTypeTTL struct {
+	Pattern string
+	TTL     time.Duration
+}
+
+func (c ContentTypeTTL) matches(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.ToLower(contentType)
+	}
+	if prefix, ok := strings.CutSuffix(c.Pattern, "/*"); ok {
+		return strings.HasPrefix(mediaType, prefix+"/")
+	}
+	return mediaType == c.Pattern
+}
+
+// ContentTypePolicy applies the first matching override and falls back to
+// Base for everything else.
+type ContentTypePolicy struct {
+	Base      RetentionPolicy
+	Overrides []ContentTypeTTL
+}
+
+func (p ContentTypePolicy) TTL(size int64, contentType string) time.Duration {
+	for _, o := range p.Overrides {
+		if o.matches(contentType) {
+			return o.TTL
+		}
+	}
+	return p.Base.TTL(size, contentType)
+}
+
+func (p ContentTypePolicy) Describe() []string {
+	lines := append([]string{}, p.Base.Describe()...)
+	lines = append(lines, "")
+	for _, o := range p.Overrides {
+		lines = append(lines, fmt.Sprintf("%-20s retention = %s", o.Pattern, describeDuration(o.TTL)))
+	}
+	return lines
+}
+
+func describeDuration(d time.Duration) string {
+	const day = 24 * time.Hour
+	switch {
+	case d%day == 0:
+		return plural(int64(d/day), "day")
+	case d%time.Hour == 0:
+		return plural(int64(d/time.Hour), "hour")
+	case d%time.Minute == 0:
+		return plural(int64(d/time.Minute), "minute")
+	}
+	return d.String()
+}
+
+func describeSize(n int64) string {
+	for _, u := range []struct {
+		suffix string
+		size   int64
+	}{
+		{"GiB", 1 << 30},
+		{"MiB", 1 << 20},
+		{"KiB", 1 << 10},
+	} {
+		if n != 0 && n%u.size == 0 {
+			return fmt.Sprintf("%d %s", n/u.size, u.suffix)
+		}
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
+func plural(n int64, unit string) string {
+	if n == 1 {
+		return "1 " + unit
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestCurvePolicies(t *testing.T) {
+	const (
+		minTTL  = time.Hour
+		maxTTL  = 101 * time.Hour
+		maxSize = 100 << 20
+	)
+	// share returns the TTL that keeps fraction f of the range above minTTL.
+	share := func(f float64) time.Duration {
+		return minTTL + time.Duration(f*float64(maxTTL-minTTL))
+	}
+	tests := []struct {
+		name   string
+		policy RetentionPolicy
+		half   time.Duration // TTL at maxSize/2
+	}{
+		{"sqrt", SqrtPolicy{minTTL, maxTTL, maxSize}, share(1 - math.Sqrt(0.5))},
+		{"linear", LinearPolicy{minTTL, maxTTL, maxSize}, 51 * time.Hour},
+		// Five of ten halvings: (2^-5 - 2^-10) / (1 - 2^-10).
+		{"exponential", ExponentialPolicy{minTTL, maxTTL, maxSize, maxSize / 10}, share(31.0 / 1023)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.TTL(0, ""); got != maxTTL {
+				t.Errorf("TTL(0) = %s, want %s", got, maxTTL)
+			}
+			if got := tt.policy.TTL(maxSize/2, ""); (got - tt.half).Abs() > time.Second {
+				t.Errorf("TTL(maxSize/2) = %s, want %s", got, tt.half)
+			}
+			if got := tt.policy.TTL(maxSize, ""); got != minTTL {
+				t.Errorf("TTL(maxSize) = %s, want %s", got, minTTL)
+			}
+			if got := tt.policy.TTL(2*maxSize, ""); got != minTTL {
+				t.Errorf("TTL(2*maxSize) = %s, want %s", got, minTTL)
+			}
+			// The curve falls towards min_ttl without a jump at the end.
+			if got := tt.policy.TTL(maxSize-1, ""); got-minTTL > time.Minute {
+				t.Errorf("TTL(maxSize-1) = %s, too far above %s", got, minTTL)
+			}
+			prev := maxTTL
+			for size := int64(0); size <= maxSize; size += maxSize / 64 {
+				got := tt.policy.TTL(size, "")
+				if got > prev {
+					t.Fatalf("TTL rises from %s to %s at %d bytes", prev, got, size)
+				}
+				prev = got
+			}
+		})
+	}
+}
+
+func TestStepPolicy(t *testing.T) {
+	p := StepPolicy{Steps: []RetentionStep{
+		{MaxSize: 1 << 20, TTL: 30 * 24 * time.Hour},
+		{MaxSize: 50 << 20, TTL: 7 * 24 * time.Hour},
+		{MaxSize: 100 << 20, TTL: 24 * time.Hour},
+	}}
+	tests := []struct {
+		size int64
+		want time.Duration
+	}{
+		{0, 30 * 24 * time.Hour},
+		{1 << 20, 30 * 24 * time.Hour},
+		{1<<20 + 1, 7 * 24 * time.Hour},
+		{50 << 20, 7 * 24 * time.Hour},
+		{100 << 20, 24 * time.Hour},
+		{200 << 20, 24 * time.Hour},
+	}
+	for _, tt := range tests {
+		if got := p.TTL(tt.size, ""); got != tt.want {
+			t.Errorf("TTL(%d) = %s, want %s", tt.size, got, tt.want)
+		}
+	}
+}
+
+func TestStepPolicyEmpty(t *testing.T) {
+	var p StepPolicy
+	for _, size := range []int64{0, 1 << 20, 1 << 40} {
+		if got, want := p.TTL(size, ""), DefaultRetention().TTL(size, ""); got != want {
+			t.Errorf("TTL(%d) = %s, want the default %s", size, got, want)
+		}
+	}
+	if lines := p.Describe(); len(lines) != 0 {
+		t.Errorf("Describe = %q", lines)
+	}
+}
+
+func TestContentTypePolicy(t *testing.T) {
+	base := LinearPolicy{MinTTL: time.Hour, MaxTTL: 2 * time.Hour, MaxFileSize: 100}
+	p := ContentTypePolicy{Base: base, Overrides: []ContentTypeTTL{
+		{Pattern: "image/png", TTL: 5 * time.Hour},
+		{Pattern: "image/*", TTL: 3 * time.Hour},
+	}}
+	tests := []struct {
+		contentType string
+		want        time.Duration
+	}{
+		{"image/png", 5 * time.Hour},
+		{"IMAGE/PNG; charset=binary", 5 * time.Hour},
+		{"image/jpeg", 3 * time.Hour},
+		{"imagex/jpeg", 90 * time.Minute},
+		{"text/plain", 90 * time.Minute},
+		{"", 90 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := p.TTL(50, tt.contentType); got != tt.want {
+			t.Errorf("TTL(%q) = %s, want %s", tt.contentType, got, tt.want)
+		}
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{24 * time.Hour, "1 day"},
+		{72 * time.Hour, "3 days"},
+		{3 * time.Hour, "3 hours"},
+		{90 * time.Minute, "90 minutes"},
+		{90 * time.Second, "1m30s"},
+	}
+	for _, tt := range tests {
+		if got := describeDuration(tt.d); got != tt.want {
+			t.Errorf("describeDuration(%s) = %q, want %q", tt.d, got, tt.want)
+		}
+	}
+	sizes := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{1000, "1000 B"},
+		{1536, "1536 B"},
+		{3 << 10, "3 KiB"},
+		{1 << 20, "1 MiB"},
+		{3 << 30, "3 GiB"},
+	}
+	for _, tt := range sizes {
+		if got := describeSize(tt.n); got != tt.want {
+			t.Errorf("describeSize(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}
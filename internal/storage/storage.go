@@ -2,33 +2,15 @@ package storage
 
 import (
 	"encoding/json"
-	"math"
+	"errors"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"sync"
 	"time"
 )
 
-type RetentionConfig struct {
-	MinTTL      time.Duration
-	MaxTTL      time.Duration
-	MaxFileSize int64
-}
-
-func DefaultRetention() RetentionConfig {
-	return RetentionConfig{
-		MinTTL:      1 * time.Hour,
-		MaxTTL:      28 * 24 * time.Hour,
-		MaxFileSize: 100 * 1024 * 1024,
-	}
-}
-
-var retention = DefaultRetention()
-
-func SetRetention(cfg RetentionConfig) {
-	retention = cfg
-}
-
 type FileMetadata struct {
 	ID           string    `json:"id"`
 	OriginalName string    `json:"original_name"`
@@ -36,38 +18,62 @@ type FileMetadata struct {
 	Size         int64     `json:"size"`
 	ContentType  string    `json:"content_type"`
 	UploadedAt   time.Time `json:"uploaded_at"`
+	ExpiresAt    time.Time `json:"expires_at,omitzero"`
+	SHA256       string    `json:"sha256,omitempty"`
+	Thumbnail    bool      `json:"thumbnail,omitempty"`
+	Stripped     bool      `json:"metadata_stripped,omitempty"`
+	// Scan is the malware scan state. It is empty for files stored without
+	// a scanner, which are served as usual.
+	Scan          string `json:"scan,omitempty"`
+	ScanSignature string `json:"scan_signature,omitempty"`
+	// ScanAttempts counts scans that failed to produce a result.
+	ScanAttempts int `json:"scan_attempts,omitempty"`
 }
 
-func (f *FileMetadata) ExpiresAt() time.Time {
-	ttl := CalculateTTL(f.Size)
-	return f.UploadedAt.Add(ttl)
-}
+// Scan states of a file.
+const (
+	ScanPending  = "pending"
+	ScanClean    = "clean"
+	ScanInfected = "infected"
+	// ScanError marks a file that could not be scanned in the allowed
+	// number of attempts. It is not served.
+	ScanError = "error"
+	// ScanSkipped marks a file served without a scan because it was too
+	// large for the scanner.
+	ScanSkipped = "skipped"
+)
 
 func (f *FileMetadata) IsExpired() bool {
-	return time.Now().After(f.ExpiresAt())
+	return time.Now().After(f.ExpiresAt)
 }
 
-// TTL = MinTTL + (MaxTTL - MinTTL) * (1 - sqrt(size/maxSize))
-func CalculateTTL(size int64) time.Duration {
-	if size <= 0 {
-		return retention.MaxTTL
-	}
-	if size >= retention.MaxFileSize {
-		return retention.MinTTL
-	}
-
-	ratio := float64(size) / float64(retention.MaxFileSize)
-	factor := 1 - math.Sqrt(ratio)
-	ttlRange := float64(retention.MaxTTL - retention.MinTTL)
-	ttl := retention.MinTTL + time.Duration(factor*ttlRange)
+// expiry returns when f expires under policy p.
+func (f *FileMetadata) expiry(p RetentionPolicy) time.Time {
+	return f.UploadedAt.Add(p.TTL(f.Size, f.ContentType))
+}
 
-	return ttl
+// migrate fills in the expiry of records written before it was stored,
+// using the current policy. It reports whether anything changed.
+func migrate(data map[string]*FileMetadata) bool {
+	changed := false
+	for _, meta := range data {
+		if meta.ExpiresAt.IsZero() {
+			meta.ExpiresAt = meta.expiry(Retention())
+			changed = true
+		}
+	}
+	return changed
 }
 
+var ErrClosed = errors.New("storage: database is closed")
+
 type DB struct {
-	path string
-	mu   sync.RWMutex
-	data map[string]*FileMetadata
+	path   string
+	mu     sync.RWMutex
+	data   map[string]*FileMetadata
+	closed bool
+	// dirty is set while the file lags behind data because a save failed.
+	dirty bool
 }
 
 func Open(path string) (*DB, error) {
@@ -87,28 +93,131 @@ func Open(path string) (*DB, error) {
 		}
 		defer file.Close()
 
-		if err := json.NewDecoder(file).Decode(&db.data); err != nil {
+		// Starting over with an empty map would let the next save wipe
+		// every record, so a damaged file is an error. An empty file
+		// holds nothing to lose.
+		if err := json.NewDecoder(file).Decode(&db.data); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("decode %s: %w", path, err)
+		}
+		if db.data == nil {
 			db.data = make(map[string]*FileMetadata)
 		}
 	}
 
+	if migrate(db.data) {
+		if err := db.save(); err != nil {
+			return nil, err
+		}
+	}
 	return db, nil
 }
 
+// ReadSnapshot returns the records in the database file at path without
+// opening it for writing. The file is replaced atomically on every save,
+// so this is safe while a server is using it.
+func ReadSnapshot(path string) ([]*FileMetadata, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var data map[string]*FileMetadata
+	if err := json.NewDecoder(file).Decode(&data); err != nil {
+		return nil, err
+	}
+	migrate(data)
+	records := make([]*FileMetadata, 0, len(data))
+	for _, meta := range data {
+		records = append(records, meta)
+	}
+	return records, nil
+}
+
+// Close rejects further writes. Every change is saved as it is made, so
+// the file is only written again if the last save failed; a command that
+// only read the database leaves it untouched.
 func (d *DB) Close() error {
-	return nil
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return nil
+	}
+	var err error
+	if d.dirty {
+		err = d.save()
+	}
+	d.closed = true
+	return err
+}
+
+// Check reports whether the database is open and its file can be written.
+func (d *DB) Check() error {
+	d.mu.RLock()
+	closed := d.closed
+	d.mu.RUnlock()
+	if closed {
+		return ErrClosed
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(d.path), ".check-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	f.Close()
+	return os.Remove(name)
 }
 
 func (d *DB) save() error {
-	file, err := os.Create(d.path)
+	if d.closed {
+		return ErrClosed
+	}
+	d.dirty = true
+	if err := d.write(); err != nil {
+		return err
+	}
+	d.dirty = false
+	return nil
+}
+
+// write replaces the file with the current data. It writes to a temporary
+// file of its own and renames it over the old one, so an interrupted save
+// never leaves a truncated database behind and a second process saving at
+// the same time cannot interleave with it.
+func (d *DB) write() error {
+	file, err := os.CreateTemp(filepath.Dir(d.path), filepath.Base(d.path)+".tmp-*")
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	tmp := file.Name()
+	if err := file.Chmod(0o644); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
 
 	encoder := json.NewEncoder(file)
 	encoder.SetIndent("", "  ")
-	return encoder.Encode(d.data)
+	if err := encoder.Encode(d.data); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, d.path)
 }
 
 func (d *DB) SaveMetadata(meta *FileMetadata) error {
@@ -119,6 +228,90 @@ func (d *DB) SaveMetadata(meta *FileMetadata) error {
 	return d.save()
 }
 
+// Replace discards every record and stores records instead.
+func (d *DB) Replace(records []*FileMetadata) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.data = make(map[string]*FileMetadata, len(records))
+	for _, meta := range records {
+		d.data[meta.ID] = meta
+	}
+	return d.save()
+}
+
+// ApplyRetention recomputes the expiry of every record from its upload time
+// under policy p. Files whose new expiry has passed are removed by the next
+// cleanup. It returns how many records changed; with dryRun nothing is
+// written.
+func (d *DB) ApplyRetention(p RetentionPolicy, dryRun bool) (changed, expired int, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	updated := make(map[string]*FileMetadata, len(d.data))
+	for id, meta := range d.data {
+		expiresAt := meta.expiry(p)
+		if expiresAt.Equal(meta.ExpiresAt) {
+			updated[id] = meta
+			continue
+		}
+		changed++
+		if !meta.IsExpired() && now.After(expiresAt) {
+			expired++
+		}
+		m := *meta
+		m.ExpiresAt = expiresAt
+		updated[id] = &m
+	}
+	if dryRun || changed == 0 {
+		return changed, expired, nil
+	}
+
+	d.data = updated
+	return changed, expired, d.save()
+}
+
+// ExtendExpiry moves the expiry of the given records to the new times.
+// Records that are gone or already expire later are left alone.
+func (d *DB) ExtendExpiry(expiry map[string]time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	changed := false
+	for id, expiresAt := range expiry {
+		meta, ok := d.data[id]
+		if !ok || !expiresAt.After(meta.ExpiresAt) {
+			continue
+		}
+		updated := *meta
+		updated.ExpiresAt = expiresAt
+		d.data[id] = &updated
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return d.save()
+}
+
+// Update applies fn to a copy of the stored record and replaces it, so
+// callers still holding the previous pointer never observe a partial write.
+func (d *DB) Update(id string, fn func(meta *FileMetadata)) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	meta, ok := d.data[id]
+	if !ok {
+		return os.ErrNotExist
+	}
+
+	updated := *meta
+	fn(&updated)
+	d.data[id] = &updated
+	return d.save()
+}
+
 func (d *DB) GetMetadata(id string) (*FileMetadata, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
@@ -0,0 +1,242 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOpenReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kcst.db")
+	db, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := &FileMetadata{ID: "abc", StoredName: "abc.txt", Size: 3, UploadedAt: time.Now()}
+	if err := db.SaveMetadata(meta); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	got, err := db.GetMetadata("abc")
+	if err != nil || got.StoredName != "abc.txt" {
+		t.Errorf("GetMetadata = %+v, %v", got, err)
+	}
+	if got.ExpiresAt.IsZero() {
+		t.Error("expiry not filled in on open")
+	}
+}
+
+func TestOpenCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kcst.db")
+	data := []byte(`{"abc": {"id": "abc", "stored_name": "abc.t`)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if db, err := Open(path); err == nil {
+		db.Close()
+		t.Fatal("expected an error for a truncated database")
+	}
+	if got, _ := os.ReadFile(path); string(got) != string(data) {
+		t.Errorf("database file rewritten: %q", got)
+	}
+}
+
+func TestOpenEmptyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kcst.db")
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if files, _ := db.ListMetadata(); len(files) != 0 {
+		t.Errorf("records = %v", files)
+	}
+}
+
+func TestCloseUnchanged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kcst.db")
+	db, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SaveMetadata(&FileMetadata{ID: "abc", UploadedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another process replaced the file; closing a database with nothing
+	// unsaved must not write over it.
+	if err := os.WriteFile(path, []byte("{}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(path); string(got) != "{}\n" {
+		t.Errorf("Close rewrote the file: %q", got)
+	}
+}
+
+func TestConcurrentWriters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kcst.db")
+	var dbs []*DB
+	for range 2 {
+		db, err := Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dbs = append(dbs, db)
+	}
+
+	var wg sync.WaitGroup
+	for i, db := range dbs {
+		wg.Go(func() {
+			for j := range 50 {
+				id := fmt.Sprintf("%d-%d", i, j)
+				if err := db.SaveMetadata(&FileMetadata{ID: id, UploadedAt: time.Now()}); err != nil {
+					t.Error(err)
+				}
+			}
+		})
+	}
+	wg.Wait()
+
+	// The last writer wins, but the file is always whole.
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("database damaged by concurrent saves: %v", err)
+	}
+	db.Close()
+	if tmp, _ := filepath.Glob(path + ".tmp*"); len(tmp) != 0 {
+		t.Errorf("temporary files left behind: %v", tmp)
+	}
+}
+
+// useRetention sets the global policy for the duration of a test.
+func useRetention(t *testing.T, p RetentionPolicy) {
+	t.Helper()
+	old := Retention()
+	SetRetention(p)
+	t.Cleanup(func() { SetRetention(old) })
+}
+
+func TestMigrateExpiry(t *testing.T) {
+	useRetention(t, StepPolicy{Steps: []RetentionStep{{MaxSize: 1 << 30, TTL: time.Hour}}})
+
+	// Written before expiry was stored: only one record has it.
+	uploaded := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	kept := uploaded.Add(48 * time.Hour)
+	path := filepath.Join(t.TempDir(), "kcst.db")
+	data := fmt.Sprintf(`{
+  "old": {"id": "old", "stored_name": "old.txt", "size": 3, "uploaded_at": %q},
+  "new": {"id": "new", "stored_name": "new.txt", "size": 3, "uploaded_at": %q, "expires_at": %q}
+}`, uploaded.Format(time.RFC3339), uploaded.Format(time.RFC3339), kept.Format(time.RFC3339))
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := ReadSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, meta := range records {
+		if meta.ExpiresAt.IsZero() {
+			t.Errorf("snapshot of %s has no expiry", meta.ID)
+		}
+	}
+	if got, _ := os.ReadFile(path); string(got) != data {
+		t.Error("ReadSnapshot wrote the file")
+	}
+
+	db, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, _ := db.GetMetadata("old")
+	if want := uploaded.Add(time.Hour); !old.ExpiresAt.Equal(want) {
+		t.Errorf("backfilled expiry = %s, want %s", old.ExpiresAt, want)
+	}
+	if meta, _ := db.GetMetadata("new"); !meta.ExpiresAt.Equal(kept) {
+		t.Errorf("stored expiry changed to %s", meta.ExpiresAt)
+	}
+	db.Close()
+
+	// The backfill is saved, so a later policy change does not move it.
+	useRetention(t, StepPolicy{Steps: []RetentionStep{{MaxSize: 1 << 30, TTL: 24 * time.Hour}}})
+	db, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if meta, _ := db.GetMetadata("old"); !meta.ExpiresAt.Equal(uploaded.Add(time.Hour)) {
+		t.Errorf("expiry after reopening = %s", meta.ExpiresAt)
+	}
+}
+
+func TestApplyRetention(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kcst.db")
+	db, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	recent := &FileMetadata{ID: "recent", Size: 10, UploadedAt: now.Add(-time.Hour), ExpiresAt: now.Add(24 * time.Hour)}
+	old := &FileMetadata{ID: "old", Size: 10, UploadedAt: now.Add(-5 * time.Hour), ExpiresAt: now.Add(24 * time.Hour)}
+	for _, meta := range []*FileMetadata{recent, old} {
+		if err := db.SaveMetadata(meta); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Shorter retention: both change, and the older file is now past it.
+	p := StepPolicy{Steps: []RetentionStep{{MaxSize: 1 << 30, TTL: 3 * time.Hour}}}
+	changed, expired, err := db.ApplyRetention(p, true)
+	if err != nil || changed != 2 || expired != 1 {
+		t.Errorf("dry run = %d changed, %d expired, %v", changed, expired, err)
+	}
+	if meta, _ := db.GetMetadata("old"); meta.IsExpired() {
+		t.Error("dry run changed a record")
+	}
+
+	changed, expired, err = db.ApplyRetention(p, false)
+	if err != nil || changed != 2 || expired != 1 {
+		t.Errorf("apply = %d changed, %d expired, %v", changed, expired, err)
+	}
+	if meta, _ := db.GetMetadata("recent"); !meta.ExpiresAt.Equal(recent.UploadedAt.Add(3 * time.Hour)) {
+		t.Errorf("recent expires at %s", meta.ExpiresAt)
+	}
+	if expired, _ := db.GetExpired(); len(expired) != 1 || expired[0].ID != "old" {
+		t.Errorf("expired = %v", expired)
+	}
+	// Records handed out earlier are copies and keep their old values.
+	if !old.ExpiresAt.Equal(now.Add(24 * time.Hour)) {
+		t.Error("ApplyRetention modified a record in place")
+	}
+
+	if changed, _, err := db.ApplyRetention(p, false); err != nil || changed != 0 {
+		t.Errorf("second apply = %d changed, %v", changed, err)
+	}
+	db.Close()
+
+	db, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if meta, _ := db.GetMetadata("recent"); !meta.ExpiresAt.Equal(recent.UploadedAt.Add(3 * time.Hour)) {
+		t.Errorf("applied expiry not saved: %s", meta.ExpiresAt)
+	}
+}
@@ -95,28 +95,9 @@ const pageTemplate = `<!DOCTYPE html>
 
     <h2>Retention Policy</h2>
     <pre class="ascii-art">
-min_age  = 3 hours
-max_age  = 28 days
-max_size = 100 MiB
+{{.RetentionDiagram}}    </pre>
 
-retention = min_age + (max_age - min_age) * (1 - sqrt(size/max_size))
-
-   days
-     28 |.
-        | ..
-        |   ...
-        |      ....
-        |          .....
-        |               ......
-        |                     .......
-        |                            ........
-      1 |                                    ...............
-        +-------------------------------------------------->
-        0                    50                          100
-                                                         MiB
-    </pre>
-
-    <p>Smaller files are retained longer. A 100 MiB file lives ~3 hours, while tiny files can stay up to 28 days.</p>
+    <p>{{.RetentionSummary}}</p>
 
     <h2>Uploading Files</h2>
     <p>Send a <code>POST</code> request with <code>multipart/form-data</code> containing a <code>file</code> field.</p>
@@ -128,7 +109,15 @@ retention = min_age + (max_age - min_age) * (1 - sqrt(size/max_size))
         </tr>
         <tr>
             <td><code>file</code></td>
-            <td>The file to upload (max 100 MiB)</td>
+            <td>The file to upload (max {{.MaxFileSize}})</td>
+        </tr>
+        <tr>
+            <td><code>strip_metadata</code></td>
+            <td>Optional. <code>true</code> or <code>false</code> to remove EXIF/XMP/IPTC from JPEG, PNG and WebP images</td>
+        </tr>
+        <tr>
+            <td><code>slug</code></td>
+            <td>Optional. Custom file name such as <code>release-notes.pdf</code>, if enabled on the server</td>
         </tr>
     </table>
 
@@ -147,30 +136,12 @@ curl -F 'file=@localfile.bin;filename=custom.bin' {{.BaseURL}}</code></pre>
             <th>File Size</th>
             <th>Retention</th>
         </tr>
+{{range .RetentionExamples}}
         <tr>
-            <td>100 MiB</td>
-            <td>~3 hours</td>
-        </tr>
-        <tr>
-            <td>50 MiB</td>
-            <td>~9 days</td>
-        </tr>
-        <tr>
-            <td>25 MiB</td>
-            <td>~14 days</td>
-        </tr>
-        <tr>
-            <td>10 MiB</td>
-            <td>~19 days</td>
-        </tr>
-        <tr>
-            <td>1 MiB</td>
-            <td>~25 days</td>
-        </tr>
-        <tr>
-            <td>&lt;1 KiB</td>
-            <td>~28 days</td>
+            <td>{{.Size}}</td>
+            <td>{{.TTL}}</td>
         </tr>
+{{end}}
     </table>
 </body>
 </html>
@@ -189,22 +160,38 @@ const previewTemplate = `<!DOCTYPE html>
     <meta property="og:site_name" content="kcst">
 {{if eq .MediaType "image"}}
     <meta property="og:type" content="image">
+{{if .ThumbnailURL}}
+    <meta property="og:image" content="{{.ThumbnailURL}}">
+    <meta property="og:image:type" content="image/jpeg">
+{{else}}
     <meta property="og:image" content="{{.RawURL}}">
     <meta property="og:image:type" content="{{.ContentType}}">
+{{end}}
 {{else if eq .MediaType "video"}}
     <meta property="og:type" content="video.other">
     <meta property="og:video" content="{{.RawURL}}">
     <meta property="og:video:type" content="{{.ContentType}}">
+{{if .ThumbnailURL}}
+    <meta property="og:image" content="{{.ThumbnailURL}}">
+    <meta property="og:image:type" content="image/jpeg">
+{{end}}
+{{else if eq .MediaType "audio"}}
+    <meta property="og:type" content="music.song">
+    <meta property="og:audio" content="{{.RawURL}}">
+    <meta property="og:audio:type" content="{{.ContentType}}">
 {{else}}
     <meta property="og:type" content="website">
 {{end}}
 
 {{if eq .MediaType "image"}}
     <meta name="twitter:card" content="summary_large_image">
-    <meta name="twitter:image" content="{{.RawURL}}">
+    <meta name="twitter:image" content="{{if .ThumbnailURL}}{{.ThumbnailURL}}{{else}}{{.RawURL}}{{end}}">
 {{else if eq .MediaType "video"}}
     <meta name="twitter:card" content="player">
     <meta name="twitter:player" content="{{.RawURL}}">
+{{if .ThumbnailURL}}
+    <meta name="twitter:image" content="{{.ThumbnailURL}}">
+{{end}}
 {{else}}
     <meta name="twitter:card" content="summary">
 {{end}}
@@ -255,6 +242,32 @@ const previewTemplate = `<!DOCTYPE html>
             max-height: 500px;
             border-radius: 4px;
         }
+        .preview audio {
+            width: 100%;
+        }
+        .preview iframe {
+            width: 100%;
+            height: 700px;
+            border: 1px solid #444;
+            border-radius: 4px;
+        }
+        .listing {
+            border-collapse: collapse;
+            width: 100%;
+            text-align: left;
+        }
+        .listing th, .listing td {
+            padding: 0.25rem 0.5rem;
+            border: 1px solid #444;
+            word-break: break-all;
+        }
+        .listing th {
+            background: #2a2a2a;
+        }
+        .listing .size {
+            text-align: right;
+            white-space: nowrap;
+        }
         a {
             color: #6bf;
         }
@@ -307,11 +320,40 @@ const previewTemplate = `<!DOCTYPE html>
     </div>
 {{else if eq .MediaType "video"}}
     <div class="preview">
-        <video controls>
+        <video controls{{if .ThumbnailURL}} poster="{{.ThumbnailURL}}"{{end}}>
             <source src="{{.RawURL}}" type="{{.ContentType}}">
             Your browser does not support video playback.
         </video>
     </div>
+{{else if eq .MediaType "audio"}}
+    <div class="preview">
+        <audio controls preload="metadata">
+            <source src="{{.RawURL}}" type="{{.ContentType}}">
+            Your browser does not support audio playback.
+        </audio>
+    </div>
+{{else if eq .MediaType "pdf"}}
+    <div class="preview">
+        <iframe src="{{.RawURL}}" title="{{.OriginalName}}"></iframe>
+    </div>
+{{else if eq .MediaType "archive"}}
+    <div class="preview">
+        <table class="listing">
+            <tr>
+                <th>Name</th>
+                <th class="size">Size</th>
+            </tr>
+{{range .Entries}}
+            <tr>
+                <td>{{.Name}}</td>
+                <td class="size">{{if .IsDir}}-{{else}}{{.SizeHuman}}{{end}}</td>
+            </tr>
+{{end}}
+        </table>
+{{if .Truncated}}
+        <p>Listing truncated.</p>
+{{end}}
+    </div>
 {{end}}
 
     <div class="actions">
@@ -0,0 +1,236 @@
+package thumbnail
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	_ "image/gif"
+	_ "image/png"
+)
+
+const (
+	MaxDimension = 480
+	maxPixels    = 64 * 1024 * 1024
+	quality      = 80
+)
+
+var background = color.RGBA{0x1a, 0x1a, 0x1a, 0xff}
+
+var ErrUnsupported = errors.New("thumbnail: unsupported content type")
+
+func Supported(contentType string) bool {
+	ct := strings.ToLower(contentType)
+	switch ct {
+	case "image/jpeg", "image/png", "image/gif":
+		return true
+	}
+	if strings.HasPrefix(ct, "video/") {
+		_, err := exec.LookPath("ffmpeg")
+		return err == nil
+	}
+	return false
+}
+
+// Generate writes a JPEG thumbnail of src to dst. Images are decoded in
+// pure Go; video frames are extracted with ffmpeg when it is installed,
+// which is killed if ctx is done first. Videos in a container that is not
+// recognised from its contents are ErrUnsupported.
+func Generate(ctx context.Context, src, dst, contentType string) error {
+	ct := strings.ToLower(contentType)
+	switch {
+	case strings.HasPrefix(ct, "image/"):
+		return fromImage(src, dst)
+	case strings.HasPrefix(ct, "video/"):
+		return fromVideo(ctx, src, dst)
+	}
+	return ErrUnsupported
+}
+
+func fromImage(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	cfg, _, err := image.DecodeConfig(in)
+	if err != nil {
+		return err
+	}
+	if cfg.Width*cfg.Height > maxPixels {
+		return errors.New("thumbnail: image too large")
+	}
+	if _, err := in.Seek(0, 0); err != nil {
+		return err
+	}
+
+	img, _, err := image.Decode(in)
+	if err != nil {
+		return err
+	}
+
+	return writeJPEG(dst, resize(img, MaxDimension))
+}
+
+// fromVideo grabs the frame at one second, skipping a black or fading
+// first frame, and falls back to the first frame for shorter clips, where
+// ffmpeg succeeds without writing anything.
+func fromVideo(ctx context.Context, src, dst string) error {
+	format, err := videoFormat(src)
+	if err != nil {
+		return err
+	}
+	for _, offset := range []string{"1", "0"} {
+		if err := extractFrame(ctx, src, dst, format, offset); err != nil {
+			return err
+		}
+		if fi, err := os.Stat(dst); err == nil && fi.Size() > 0 {
+			return nil
+		}
+	}
+	os.Remove(dst)
+	return errors.New("thumbnail: ffmpeg: no frame extracted")
+}
+
+// videoFormat returns the ffmpeg demuxer for the container in src, judged
+// by its first bytes rather than the content type the uploader claimed.
+// Left to probe on its own, ffmpeg also opens playlists and concat lists,
+// which make it read other local files or fetch URLs.
+func videoFormat(src string) (string, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	head := make([]byte, 189)
+	n, _ := f.Read(head)
+	head = head[:n]
+	switch {
+	case len(head) >= 8 && string(head[4:8]) == "ftyp":
+		return "mov", nil
+	case bytes.HasPrefix(head, []byte{0x1a, 0x45, 0xdf, 0xa3}):
+		return "matroska", nil
+	case len(head) >= 12 && string(head[:4]) == "RIFF" && string(head[8:12]) == "AVI ":
+		return "avi", nil
+	case bytes.HasPrefix(head, []byte("OggS")):
+		return "ogg", nil
+	case bytes.HasPrefix(head, []byte("FLV")):
+		return "flv", nil
+	case bytes.HasPrefix(head, []byte{0x00, 0x00, 0x01, 0xba}):
+		return "mpeg", nil
+	case len(head) > 188 && head[0] == 0x47 && head[188] == 0x47:
+		return "mpegts", nil
+	}
+	return "", ErrUnsupported
+}
+
+// extractFrame runs ffmpeg with the demuxer fixed to format and only the
+// file protocol allowed, so the upload cannot point it anywhere else.
+func extractFrame(ctx context.Context, src, dst, format, offset string) error {
+	scale := "scale='min(" + strconv.Itoa(MaxDimension) + ",iw)':-2"
+	cmd := exec.CommandContext(ctx, "ffmpeg",
+		"-nostdin",
+		"-loglevel", "error",
+		"-y",
+		"-protocol_whitelist", "file",
+		"-f", format,
+		"-ss", offset,
+		"-i", "file:"+src,
+		"-frames:v", "1",
+		"-vf", scale,
+		"-f", "image2",
+		"-c:v", "mjpeg",
+		dst,
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(dst)
+		if ctx.Err() != nil {
+			return fmt.Errorf("thumbnail: ffmpeg: %w", ctx.Err())
+		}
+		return errors.New("thumbnail: ffmpeg: " + strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func writeJPEG(dst string, img image.Image) error {
+	tmp := dst + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	if err := jpeg.Encode(out, img, &jpeg.Options{Quality: quality}); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// resize scales img down so that neither side exceeds limit, averaging the
+// source pixels that fall into each destination pixel. Transparent areas are
+// flattened onto the page background since JPEG has no alpha channel. Source
+// rows are converted one destination row's band at a time, so the only
+// copy of the image held besides img is a few rows high.
+func resize(img image.Image, limit int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	dw, dh := w, h
+	if w > limit || h > limit {
+		if w > h {
+			dw, dh = limit, h*limit/w
+		} else {
+			dw, dh = w*limit/h, limit
+		}
+	}
+	dw, dh = max(dw, 1), max(dh, 1)
+
+	band := image.NewRGBA(image.Rect(0, 0, w, (h+dh-1)/dh+1))
+	out := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*h/dh, max((y+1)*h/dh, y*h/dh+1)
+		rows := image.Rect(0, 0, w, y1-y0)
+		draw.Draw(band, rows, image.NewUniform(background), image.Point{}, draw.Src)
+		draw.Draw(band, rows, img, image.Pt(b.Min.X, b.Min.Y+y0), draw.Over)
+
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*w/dw, max((x+1)*w/dw, x*w/dw+1)
+
+			var r, g, bl, a, n uint64
+			for sy := 0; sy < y1-y0; sy++ {
+				row := band.Pix[sy*band.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					r += uint64(p[0])
+					g += uint64(p[1])
+					bl += uint64(p[2])
+					a += uint64(p[3])
+					n++
+				}
+			}
+
+			i := y*out.Stride + x*4
+			out.Pix[i] = uint8(r / n)
+			out.Pix[i+1] = uint8(g / n)
+			out.Pix[i+2] = uint8(bl / n)
+			out.Pix[i+3] = uint8(a / n)
+		}
+	}
+	return out
+}
@@ -0,0 +1,259 @@
+package thumbnail
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResize(t *testing.T) {
+	tests := []struct {
+		w, h, limit int
+		wantW       int
+		wantH       int
+	}{
+		{100, 50, 480, 100, 50},
+		{960, 480, 480, 480, 240},
+		{480, 960, 480, 240, 480},
+		{5000, 1, 480, 480, 1},
+		{1, 5000, 480, 1, 480},
+	}
+	for _, tt := range tests {
+		img := image.NewRGBA(image.Rect(0, 0, tt.w, tt.h))
+		b := resize(img, tt.limit).Bounds()
+		if b.Dx() != tt.wantW || b.Dy() != tt.wantH {
+			t.Errorf("resize(%dx%d, %d) = %dx%d, want %dx%d", tt.w, tt.h, tt.limit, b.Dx(), b.Dy(), tt.wantW, tt.wantH)
+		}
+	}
+}
+
+func TestResizeAverages(t *testing.T) {
+	// Alternating black and white columns average to grey.
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for y := range 4 {
+		for x := range 4 {
+			if x%2 == 0 {
+				img.Set(x, y, color.White)
+			} else {
+				img.Set(x, y, color.Black)
+			}
+		}
+	}
+	got := resize(img, 2).(*image.RGBA).RGBAAt(0, 0)
+	if got.R != 127 || got.G != 127 || got.B != 127 || got.A != 255 {
+		t.Errorf("pixel = %v, want grey", got)
+	}
+}
+
+func TestResizeFlattensTransparency(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(10, 10, 20, 20))
+	got := resize(img, 480).(*image.RGBA).RGBAAt(0, 0)
+	if got != background {
+		t.Errorf("pixel = %v, want background %v", got, background)
+	}
+}
+
+func writePNG(t *testing.T, img image.Image) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "in.png")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, img); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestGenerateImage(t *testing.T) {
+	src := writePNG(t, image.NewRGBA(image.Rect(0, 0, 1000, 500)))
+	dst := filepath.Join(t.TempDir(), "thumb.jpg")
+	if err := Generate(context.Background(), src, dst, "image/png"); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	cfg, err := jpeg.DecodeConfig(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Width != MaxDimension || cfg.Height != MaxDimension/2 {
+		t.Errorf("thumbnail is %dx%d", cfg.Width, cfg.Height)
+	}
+}
+
+func TestGenerateTooLarge(t *testing.T) {
+	// Rewrite the IHDR of a small PNG to claim it is 10000x10000.
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1)))
+	data := buf.Bytes()
+	ihdr := data[12 : 12+4+13]
+	binary.BigEndian.PutUint32(ihdr[4:], 10000)
+	binary.BigEndian.PutUint32(ihdr[8:], 10000)
+	binary.BigEndian.PutUint32(data[12+4+13:], crc32.ChecksumIEEE(ihdr))
+
+	src := filepath.Join(t.TempDir(), "big.png")
+	os.WriteFile(src, data, 0o644)
+	dst := filepath.Join(t.TempDir(), "thumb.jpg")
+	if err := Generate(context.Background(), src, dst, "image/png"); err == nil {
+		t.Fatal("expected an error for an oversized image")
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Error("thumbnail written for an oversized image")
+	}
+}
+
+func TestGenerateUnsupported(t *testing.T) {
+	err := Generate(context.Background(), "x", "y", "application/pdf")
+	if !errors.Is(err, ErrUnsupported) {
+		t.Errorf("err = %v, want ErrUnsupported", err)
+	}
+}
+
+// fakeFFmpeg puts a shell script named ffmpeg first in PATH.
+func fakeFFmpeg(t *testing.T, script string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a POSIX shell")
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "ffmpeg"), []byte("#!/bin/sh\n"+script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// writeVideo writes a file that starts like an MP4 container.
+func writeVideo(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "clip.mp4")
+	if err := os.WriteFile(path, []byte("\x00\x00\x00\x20ftypisom\x00\x00\x02\x00"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestVideoFormat(t *testing.T) {
+	ts := make([]byte, 376)
+	ts[0], ts[188] = 0x47, 0x47
+	tests := []struct {
+		head string
+		want string
+	}{
+		{"\x00\x00\x00\x18ftypmp42", "mov"},
+		{"\x1a\x45\xdf\xa3\x01", "matroska"},
+		{"RIFF\x00\x00\x00\x00AVI LIST", "avi"},
+		{"OggS\x00\x02", "ogg"},
+		{"FLV\x01\x05", "flv"},
+		{"\x00\x00\x01\xba\x44", "mpeg"},
+		{string(ts), "mpegts"},
+		// Playlists and concat lists make ffmpeg open other inputs.
+		{"#EXTM3U\n#EXT-X-TARGETDURATION:1\nhttp://10.0.0.1/x.ts\n", ""},
+		{"ffconcat version 1.0\nfile /etc/passwd\n", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "video")
+		if err := os.WriteFile(path, []byte(tt.head), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := videoFormat(path)
+		if got != tt.want || (tt.want == "") != errors.Is(err, ErrUnsupported) {
+			t.Errorf("videoFormat(%q) = %q, %v; want %q", tt.head, got, err, tt.want)
+		}
+	}
+}
+
+func TestGenerateVideoArgs(t *testing.T) {
+	// Record the arguments instead of running ffmpeg.
+	args := filepath.Join(t.TempDir(), "args")
+	fakeFFmpeg(t, `
+for a; do echo "$a"; last=$a; done > `+args+`
+echo frame > "$last"
+`)
+	src := writeVideo(t)
+	if err := Generate(context.Background(), src, filepath.Join(t.TempDir(), "thumb.jpg"), "video/mp4"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(data)
+	for _, want := range []string{"-protocol_whitelist\nfile\n", "-f\nmov\n", "-i\nfile:" + src + "\n"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("ffmpeg arguments %q lack %q", got, want)
+		}
+	}
+}
+
+func TestGeneratePlaylist(t *testing.T) {
+	fakeFFmpeg(t, "echo ran >&2; exit 1\n")
+	src := filepath.Join(t.TempDir(), "clip.mp4")
+	if err := os.WriteFile(src, []byte("#EXTM3U\nhttp://169.254.169.254/latest\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	err := Generate(context.Background(), src, filepath.Join(t.TempDir(), "thumb.jpg"), "video/mp4")
+	if !errors.Is(err, ErrUnsupported) {
+		t.Errorf("err = %v, want ErrUnsupported without running ffmpeg", err)
+	}
+}
+
+func TestGenerateShortVideo(t *testing.T) {
+	// Like ffmpeg on a clip shorter than a second, write nothing for
+	// -ss 1 but still succeed.
+	fakeFFmpeg(t, `
+prev=
+for a; do [ "$prev" = -ss ] && ss=$a; prev=$a; last=$a; done
+[ "$ss" = 0 ] && echo frame > "$last"
+exit 0
+`)
+	dst := filepath.Join(t.TempDir(), "thumb.jpg")
+	if err := Generate(context.Background(), writeVideo(t), dst, "video/mp4"); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(dst); string(data) != "frame\n" {
+		t.Errorf("thumbnail = %q", data)
+	}
+}
+
+func TestGenerateNoFrame(t *testing.T) {
+	fakeFFmpeg(t, "exit 0\n")
+	dst := filepath.Join(t.TempDir(), "thumb.jpg")
+	if err := Generate(context.Background(), writeVideo(t), dst, "video/mp4"); err == nil {
+		t.Fatal("expected an error when no frame is written")
+	}
+}
+
+func TestGenerateVideoTimeout(t *testing.T) {
+	fakeFFmpeg(t, "exec sleep 10\n")
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := Generate(ctx, writeVideo(t), filepath.Join(t.TempDir(), "thumb.jpg"), "video/mp4")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want deadline exceeded", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("ffmpeg was not killed at the deadline")
+	}
+}
@@ -0,0 +1,80 @@
+package upload
+
+import (
+	"time"
+
+	"github.com/keircn/kcst/internal/storage"
+)
+
+// accessFlushInterval is how often extended expiry times are written to
+// the database, so a popular file costs one write per interval rather than
+// one per download.
+const accessFlushInterval = time.Minute
+
+type accessExtension struct {
+	by     time.Duration
+	maxAge time.Duration
+}
+
+// SetAccessExtension keeps files alive while they are used: each download
+// pushes the expiry to at least by from now, but never past maxAge after
+// the upload. A zero by turns this off.
+func (s *Store) SetAccessExtension(by, maxAge time.Duration) {
+	s.extension.Store(&accessExtension{by: by, maxAge: maxAge})
+}
+
+// Touch records a successful download of meta.
+func (s *Store) Touch(meta *storage.FileMetadata) {
+	ext := s.extension.Load()
+	if ext == nil || ext.by <= 0 {
+		return
+	}
+
+	expiresAt := time.Now().Add(ext.by)
+	if limit := meta.UploadedAt.Add(ext.maxAge); expiresAt.After(limit) {
+		expiresAt = limit
+	}
+
+	s.accessMu.Lock()
+	defer s.accessMu.Unlock()
+
+	if expiresAt.After(s.expiresAt(meta)) {
+		s.accessed[meta.ID] = expiresAt
+	}
+}
+
+// ExpiresAt returns when meta expires, including extensions from recent
+// downloads that have not been written to the database yet.
+func (s *Store) ExpiresAt(meta *storage.FileMetadata) time.Time {
+	s.accessMu.Lock()
+	defer s.accessMu.Unlock()
+
+	return s.expiresAt(meta)
+}
+
+func (s *Store) expiresAt(meta *storage.FileMetadata) time.Time {
+	if t, ok := s.accessed[meta.ID]; ok && t.After(meta.ExpiresAt) {
+		return t
+	}
+	return meta.ExpiresAt
+}
+
+func (s *Store) isExpired(meta *storage.FileMetadata) bool {
+	return time.Now().After(s.ExpiresAt(meta))
+}
+
+// FlushAccess writes pending expiry extensions to the database. The lock
+// is held throughout so a file never looks expired between the two.
+func (s *Store) FlushAccess() error {
+	s.accessMu.Lock()
+	defer s.accessMu.Unlock()
+
+	if len(s.accessed) == 0 {
+		return nil
+	}
+	if err := s.db.ExtendExpiry(s.accessed); err != nil {
+		return err
+	}
+	clear(s.accessed)
+	return nil
+}
@@ -0,0 +1,60 @@
+package upload
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTouch(t *testing.T) {
+	s := newTestStore(t)
+	meta := importFile(t, s, "data")
+	base := meta.ExpiresAt
+
+	s.Touch(meta)
+	if got := s.ExpiresAt(meta); !got.Equal(base) {
+		t.Errorf("expiry changed without an extension: %s", got)
+	}
+
+	s.SetAccessExtension(1000*time.Hour, 2000*time.Hour)
+	s.Touch(meta)
+	got := s.ExpiresAt(meta)
+	if want := time.Now().Add(1000 * time.Hour); got.Before(want.Add(-time.Minute)) || got.After(want) {
+		t.Errorf("extended expiry = %s, want about %s", got, want)
+	}
+	if stored, _ := s.db.GetMetadata(meta.ID); !stored.ExpiresAt.Equal(base) {
+		t.Error("extension written before the flush")
+	}
+
+	if err := s.FlushAccess(); err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := s.db.GetMetadata(meta.ID)
+	if !stored.ExpiresAt.Equal(got) {
+		t.Errorf("stored expiry = %s, want %s", stored.ExpiresAt, got)
+	}
+}
+
+func TestTouchMaxAge(t *testing.T) {
+	s := newTestStore(t)
+	meta := importFile(t, s, "data")
+	s.SetAccessExtension(1000*time.Hour, 2000*time.Hour)
+	meta.UploadedAt = time.Now().Add(-1500 * time.Hour)
+	meta.ExpiresAt = time.Now().Add(time.Hour)
+
+	s.Touch(meta)
+	if got, want := s.ExpiresAt(meta), meta.UploadedAt.Add(2000*time.Hour); !got.Equal(want) {
+		t.Errorf("expiry = %s, want the cap %s", got, want)
+	}
+}
+
+func TestTouchNeverShortens(t *testing.T) {
+	s := newTestStore(t)
+	meta := importFile(t, s, "data")
+	meta.ExpiresAt = time.Now().Add(5000 * time.Hour)
+	s.SetAccessExtension(time.Hour, 10000*time.Hour)
+
+	s.Touch(meta)
+	if got := s.ExpiresAt(meta); !got.Equal(meta.ExpiresAt) {
+		t.Errorf("expiry = %s, want %s", got, meta.ExpiresAt)
+	}
+}
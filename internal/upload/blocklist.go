@@ -0,0 +1,146 @@
+package upload
+
+import (
+	"errors"
+	"log"
+	"os"
+
+	"github.com/keircn/kcst/internal/audit"
+	"github.com/keircn/kcst/internal/blocklist"
+	"github.com/keircn/kcst/internal/events"
+	"github.com/keircn/kcst/internal/storage"
+)
+
+var ErrBlocked = errors.New("content is blocked")
+
+// SetBlocklist rejects uploads whose SHA-256 is on bl and records every
+// block in auditLog. Call it before the store is used.
+func (s *Store) SetBlocklist(bl *blocklist.List, auditLog *audit.Log) {
+	s.blocklist = bl
+	s.auditLog = auditLog
+}
+
+func (s *Store) Blocklist() *blocklist.List {
+	return s.blocklist
+}
+
+// blocked returns the blocklist entry matching any of hashes.
+func (s *Store) blocked(hashes ...string) (*blocklist.Entry, bool) {
+	if s.blocklist == nil {
+		return nil, false
+	}
+	for _, hash := range hashes {
+		if e, ok := s.blocklist.Contains(hash); ok {
+			return e, true
+		}
+	}
+	return nil, false
+}
+
+// Block adds hashes to the blocklist and removes stored and trashed files
+// with matching content for good. actor is recorded in the audit log. It
+// returns how many hashes were new and the files that were removed.
+func (s *Store) Block(hashes []string, reason, actor string) (int, []*storage.FileMetadata, error) {
+	// Keep Cleanup from trashing or purging the files being removed.
+	s.cleanupMu.Lock()
+	defer s.cleanupMu.Unlock()
+
+	added, err := s.blocklist.Add(hashes, reason)
+	if err != nil {
+		return 0, nil, err
+	}
+	for _, hash := range added {
+		s.audit(audit.Entry{Action: audit.BlocklistAdd, Hash: hash, Actor: actor, Detail: reason})
+	}
+
+	removed, err := s.removeBlocked(actor)
+	return len(added), removed, err
+}
+
+// ReloadBlocklist rereads the blocklist file, which `kcst blocklist`
+// changes without touching the database, and removes stored and trashed
+// copies of blocked content.
+func (s *Store) ReloadBlocklist() ([]*storage.FileMetadata, error) {
+	if s.blocklist == nil {
+		return nil, nil
+	}
+
+	s.cleanupMu.Lock()
+	defer s.cleanupMu.Unlock()
+
+	if _, err := s.blocklist.Reload(); err != nil {
+		return nil, err
+	}
+	return s.removeBlocked("reload")
+}
+
+// RemoveBlocked removes stored and trashed copies of blocked content. The
+// server calls it on start to catch up with blocks added while it was
+// down.
+func (s *Store) RemoveBlocked() ([]*storage.FileMetadata, error) {
+	if s.blocklist == nil {
+		return nil, nil
+	}
+
+	s.cleanupMu.Lock()
+	defer s.cleanupMu.Unlock()
+
+	return s.removeBlocked("reload")
+}
+
+// removeBlocked deletes stored and trashed files whose content is on the
+// blocklist. The caller must hold s.cleanupMu.
+func (s *Store) removeBlocked(actor string) ([]*storage.FileMetadata, error) {
+	files, err := s.db.ListMetadata()
+	if err != nil {
+		return nil, err
+	}
+	var removed []*storage.FileMetadata
+	for _, meta := range files {
+		entry, ok := s.blocked(meta.SHA256)
+		if !ok {
+			continue
+		}
+		if err := s.Delete(meta); err != nil {
+			log.Printf("Failed to remove blocked file %s: %v", meta.StoredName, err)
+			continue
+		}
+		removed = append(removed, meta)
+		s.publish(events.FileDeleted, meta)
+		s.audit(audit.Entry{Action: audit.FileRemoved, Hash: meta.SHA256, File: meta.StoredName, Actor: actor, Detail: entry.Reason})
+	}
+
+	trashed, err := s.TrashList()
+	if err != nil {
+		return removed, err
+	}
+	for _, e := range trashed {
+		if _, ok := s.blocked(e.Metadata.SHA256); !ok {
+			continue
+		}
+		if err := os.RemoveAll(s.trashPath(e.Metadata.ID)); err != nil {
+			log.Printf("Failed to purge blocked file %s from the trash: %v", e.Metadata.StoredName, err)
+			continue
+		}
+		s.audit(audit.Entry{Action: audit.FileRemoved, Hash: e.Metadata.SHA256, File: e.Metadata.StoredName, Actor: actor, Detail: "from trash"})
+	}
+	return removed, nil
+}
+
+// Unblock removes hash from the blocklist and reports whether it was on it.
+func (s *Store) Unblock(hash, actor string) (bool, error) {
+	ok, err := s.blocklist.Remove(hash)
+	if ok {
+		s.audit(audit.Entry{Action: audit.BlocklistRemove, Hash: hash, Actor: actor})
+	}
+	return ok, err
+}
+
+func (s *Store) audit(e audit.Entry) {
+	if s.auditLog == nil {
+		return
+	}
+	if err := s.auditLog.Record(e); err != nil {
+		log.Printf("Failed to write audit log: %v", err)
+	}
+}
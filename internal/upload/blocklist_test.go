@@ -0,0 +1,215 @@
+package upload
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/keircn/kcst/internal/audit"
+	"github.com/keircn/kcst/internal/blocklist"
+)
+
+func hashOf(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func withBlocklist(t *testing.T, s *Store) string {
+	t.Helper()
+	dir := t.TempDir()
+	bl, err := blocklist.Open(filepath.Join(dir, "blocklist.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetBlocklist(bl, audit.New(filepath.Join(dir, "audit.log")))
+	return filepath.Join(dir, "blocklist.json")
+}
+
+func dirNames(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	return names
+}
+
+func TestUploadBlocked(t *testing.T) {
+	s := newTestStore(t)
+	withBlocklist(t, s)
+	if _, _, err := s.Block([]string{hashOf("bad")}, "test", "cli"); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "in.txt")
+	if err := os.WriteFile(path, []byte("bad"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Import(path, Options{Slug: "takedown"}); !errors.Is(err, ErrBlocked) {
+		t.Fatalf("Import: err = %v, want ErrBlocked", err)
+	}
+	// Neither the final file nor the temporary one is left behind, and the
+	// slug is free again.
+	if names := dirNames(t, s.dir); len(names) != 0 {
+		t.Errorf("upload directory holds %v", names)
+	}
+	if len(s.pending) != 0 {
+		t.Errorf("pending = %v", s.pending)
+	}
+
+	meta := importFile(t, s, "fine")
+	if names := dirNames(t, s.dir); len(names) != 1 || names[0] != meta.StoredName {
+		t.Errorf("upload directory holds %v, want %s", names, meta.StoredName)
+	}
+}
+
+func TestBlockRemovesCopies(t *testing.T) {
+	s := newTestStore(t)
+	withBlocklist(t, s)
+
+	stored := importFile(t, s, "bad")
+	trashed := importFile(t, s, "bad")
+	kept := importFile(t, s, "fine")
+	if err := s.Trash(trashed, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	added, removed, err := s.Block([]string{hashOf("bad")}, "DMCA", "cli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 1 || len(removed) != 1 || removed[0].ID != stored.ID {
+		t.Errorf("Block = %d, %v", added, removed)
+	}
+	if _, err := os.Stat(s.Path(stored)); !os.IsNotExist(err) {
+		t.Errorf("blocked file still on disk: %v", err)
+	}
+	if meta, _ := s.db.GetMetadata(stored.ID); meta != nil {
+		t.Error("blocked file still recorded")
+	}
+	if entries, err := s.TrashList(); err != nil || len(entries) != 0 {
+		t.Errorf("trash = %v, %v", entries, err)
+	}
+	if meta, _ := s.db.GetMetadata(kept.ID); meta == nil {
+		t.Error("unrelated file removed")
+	}
+}
+
+func TestReloadBlocklist(t *testing.T) {
+	s := newTestStore(t)
+	path := withBlocklist(t, s)
+	meta := importFile(t, s, "bad")
+
+	// kcst blocklist add edits the file behind the server's back.
+	other, err := blocklist.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Add([]string{hashOf("bad")}, "cli"); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := s.ReloadBlocklist()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0].ID != meta.ID {
+		t.Errorf("ReloadBlocklist removed %v", removed)
+	}
+	if _, ok := s.blocked(hashOf("bad")); !ok {
+		t.Error("reloaded hash is not blocked")
+	}
+
+	// Nothing new on the next reload.
+	if removed, err := s.ReloadBlocklist(); err != nil || len(removed) != 0 {
+		t.Errorf("second reload = %v, %v", removed, err)
+	}
+}
+
+func TestFsckIncomplete(t *testing.T) {
+	s := newTestStore(t)
+	stale := filepath.Join(s.dir, tempPrefix+"deadbeef")
+	if err := os.WriteFile(stale, []byte("partial"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := s.Fsck(FsckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := problems(report)[tempPrefix+"deadbeef"]; got != ProblemIncomplete {
+		t.Errorf("problem = %q, want %q", got, ProblemIncomplete)
+	}
+
+	if _, err := s.Fsck(FsckOptions{Repair: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("unfinished upload not removed: %v", err)
+	}
+}
+
+// gatedReader blocks its first read until released, holding an upload
+// between reserving its name and storing it.
+type gatedReader struct {
+	r       *strings.Reader
+	started chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (r *gatedReader) Read(p []byte) (int, error) {
+	r.once.Do(func() {
+		close(r.started)
+		<-r.release
+	})
+	return r.r.Read(p)
+}
+
+func (r *gatedReader) Seek(offset int64, whence int) (int64, error) {
+	return r.r.Seek(offset, whence)
+}
+
+func TestSaveDoesNotReplace(t *testing.T) {
+	s := newTestStore(t)
+	r := &gatedReader{
+		r:       strings.NewReader("upload"),
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		_, _, err := s.save(r, "in.txt", "text/plain", Options{Slug: "taken.txt"})
+		errc <- err
+	}()
+	<-r.started
+
+	// Something else creates the file while the upload is written.
+	path := filepath.Join(s.dir, "taken.txt")
+	if err := os.WriteFile(path, []byte("existing"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	close(r.release)
+
+	if err := <-errc; !errors.Is(err, ErrSlugTaken) {
+		t.Errorf("save: err = %v, want ErrSlugTaken", err)
+	}
+	if got, _ := os.ReadFile(path); string(got) != "existing" {
+		t.Errorf("existing file replaced with %q", got)
+	}
+	if names := dirNames(t, s.dir); len(names) != 1 {
+		t.Errorf("upload directory holds %v", names)
+	}
+}
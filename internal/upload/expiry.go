@@ -0,0 +1,150 @@
+package upload
+
+import (
+	"container/heap"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/keircn/kcst/internal/metrics"
+	"github.com/keircn/kcst/internal/storage"
+)
+
+// expiryQueue orders file IDs by expiry time so the cleanup routine can
+// sleep until exactly the next one is due. Entries can be stale: a file
+// may have been deleted or had its expiry extended since it was queued,
+// so each one is checked against the database when it comes up.
+type expiryQueue struct {
+	mu      sync.Mutex
+	entries expiryHeap
+	// wake is signalled when an entry is pushed ahead of the current head.
+	wake chan struct{}
+}
+
+type expiryEntry struct {
+	id        string
+	expiresAt time.Time
+}
+
+type expiryHeap []expiryEntry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expiresAt.Before(h[j].expiresAt) }
+func (h expiryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *expiryHeap) Push(x any)        { *h = append(*h, x.(expiryEntry)) }
+func (h *expiryHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+func newExpiryQueue() *expiryQueue {
+	return &expiryQueue{wake: make(chan struct{}, 1)}
+}
+
+func (q *expiryQueue) push(id string, expiresAt time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	first := len(q.entries) == 0 || expiresAt.Before(q.entries[0].expiresAt)
+	heap.Push(&q.entries, expiryEntry{id: id, expiresAt: expiresAt})
+	if first {
+		select {
+		case q.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// reset replaces the queue with the given records.
+func (q *expiryQueue) reset(files []*storage.FileMetadata) {
+	entries := make(expiryHeap, 0, len(files))
+	for _, meta := range files {
+		entries = append(entries, expiryEntry{id: meta.ID, expiresAt: meta.ExpiresAt})
+	}
+	heap.Init(&entries)
+
+	q.mu.Lock()
+	q.entries = entries
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next returns when the earliest entry is due and whether there is one.
+func (q *expiryQueue) next() (time.Time, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.entries) == 0 {
+		return time.Time{}, false
+	}
+	return q.entries[0].expiresAt, true
+}
+
+// due removes and returns the IDs of all entries due by now.
+func (q *expiryQueue) due(now time.Time) []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var ids []string
+	for len(q.entries) > 0 && !q.entries[0].expiresAt.After(now) {
+		ids = append(ids, heap.Pop(&q.entries).(expiryEntry).id)
+	}
+	return ids
+}
+
+// Reschedule rebuilds the expiry queue from the database. Call it after
+// expiry times were changed outside the store, such as by re-applying the
+// retention policy.
+func (s *Store) Reschedule() error {
+	files, err := s.db.ListMetadata()
+	if err != nil {
+		return err
+	}
+	s.expiry.reset(files)
+	return nil
+}
+
+// expireDue deletes the queued files whose expiry has passed and requeues
+// those that were extended in the meantime.
+func (s *Store) expireDue() {
+	s.cleanupMu.Lock()
+	defer s.cleanupMu.Unlock()
+
+	now := time.Now()
+	for _, id := range s.expiry.due(now) {
+		meta, err := s.db.GetMetadata(id)
+		if err != nil || meta == nil {
+			continue
+		}
+		if expiresAt := s.ExpiresAt(meta); expiresAt.After(now) {
+			s.expiry.push(id, expiresAt)
+			continue
+		}
+
+		if err := s.Trash(meta, TrashExpired); err != nil {
+			log.Printf("Failed to remove expired file %s: %v", meta.StoredName, err)
+			continue
+		}
+		metrics.CleanupRemoved.Add(1)
+		log.Printf("Cleaned up expired file: %s (size: %d, uploaded: %s)",
+			meta.StoredName, meta.Size, meta.UploadedAt.Format(time.RFC3339))
+	}
+}
+
+// expiryTimer returns a channel that fires when the next queued file is
+// due, or nil if nothing is queued.
+func (s *Store) expiryTimer(timer *time.Timer) <-chan time.Time {
+	next, ok := s.expiry.next()
+	if !ok {
+		timer.Stop()
+		return nil
+	}
+	timer.Reset(time.Until(next))
+	return timer.C
+}
@@ -0,0 +1,82 @@
+package upload
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/keircn/kcst/internal/storage"
+)
+
+func TestExpiryQueue(t *testing.T) {
+	q := newExpiryQueue()
+	now := time.Now()
+	if _, ok := q.next(); ok {
+		t.Error("empty queue has a next entry")
+	}
+
+	q.push("b", now.Add(2*time.Minute))
+	<-q.wake
+	q.push("c", now.Add(3*time.Minute))
+	select {
+	case <-q.wake:
+		t.Error("woken by an entry behind the head")
+	default:
+	}
+	q.push("a", now.Add(time.Minute))
+	select {
+	case <-q.wake:
+	default:
+		t.Error("not woken by a new head")
+	}
+
+	if next, _ := q.next(); !next.Equal(now.Add(time.Minute)) {
+		t.Errorf("next = %s", next)
+	}
+	if ids := q.due(now); len(ids) != 0 {
+		t.Errorf("due before any expiry: %v", ids)
+	}
+	ids := q.due(now.Add(2 * time.Minute))
+	if len(ids) != 2 || ids[0] != "a" || ids[1] != "b" {
+		t.Errorf("due = %v, want [a b]", ids)
+	}
+
+	q.reset([]*storage.FileMetadata{{ID: "x", ExpiresAt: now}})
+	if ids := q.due(now); len(ids) != 1 || ids[0] != "x" {
+		t.Errorf("due after reset = %v", ids)
+	}
+}
+
+func TestExpireDue(t *testing.T) {
+	s := newTestStore(t)
+	expired := importFile(t, s, "old")
+	extended := importFile(t, s, "popular")
+	kept := importFile(t, s, "new")
+
+	past := time.Now().Add(-time.Minute)
+	for _, meta := range []*storage.FileMetadata{expired, extended} {
+		s.db.Update(meta.ID, func(m *storage.FileMetadata) { m.ExpiresAt = past })
+	}
+	s.accessed[extended.ID] = time.Now().Add(time.Hour)
+	if err := s.Reschedule(); err != nil {
+		t.Fatal(err)
+	}
+
+	s.expireDue()
+
+	if meta, _ := s.db.GetMetadata(expired.ID); meta != nil {
+		t.Error("expired record kept")
+	}
+	if _, err := os.Stat(s.Path(expired)); !os.IsNotExist(err) {
+		t.Error("expired blob kept")
+	}
+	for _, meta := range []*storage.FileMetadata{extended, kept} {
+		if m, _ := s.db.GetMetadata(meta.ID); m == nil {
+			t.Errorf("%s removed", meta.StoredName)
+		}
+	}
+	// The extended file is queued again for its new expiry.
+	if next, _ := s.expiry.next(); !next.Equal(s.accessed[extended.ID]) {
+		t.Errorf("next expiry = %s, want the extension", next)
+	}
+}
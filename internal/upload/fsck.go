@@ -0,0 +1,261 @@
+package upload
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/keircn/kcst/internal/storage"
+)
+
+const quarantineDir = ".quarantine"
+
+// ErrNoRecords is returned by a repair that would treat every stored file
+// as an orphan because the database is empty.
+var ErrNoRecords = errors.New("the database has no records but the upload directory has files; refusing to repair")
+
+// Kinds of inconsistency reported by Fsck.
+const (
+	ProblemOrphan           = "orphan"            // blob without metadata
+	ProblemMissing          = "missing"           // metadata without blob
+	ProblemSize             = "size"              // blob size differs from metadata
+	ProblemHash             = "hash"              // blob contents differ from the recorded hash
+	ProblemOrphanThumbnail  = "orphan-thumbnail"  // thumbnail without metadata
+	ProblemMissingThumbnail = "missing-thumbnail" // metadata claims a thumbnail that is gone
+	ProblemIncomplete       = "incomplete"        // upload left unfinished by a crash
+)
+
+type FsckOptions struct {
+	// Repair fixes what is found instead of only reporting it.
+	Repair bool
+	// DeleteOrphans removes orphaned and corrupt blobs instead of moving
+	// them to the quarantine directory.
+	DeleteOrphans bool
+	// VerifyHashes reads every blob that has a recorded hash and compares
+	// it. This reads all stored data.
+	VerifyHashes bool
+	// Force repairs even when the database is empty but files exist.
+	Force bool
+}
+
+type Problem struct {
+	Kind     string
+	Name     string
+	Detail   string
+	Repaired bool
+}
+
+func (p Problem) String() string {
+	s := fmt.Sprintf("%s: %s", p.Kind, p.Name)
+	if p.Detail != "" {
+		s += " (" + p.Detail + ")"
+	}
+	if p.Repaired {
+		s += " [repaired]"
+	}
+	return s
+}
+
+type FsckReport struct {
+	Files    int
+	Blobs    int
+	Problems []Problem
+}
+
+// Fsck compares the upload directory with the metadata database. Blobs of
+// uploads still being written are not reported. Repairs move orphaned and
+// corrupt blobs into the quarantine directory (or delete them), drop
+// records whose blob is gone and remove stray thumbnails and unfinished
+// uploads.
+func (s *Store) Fsck(opts FsckOptions) (*FsckReport, error) {
+	files, err := s.db.ListMetadata()
+	if err != nil {
+		return nil, err
+	}
+	report := &FsckReport{Files: len(files)}
+
+	byName := make(map[string]*storage.FileMetadata, len(files))
+	byID := make(map[string]*storage.FileMetadata, len(files))
+	for _, meta := range files {
+		byName[meta.StoredName] = meta
+		byID[meta.ID] = meta
+	}
+
+	s.mu.Lock()
+	pending := make(map[string]bool, len(s.pending))
+	for id, name := range s.pending {
+		pending[name] = true
+		pending[id] = true
+	}
+	s.mu.Unlock()
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var orphans, incomplete []string
+	for _, e := range entries {
+		name := e.Name()
+		if id, ok := strings.CutPrefix(name, tempPrefix); ok && !e.IsDir() && !pending[id] {
+			incomplete = append(incomplete, name)
+			continue
+		}
+		if e.IsDir() || strings.HasPrefix(name, ".") || pending[name] {
+			continue
+		}
+		report.Blobs++
+		if byName[name] == nil {
+			orphans = append(orphans, name)
+		}
+	}
+
+	// An empty database next to stored files is more likely a wrong or
+	// lost database path than a directory full of orphans.
+	if opts.Repair && !opts.Force && len(files) == 0 && report.Blobs > 0 {
+		return nil, fmt.Errorf("%w (%d files in %s)", ErrNoRecords, report.Blobs, s.dir)
+	}
+
+	for _, name := range orphans {
+		p := Problem{Kind: ProblemOrphan, Name: name}
+		if opts.Repair {
+			p.Repaired = s.discard(name, opts.DeleteOrphans)
+		}
+		report.Problems = append(report.Problems, p)
+	}
+
+	// Unfinished uploads never passed the blocklist, so they are not kept.
+	for _, name := range incomplete {
+		p := Problem{Kind: ProblemIncomplete, Name: name}
+		if opts.Repair {
+			p.Repaired = s.discard(name, true)
+		}
+		report.Problems = append(report.Problems, p)
+	}
+
+	for _, meta := range files {
+		// Infected content is quarantined or deleted on purpose.
+		if pending[meta.ID] || meta.Scan == storage.ScanInfected {
+			continue
+		}
+		if p, ok := s.checkBlob(meta, opts); ok {
+			report.Problems = append(report.Problems, p)
+			continue
+		}
+		if meta.Thumbnail {
+			if _, err := os.Stat(s.thumbnailPath(meta.ID)); os.IsNotExist(err) {
+				p := Problem{Kind: ProblemMissingThumbnail, Name: meta.StoredName}
+				if opts.Repair {
+					p.Repaired = s.db.Update(meta.ID, func(m *storage.FileMetadata) {
+						m.Thumbnail = false
+					}) == nil
+				}
+				report.Problems = append(report.Problems, p)
+			}
+		}
+	}
+
+	thumbs, err := os.ReadDir(filepath.Join(s.dir, thumbDir))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, e := range thumbs {
+		id := strings.TrimSuffix(e.Name(), ".jpg")
+		if e.IsDir() || pending[id] || byID[id] != nil {
+			continue
+		}
+		p := Problem{Kind: ProblemOrphanThumbnail, Name: filepath.Join(thumbDir, e.Name())}
+		if opts.Repair {
+			p.Repaired = os.Remove(filepath.Join(s.dir, thumbDir, e.Name())) == nil
+		}
+		report.Problems = append(report.Problems, p)
+	}
+
+	return report, nil
+}
+
+// checkBlob reports a problem with the blob for meta, repairing it if
+// requested. The boolean is false when the blob is fine.
+func (s *Store) checkBlob(meta *storage.FileMetadata, opts FsckOptions) (Problem, bool) {
+	info, err := os.Stat(s.Path(meta))
+	if os.IsNotExist(err) {
+		p := Problem{Kind: ProblemMissing, Name: meta.StoredName}
+		if opts.Repair {
+			p.Repaired = s.Delete(meta) == nil
+		}
+		return p, true
+	}
+	if err != nil {
+		return Problem{Kind: ProblemMissing, Name: meta.StoredName, Detail: err.Error()}, true
+	}
+
+	var p Problem
+	switch {
+	case info.Size() != meta.Size:
+		p = Problem{Kind: ProblemSize, Name: meta.StoredName,
+			Detail: fmt.Sprintf("%d bytes on disk, %d recorded", info.Size(), meta.Size)}
+	case opts.VerifyHashes && meta.SHA256 != "":
+		sum, err := hashFile(s.Path(meta))
+		if err != nil {
+			return Problem{Kind: ProblemHash, Name: meta.StoredName, Detail: err.Error()}, true
+		}
+		if sum == meta.SHA256 {
+			return Problem{}, false
+		}
+		p = Problem{Kind: ProblemHash, Name: meta.StoredName, Detail: "sha256 " + sum}
+	default:
+		return Problem{}, false
+	}
+
+	if opts.Repair && s.discard(meta.StoredName, opts.DeleteOrphans) {
+		p.Repaired = s.Delete(meta) == nil
+	}
+	return p, true
+}
+
+// discard deletes a blob or moves it into the quarantine directory.
+func (s *Store) discard(name string, remove bool) bool {
+	src := filepath.Join(s.dir, name)
+	if remove {
+		if err := os.Remove(src); err != nil {
+			log.Printf("Failed to remove %s: %v", src, err)
+			return false
+		}
+		return true
+	}
+
+	dir := filepath.Join(s.dir, quarantineDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		log.Printf("Failed to create quarantine directory: %v", err)
+		return false
+	}
+	dst := filepath.Join(dir, name)
+	if _, err := os.Lstat(dst); err == nil {
+		dst = filepath.Join(dir, fmt.Sprintf("%s.%d", name, time.Now().Unix()))
+	}
+	if err := os.Rename(src, dst); err != nil {
+		log.Printf("Failed to quarantine %s: %v", src, err)
+		return false
+	}
+	return true
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,144 @@
+package upload
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/keircn/kcst/internal/storage"
+)
+
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+	dir := t.TempDir()
+	db, err := storage.Open(filepath.Join(dir, "kcst.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	s, err := NewStore(filepath.Join(dir, "uploads"), db, time.Hour, IDGenerator{Alphabet: AlphabetHex, Length: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Wait)
+	return s
+}
+
+// importFile stores a file with the given content through Import.
+func importFile(t *testing.T, s *Store, content string) *storage.FileMetadata {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "in.txt")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, meta, err := s.Import(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return meta
+}
+
+func problems(r *FsckReport) map[string]string {
+	m := make(map[string]string)
+	for _, p := range r.Problems {
+		m[p.Name] = p.Kind
+	}
+	return m
+}
+
+func TestFsck(t *testing.T) {
+	s := newTestStore(t)
+	ok := importFile(t, s, "fine")
+	missing := importFile(t, s, "gone")
+	resized := importFile(t, s, "short")
+	corrupt := importFile(t, s, "right")
+
+	os.Remove(s.Path(missing))
+	os.WriteFile(s.Path(resized), []byte("longer now"), 0o644)
+	os.WriteFile(s.Path(corrupt), []byte("wrong"), 0o644)
+	os.WriteFile(filepath.Join(s.dir, "stray.bin"), []byte("x"), 0o644)
+	os.WriteFile(s.thumbnailPath("nobody"), []byte("x"), 0o644)
+
+	report, err := s.Fsck(FsckOptions{VerifyHashes: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		missing.StoredName:   ProblemMissing,
+		resized.StoredName:   ProblemSize,
+		corrupt.StoredName:   ProblemHash,
+		"stray.bin":          ProblemOrphan,
+		".thumbs/nobody.jpg": ProblemOrphanThumbnail,
+	}
+	got := problems(report)
+	for name, kind := range want {
+		if got[name] != kind {
+			t.Errorf("%s: problem %q, want %q", name, got[name], kind)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("problems = %v", report.Problems)
+	}
+	if report.Files != 4 || report.Blobs != 4 {
+		t.Errorf("report counts %d records, %d files", report.Files, report.Blobs)
+	}
+
+	report, err = s.Fsck(FsckOptions{Repair: true, VerifyHashes: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range report.Problems {
+		if !p.Repaired {
+			t.Errorf("not repaired: %s", p)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(s.dir, quarantineDir, "stray.bin")); err != nil {
+		t.Errorf("orphan not quarantined: %v", err)
+	}
+
+	report, err = s.Fsck(FsckOptions{VerifyHashes: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 0 {
+		t.Errorf("problems after repair: %v", report.Problems)
+	}
+	if report.Files != 1 || report.Blobs != 1 {
+		t.Errorf("after repair: %d records, %d files", report.Files, report.Blobs)
+	}
+	if _, err := os.Stat(s.Path(ok)); err != nil {
+		t.Errorf("healthy file touched: %v", err)
+	}
+}
+
+func TestFsckEmptyDatabase(t *testing.T) {
+	s := newTestStore(t)
+	for _, name := range []string{"a.txt", "b.txt"} {
+		os.WriteFile(filepath.Join(s.dir, name), []byte("x"), 0o644)
+	}
+
+	if _, err := s.Fsck(FsckOptions{Repair: true}); !errors.Is(err, ErrNoRecords) {
+		t.Fatalf("err = %v, want ErrNoRecords", err)
+	}
+	if _, err := os.Stat(filepath.Join(s.dir, "a.txt")); err != nil {
+		t.Errorf("file moved by a refused repair: %v", err)
+	}
+
+	report, err := s.Fsck(FsckOptions{})
+	if err != nil || len(report.Problems) != 2 {
+		t.Errorf("report without repair = %v, %v", report, err)
+	}
+
+	report, err = s.Fsck(FsckOptions{Repair: true, Force: true, DeleteOrphans: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 2 {
+		t.Errorf("problems = %v", report.Problems)
+	}
+	if _, err := os.Stat(filepath.Join(s.dir, "a.txt")); !os.IsNotExist(err) {
+		t.Error("forced repair left the orphan")
+	}
+}
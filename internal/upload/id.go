@@ -0,0 +1,101 @@
+package upload
+
+import (
+	"crypto/rand"
+	"math/big"
+	"strings"
+)
+
+const (
+	AlphabetHex    = "hex"
+	AlphabetBase62 = "base62"
+	AlphabetWords  = "words"
+)
+
+const (
+	hexChars    = "0123456789abcdef"
+	base62Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+// IDGenerator produces random file IDs. For the words alphabet, Length is
+// the number of words joined with '-'; otherwise it is the number of
+// characters.
+type IDGenerator struct {
+	Alphabet string
+	Length   int
+}
+
+func (g IDGenerator) Generate() (string, error) {
+	switch g.Alphabet {
+	case AlphabetWords:
+		parts := make([]string, g.Length)
+		for i := range parts {
+			list := nouns
+			if i < g.Length-1 {
+				list = adjectives
+			}
+			n, err := randInt(len(list))
+			if err != nil {
+				return "", err
+			}
+			parts[i] = list[n]
+		}
+		return strings.Join(parts, "-"), nil
+	case AlphabetBase62:
+		return randString(base62Chars, g.Length)
+	default:
+		return randString(hexChars, g.Length)
+	}
+}
+
+func randString(chars string, length int) (string, error) {
+	b := make([]byte, length)
+	for i := range b {
+		n, err := randInt(len(chars))
+		if err != nil {
+			return "", err
+		}
+		b[i] = chars[n]
+	}
+	return string(b), nil
+}
+
+func randInt(max int) (int, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(max)))
+	if err != nil {
+		return 0, err
+	}
+	return int(n.Int64()), nil
+}
+
+var adjectives = []string{
+	"able", "amber", "ancient", "autumn", "bold", "brave", "bright", "brisk",
+	"calm", "clever", "cold", "cool", "crimson", "crisp", "damp", "dark",
+	"dawn", "deep", "dry", "dusty", "eager", "early", "empty", "fancy",
+	"fast", "fierce", "flat", "fresh", "gentle", "giant", "glad", "golden",
+	"grand", "green", "happy", "hidden", "hollow", "honest", "icy", "jolly",
+	"keen", "kind", "late", "lazy", "light", "little", "lively", "lone",
+	"loud", "lucky", "mellow", "misty", "modest", "muddy", "narrow", "neat",
+	"noble", "odd", "old", "pale", "patient", "plain", "polite", "proud",
+	"quick", "quiet", "rapid", "rare", "red", "rough", "round", "royal",
+	"rusty", "sharp", "shiny", "short", "shy", "silent", "silver", "simple",
+	"sleepy", "slow", "small", "smooth", "snowy", "soft", "solid", "spare",
+	"steady", "still", "stormy", "sunny", "swift", "tall", "tame", "tidy",
+	"tiny", "vast", "warm", "wild", "windy", "wise", "young", "zesty",
+}
+
+var nouns = []string{
+	"acorn", "anchor", "apple", "arrow", "badger", "banjo", "barn", "beacon",
+	"bear", "bell", "birch", "bison", "boat", "breeze", "brook", "cabin",
+	"canyon", "castle", "cedar", "cloud", "comet", "coral", "crane", "creek",
+	"dune", "eagle", "ember", "falcon", "fern", "field", "finch", "flame",
+	"forest", "fox", "garden", "glacier", "grove", "harbor", "hawk", "heron",
+	"hill", "island", "ivy", "jaguar", "kettle", "lake", "lantern", "leaf",
+	"lemon", "lily", "lynx", "maple", "meadow", "moon", "moose", "moss",
+	"mountain", "oak", "ocean", "orchid", "otter", "owl", "panda", "pebble",
+	"pine", "planet", "pond", "poppy", "prairie", "quartz", "rabbit", "raven",
+	"reef", "river", "robin", "rock", "sail", "salmon", "shore", "sparrow",
+	"spruce", "star", "stone", "storm", "summit", "sun", "swan", "thistle",
+	"thunder", "tiger", "trail", "tulip", "valley", "violet", "walrus", "wave",
+	"willow", "wolf", "wren", "yak", "zebra", "zephyr",
+}
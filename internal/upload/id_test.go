@@ -0,0 +1,134 @@
+package upload
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/keircn/kcst/internal/storage"
+)
+
+func TestGenerate(t *testing.T) {
+	tests := []struct {
+		gen   IDGenerator
+		valid func(string) bool
+	}{
+		{IDGenerator{Alphabet: AlphabetHex, Length: 12}, func(id string) bool {
+			return len(id) == 12 && strings.Trim(id, hexChars) == ""
+		}},
+		{IDGenerator{Alphabet: AlphabetBase62, Length: 6}, func(id string) bool {
+			return len(id) == 6 && strings.Trim(id, base62Chars) == ""
+		}},
+		{IDGenerator{Alphabet: AlphabetWords, Length: 3}, func(id string) bool {
+			parts := strings.Split(id, "-")
+			return len(parts) == 3 && slices.Contains(adjectives, parts[0]) &&
+				slices.Contains(adjectives, parts[1]) && slices.Contains(nouns, parts[2])
+		}},
+	}
+	for _, tt := range tests {
+		id, err := tt.gen.Generate()
+		if err != nil || !tt.valid(id) {
+			t.Errorf("%+v: Generate = %q, %v", tt.gen, id, err)
+		}
+	}
+}
+
+// tinyIDs leaves only the 16 one-character hex IDs, so collisions are
+// certain.
+func tinyIDs(s *Store) {
+	s.SetIDGenerator(IDGenerator{Alphabet: AlphabetHex, Length: 1})
+}
+
+func TestIDCollisionRetry(t *testing.T) {
+	s := newTestStore(t)
+	tinyIDs(s)
+
+	// Half the ID space: later uploads keep drawing taken IDs and must
+	// retry rather than fail or reuse one.
+	seen := make(map[string]bool)
+	for range 8 {
+		meta := importFile(t, s, "x")
+		if seen[meta.ID] {
+			t.Fatalf("ID %s handed out twice", meta.ID)
+		}
+		seen[meta.ID] = true
+	}
+}
+
+func TestIDExhausted(t *testing.T) {
+	s := newTestStore(t)
+	tinyIDs(s)
+	for _, c := range hexChars {
+		id := string(c)
+		if err := s.db.SaveMetadata(&storage.FileMetadata{ID: id, StoredName: id + ".txt", UploadedAt: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "in.txt")
+	if err := os.WriteFile(path, []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Import(path, Options{}); !errors.Is(err, ErrNoFreeID) {
+		t.Errorf("Import: err = %v, want ErrNoFreeID", err)
+	}
+}
+
+func TestNoOverwrite(t *testing.T) {
+	s := newTestStore(t)
+	tinyIDs(s)
+
+	// Files the database does not know about, such as restored or
+	// hand-placed ones, still block their names.
+	for _, c := range hexChars {
+		if err := os.WriteFile(filepath.Join(s.dir, string(c)+".txt"), []byte("keep"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "in.txt")
+	if err := os.WriteFile(path, []byte("new"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Import(path, Options{}); !errors.Is(err, ErrNoFreeID) {
+		t.Errorf("Import: err = %v, want ErrNoFreeID", err)
+	}
+	if _, _, err := s.Import(path, Options{Slug: "a.txt"}); !errors.Is(err, ErrSlugTaken) {
+		t.Errorf("Import with a slug: err = %v, want ErrSlugTaken", err)
+	}
+	for _, c := range hexChars {
+		if data, _ := os.ReadFile(filepath.Join(s.dir, string(c)+".txt")); string(data) != "keep" {
+			t.Errorf("%c.txt overwritten with %q", c, data)
+		}
+	}
+}
+
+func TestSlugReserved(t *testing.T) {
+	s := newTestStore(t)
+	r := &gatedReader{
+		r:       strings.NewReader("first"),
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	errc := make(chan error, 1)
+	go func() {
+		_, _, err := s.save(r, "a.txt", "text/plain", Options{Slug: "same"})
+		errc <- err
+	}()
+	<-r.started
+
+	// The first upload has not reached the database yet.
+	if _, _, err := s.save(strings.NewReader("second"), "b.txt", "text/plain", Options{Slug: "same"}); !errors.Is(err, ErrSlugTaken) {
+		t.Errorf("second upload: err = %v, want ErrSlugTaken", err)
+	}
+	close(r.release)
+	if err := <-errc; err != nil {
+		t.Fatalf("first upload: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(s.dir, "same")); string(data) != "first" {
+		t.Errorf("stored %q", data)
+	}
+}
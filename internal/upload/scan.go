@@ -0,0 +1,227 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/keircn/kcst/internal/events"
+	"github.com/keircn/kcst/internal/scan"
+	"github.com/keircn/kcst/internal/storage"
+)
+
+// maxConcurrentScans bounds how many files are scanned at once.
+const maxConcurrentScans = 4
+
+// What happens to a file the scanner refuses for its size.
+const (
+	OversizeSkip   = "skip"   // serve it unscanned
+	OversizeReject = "reject" // remove it
+	OversizeFlag   = "flag"   // mark it as a scan error at once
+)
+
+// What happens to the contents of an infected file. Its record stays so
+// that it keeps answering as infected until it expires.
+const (
+	InfectedQuarantine = "quarantine" // move it to the quarantine directory
+	InfectedDelete     = "delete"
+)
+
+var (
+	ErrScanPending = errors.New("file has not been scanned yet")
+	ErrInfected    = errors.New("file is infected")
+	ErrScanFailed  = errors.New("file could not be scanned")
+)
+
+// SetScanner makes new uploads wait for sc to find them clean before they
+// are served. Each scan may take up to timeout; a file that fails to scan
+// maxAttempts times is marked as an error. Call it before the store is
+// used.
+func (s *Store) SetScanner(sc scan.Scanner, timeout time.Duration, maxAttempts int) {
+	s.scanner = sc
+	s.scanTimeout = timeout
+	s.scanMaxAttempts = maxAttempts
+	s.scanOversize = OversizeFlag
+	s.scanInfected = InfectedQuarantine
+	s.scanSlots = make(chan struct{}, maxConcurrentScans)
+	s.scanning = make(map[string]bool)
+}
+
+// SetScanActions sets what happens to files too large for the scanner and
+// to infected files. See the Oversize and Infected constants.
+func (s *Store) SetScanActions(oversize, infected string) {
+	s.scanOversize = oversize
+	s.scanInfected = infected
+}
+
+// checkScan returns why meta may not be served yet, if it may not.
+func checkScan(meta *storage.FileMetadata) error {
+	switch meta.Scan {
+	case storage.ScanPending:
+		return ErrScanPending
+	case storage.ScanInfected:
+		return ErrInfected
+	case storage.ScanError:
+		return ErrScanFailed
+	}
+	return nil
+}
+
+// ScanPending starts scanning every file still waiting for a result, such
+// as those whose scan failed or was interrupted by a restart.
+func (s *Store) ScanPending() error {
+	if s.scanner == nil {
+		return nil
+	}
+	files, err := s.db.ListMetadata()
+	if err != nil {
+		return err
+	}
+	for _, meta := range files {
+		if meta.Scan == storage.ScanPending {
+			s.startScan(meta)
+		}
+	}
+	return nil
+}
+
+// startScan scans meta in the background unless a scan of it is already
+// running.
+func (s *Store) startScan(meta *storage.FileMetadata) {
+	s.scanMu.Lock()
+	if s.scanning[meta.ID] {
+		s.scanMu.Unlock()
+		return
+	}
+	s.scanning[meta.ID] = true
+	s.scanMu.Unlock()
+
+	s.wg.Go(func() {
+		defer func() {
+			s.scanMu.Lock()
+			delete(s.scanning, meta.ID)
+			s.scanMu.Unlock()
+		}()
+
+		select {
+		case s.scanSlots <- struct{}{}:
+		case <-s.ctx.Done():
+			return
+		}
+		defer func() { <-s.scanSlots }()
+		s.scanFile(meta)
+	})
+}
+
+func (s *Store) scanFile(meta *storage.FileMetadata) {
+	ctx, cancel := context.WithTimeout(s.ctx, s.scanTimeout)
+	defer cancel()
+
+	res, err := s.scanner.Scan(ctx, s.Path(meta))
+	if err != nil && s.ctx.Err() != nil {
+		// Shutting down: the file stays pending for the next start.
+		return
+	}
+	if errors.Is(err, scan.ErrTooLarge) {
+		s.scanOversized(meta, err)
+		return
+	}
+	if err != nil {
+		s.scanFailed(meta, err)
+		return
+	}
+
+	state := storage.ScanClean
+	if res.Infected {
+		state = storage.ScanInfected
+		log.Printf("Blocked infected upload %s: %s", meta.StoredName, res.Signature)
+	}
+	if err := s.db.Update(meta.ID, func(m *storage.FileMetadata) {
+		m.Scan = state
+		m.ScanSignature = res.Signature
+	}); err != nil {
+		log.Printf("Failed to record scan result for %s: %v", meta.StoredName, err)
+		return
+	}
+	if state == storage.ScanInfected {
+		s.removeInfected(meta)
+		return
+	}
+	s.announce(meta.ID)
+}
+
+// announce publishes a file that may now be served and thumbnails it.
+func (s *Store) announce(id string) {
+	if updated, _ := s.db.GetMetadata(id); updated != nil {
+		s.publish(events.FileUploaded, updated)
+		s.startThumbnail(updated)
+	}
+}
+
+// removeInfected takes the contents of an infected file out of the upload
+// directory.
+func (s *Store) removeInfected(meta *storage.FileMetadata) {
+	if s.scanInfected == InfectedDelete {
+		if err := os.Remove(s.Path(meta)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove infected file %s: %v", meta.StoredName, err)
+		}
+		return
+	}
+	if s.discard(meta.StoredName, false) {
+		log.Printf("Moved infected file %s to %s", meta.StoredName, filepath.Join(s.dir, quarantineDir))
+	}
+}
+
+// scanOversized handles a file the scanner refused for its size.
+func (s *Store) scanOversized(meta *storage.FileMetadata, err error) {
+	switch s.scanOversize {
+	case OversizeSkip:
+		if uerr := s.db.Update(meta.ID, func(m *storage.FileMetadata) {
+			m.Scan = storage.ScanSkipped
+		}); uerr != nil {
+			log.Printf("Failed to record skipped scan for %s: %v", meta.StoredName, uerr)
+			return
+		}
+		log.Printf("Serving %s unscanned: %v", meta.StoredName, err)
+		s.announce(meta.ID)
+	case OversizeReject:
+		if derr := s.Delete(meta); derr != nil {
+			log.Printf("Failed to remove %s: %v", meta.StoredName, derr)
+			return
+		}
+		log.Printf("Removed %s: %v", meta.StoredName, err)
+	default:
+		if uerr := s.db.Update(meta.ID, func(m *storage.FileMetadata) {
+			m.Scan = storage.ScanError
+		}); uerr != nil {
+			log.Printf("Failed to record scan error for %s: %v", meta.StoredName, uerr)
+			return
+		}
+		log.Printf("Cannot scan %s: %v", meta.StoredName, err)
+	}
+}
+
+// scanFailed counts a failed scan. The file stays pending and is retried
+// by the next cleanup until it runs out of attempts.
+func (s *Store) scanFailed(meta *storage.FileMetadata, err error) {
+	var attempts int
+	if uerr := s.db.Update(meta.ID, func(m *storage.FileMetadata) {
+		m.ScanAttempts++
+		attempts = m.ScanAttempts
+		if m.ScanAttempts >= s.scanMaxAttempts {
+			m.Scan = storage.ScanError
+		}
+	}); uerr != nil {
+		log.Printf("Failed to scan %s: %v", meta.StoredName, err)
+		log.Printf("Failed to record scan attempt for %s: %v", meta.StoredName, uerr)
+		return
+	}
+	if attempts >= s.scanMaxAttempts {
+		log.Printf("Giving up on scanning %s after %d attempts: %v", meta.StoredName, attempts, err)
+		return
+	}
+	log.Printf("Failed to scan %s (attempt %d of %d): %v", meta.StoredName, attempts, s.scanMaxAttempts, err)
+}
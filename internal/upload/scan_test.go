@@ -0,0 +1,323 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/keircn/kcst/internal/events"
+	"github.com/keircn/kcst/internal/scan"
+	"github.com/keircn/kcst/internal/storage"
+)
+
+// scannerFunc adapts a function to scan.Scanner.
+type scannerFunc func(ctx context.Context, path string) (scan.Result, error)
+
+func (f scannerFunc) Scan(ctx context.Context, path string) (scan.Result, error) {
+	return f(ctx, path)
+}
+
+// recorder collects published events.
+type recorder struct {
+	mu     sync.Mutex
+	events []events.Type
+	files  []*storage.FileMetadata
+}
+
+func (r *recorder) Publish(t events.Type, meta *storage.FileMetadata) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, t)
+	r.files = append(r.files, meta)
+}
+
+func (r *recorder) published() []events.Type {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]events.Type(nil), r.events...)
+}
+
+func scanState(t *testing.T, s *Store, id string) *storage.FileMetadata {
+	t.Helper()
+	meta, err := s.db.GetMetadata(id)
+	if err != nil || meta == nil {
+		t.Fatalf("record %s: %v", id, err)
+	}
+	return meta
+}
+
+func TestScanClean(t *testing.T) {
+	s := newTestStore(t)
+	rec := &recorder{}
+	s.SetPublisher(rec)
+	release := make(chan struct{})
+	s.SetScanner(scannerFunc(func(ctx context.Context, path string) (scan.Result, error) {
+		<-release
+		return scan.Result{}, nil
+	}), time.Minute, 3)
+
+	meta := importFile(t, s, "clean")
+	if meta.Scan != storage.ScanPending {
+		t.Errorf("new upload scan state = %q, want pending", meta.Scan)
+	}
+	if _, _, err := s.Get(meta.StoredName); !errors.Is(err, ErrScanPending) {
+		t.Errorf("Get while scanning: err = %v", err)
+	}
+	if got := rec.published(); len(got) != 0 {
+		t.Errorf("events before the scan finished: %v", got)
+	}
+
+	close(release)
+	s.Wait()
+	if got := scanState(t, s, meta.ID).Scan; got != storage.ScanClean {
+		t.Errorf("scan state = %q, want clean", got)
+	}
+	f, _, err := s.Get(meta.StoredName)
+	if err != nil {
+		t.Fatalf("Get after a clean scan: %v", err)
+	}
+	f.Close()
+	if got := rec.published(); len(got) != 1 || got[0] != events.FileUploaded || rec.files[0].Scan != storage.ScanClean {
+		t.Errorf("events = %v", got)
+	}
+}
+
+func TestScanInfected(t *testing.T) {
+	s := newTestStore(t)
+	rec := &recorder{}
+	s.SetPublisher(rec)
+	s.SetScanner(scannerFunc(func(context.Context, string) (scan.Result, error) {
+		return scan.Result{Infected: true, Signature: "Eicar"}, nil
+	}), time.Minute, 3)
+
+	meta := importFile(t, s, "bad")
+	s.Wait()
+	got := scanState(t, s, meta.ID)
+	if got.Scan != storage.ScanInfected || got.ScanSignature != "Eicar" {
+		t.Errorf("record = %+v", got)
+	}
+	if _, _, err := s.Get(meta.StoredName); !errors.Is(err, ErrInfected) {
+		t.Errorf("Get: err = %v, want ErrInfected", err)
+	}
+	if ev := rec.published(); len(ev) != 0 {
+		t.Errorf("events for an infected upload: %v", ev)
+	}
+	// The contents leave the upload directory for the quarantine.
+	if _, err := os.Stat(s.Path(meta)); !os.IsNotExist(err) {
+		t.Errorf("infected file still stored: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(s.dir, quarantineDir, meta.StoredName)); string(data) != "bad" {
+		t.Errorf("quarantined copy = %q", data)
+	}
+	if report, err := s.Fsck(FsckOptions{}); err != nil || len(report.Problems) != 0 {
+		t.Errorf("fsck after quarantine = %+v, %v", report, err)
+	}
+}
+
+func TestScanInfectedDelete(t *testing.T) {
+	s := newTestStore(t)
+	s.SetScanner(scannerFunc(func(context.Context, string) (scan.Result, error) {
+		return scan.Result{Infected: true, Signature: "Eicar"}, nil
+	}), time.Minute, 3)
+	s.SetScanActions(OversizeFlag, InfectedDelete)
+
+	meta := importFile(t, s, "bad")
+	s.Wait()
+	if _, err := os.Stat(s.Path(meta)); !os.IsNotExist(err) {
+		t.Errorf("infected file still stored: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(s.dir, quarantineDir)); !os.IsNotExist(err) {
+		t.Errorf("quarantine used in delete mode: %v", err)
+	}
+	if _, _, err := s.Get(meta.StoredName); !errors.Is(err, ErrInfected) {
+		t.Errorf("Get: err = %v, want ErrInfected", err)
+	}
+}
+
+func TestScanOversize(t *testing.T) {
+	tooLarge := scannerFunc(func(context.Context, string) (scan.Result, error) {
+		return scan.Result{}, fmt.Errorf("clamd: INSTREAM size limit exceeded. ERROR: %w", scan.ErrTooLarge)
+	})
+
+	t.Run("skip", func(t *testing.T) {
+		s := newTestStore(t)
+		rec := &recorder{}
+		s.SetPublisher(rec)
+		s.SetScanner(tooLarge, time.Minute, 3)
+		s.SetScanActions(OversizeSkip, InfectedQuarantine)
+
+		meta := importFile(t, s, "big")
+		s.Wait()
+		if got := scanState(t, s, meta.ID).Scan; got != storage.ScanSkipped {
+			t.Errorf("scan state = %q, want skipped", got)
+		}
+		f, _, err := s.Get(meta.StoredName)
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		f.Close()
+		if got := rec.published(); len(got) != 1 || got[0] != events.FileUploaded {
+			t.Errorf("events = %v", got)
+		}
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		s := newTestStore(t)
+		s.SetScanner(tooLarge, time.Minute, 3)
+		s.SetScanActions(OversizeReject, InfectedQuarantine)
+
+		meta := importFile(t, s, "big")
+		s.Wait()
+		if got, _ := s.db.GetMetadata(meta.ID); got != nil {
+			t.Errorf("rejected file still recorded: %+v", got)
+		}
+		if _, err := os.Stat(s.Path(meta)); !os.IsNotExist(err) {
+			t.Errorf("rejected file still stored: %v", err)
+		}
+	})
+
+	t.Run("flag", func(t *testing.T) {
+		s := newTestStore(t)
+		s.SetScanner(tooLarge, time.Minute, 3)
+
+		meta := importFile(t, s, "big")
+		s.Wait()
+		// No retries: the size will not change.
+		if got := scanState(t, s, meta.ID); got.Scan != storage.ScanError || got.ScanAttempts != 0 {
+			t.Errorf("record = %+v", got)
+		}
+		if _, _, err := s.Get(meta.StoredName); !errors.Is(err, ErrScanFailed) {
+			t.Errorf("Get: err = %v, want ErrScanFailed", err)
+		}
+	})
+}
+
+func TestScanAttempts(t *testing.T) {
+	s := newTestStore(t)
+	var mu sync.Mutex
+	calls := 0
+	s.SetScanner(scannerFunc(func(context.Context, string) (scan.Result, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		return scan.Result{}, errors.New("clamd unreachable")
+	}), time.Minute, 3)
+
+	meta := importFile(t, s, "data")
+	s.Wait()
+	if got := scanState(t, s, meta.ID); got.Scan != storage.ScanPending || got.ScanAttempts != 1 {
+		t.Fatalf("after one failure: %+v", got)
+	}
+
+	for range 2 {
+		if err := s.ScanPending(); err != nil {
+			t.Fatal(err)
+		}
+		s.Wait()
+	}
+	got := scanState(t, s, meta.ID)
+	if got.Scan != storage.ScanError || got.ScanAttempts != 3 {
+		t.Errorf("after three failures: %+v", got)
+	}
+	if _, _, err := s.Get(meta.StoredName); !errors.Is(err, ErrScanFailed) {
+		t.Errorf("Get: err = %v, want ErrScanFailed", err)
+	}
+
+	// Files in the error state are not retried.
+	s.ScanPending()
+	s.Wait()
+	if calls != 3 {
+		t.Errorf("scanner called %d times, want 3", calls)
+	}
+}
+
+func TestScanStop(t *testing.T) {
+	s := newTestStore(t)
+	started := make(chan struct{}, maxConcurrentScans+2)
+	s.SetScanner(scannerFunc(func(ctx context.Context, path string) (scan.Result, error) {
+		started <- struct{}{}
+		<-ctx.Done()
+		return scan.Result{}, ctx.Err()
+	}), time.Hour, 3)
+
+	// More uploads than scan slots, so some scans are still queued.
+	var files []*storage.FileMetadata
+	for i := range maxConcurrentScans + 2 {
+		files = append(files, importFile(t, s, string(rune('a'+i))))
+	}
+	for range maxConcurrentScans {
+		<-started
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.Stop()
+		s.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait did not return after Stop")
+	}
+	for _, meta := range files {
+		if got := scanState(t, s, meta.ID); got.Scan != storage.ScanPending || got.ScanAttempts != 0 {
+			t.Errorf("%s after shutdown: %+v", meta.StoredName, got)
+		}
+	}
+}
+
+func TestNoScanner(t *testing.T) {
+	s := newTestStore(t)
+	rec := &recorder{}
+	s.SetPublisher(rec)
+	meta := importFile(t, s, "plain")
+	if meta.Scan != "" {
+		t.Errorf("scan state without a scanner = %q", meta.Scan)
+	}
+	if got := rec.published(); len(got) != 1 || got[0] != events.FileUploaded {
+		t.Errorf("events = %v", got)
+	}
+}
+
+func TestThumbnailAfterScan(t *testing.T) {
+	s := newTestStore(t)
+	release := make(chan struct{})
+	s.SetScanner(scannerFunc(func(ctx context.Context, path string) (scan.Result, error) {
+		<-release
+		return scan.Result{}, nil
+	}), time.Minute, 3)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "in.png")
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, meta, err := s.Import(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing reads the upload but the scanner until it is found clean.
+	time.Sleep(50 * time.Millisecond)
+	if _, err := os.Stat(s.thumbnailPath(meta.ID)); !os.IsNotExist(err) {
+		t.Errorf("thumbnail made before the scan finished: %v", err)
+	}
+
+	close(release)
+	s.Wait()
+	if !scanState(t, s, meta.ID).Thumbnail {
+		t.Error("no thumbnail after a clean scan")
+	}
+}
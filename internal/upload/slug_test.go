@@ -0,0 +1,46 @@
+package upload
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateSlug(t *testing.T) {
+	tests := []struct {
+		slug string
+		ok   bool
+	}{
+		{"holiday", true},
+		{"Holiday-2024_v2.tar.gz", true},
+		{"a", true},
+		{strings.Repeat("x", maxSlugLength), true},
+		{"", false},
+		{strings.Repeat("x", maxSlugLength+1), false},
+		{".hidden", false},
+		{"a..b", false},
+		{"../etc", false},
+		{"dir/name", false},
+		{`dir\name`, false},
+		{"with space", false},
+		{"ünïcode", false},
+		{"name?x=1", false},
+		// Names that would shadow a route, in any case or with an
+		// extension.
+		{"f", false},
+		{"T", false},
+		{"admin", false},
+		{"healthz.json", false},
+		{"metrics.txt", false},
+		{"fa", true},
+	}
+	for _, tt := range tests {
+		err := ValidateSlug(tt.slug)
+		if tt.ok && err != nil {
+			t.Errorf("ValidateSlug(%q) = %v, want nil", tt.slug, err)
+		}
+		if !tt.ok && !errors.Is(err, ErrInvalidSlug) {
+			t.Errorf("ValidateSlug(%q) = %v, want ErrInvalidSlug", tt.slug, err)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package upload
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/keircn/kcst/internal/events"
+	"github.com/keircn/kcst/internal/storage"
+)
+
+// The trash holds removed files until their grace period passes. Each one
+// gets a directory named after its ID with the blob, the thumbnail and its
+// metadata, so the trash can be listed and restored without the database.
+const (
+	trashDir       = ".trash"
+	trashBlob      = "blob"
+	trashThumbnail = "thumb.jpg"
+	trashEntryName = "meta.json"
+)
+
+// Reasons a file was moved to the trash.
+const (
+	TrashExpired = "expired"
+	TrashDeleted = "deleted"
+)
+
+var (
+	ErrNotInTrash = errors.New("no such file in the trash")
+	ErrNameInUse  = errors.New("a file with this id or name already exists")
+)
+
+type TrashEntry struct {
+	Metadata  *storage.FileMetadata `json:"metadata"`
+	Reason    string                `json:"reason"`
+	TrashedAt time.Time             `json:"trashed_at"`
+	PurgeAt   time.Time             `json:"purge_at"`
+}
+
+// SetTrashPeriod sets how long removed files are kept in the trash. Zero
+// deletes them immediately.
+func (s *Store) SetTrashPeriod(d time.Duration) {
+	s.trashPeriod.Store(int64(d))
+}
+
+func (s *Store) trashPath(id string) string {
+	return filepath.Join(s.dir, trashDir, id)
+}
+
+// Trash removes a file like Delete, but keeps it restorable in the trash
+// if a trash period is set.
+func (s *Store) Trash(meta *storage.FileMetadata, reason string) error {
+	if err := s.trash(meta, reason); err != nil {
+		return err
+	}
+
+	t := events.FileDeleted
+	if reason == TrashExpired {
+		t = events.FileExpired
+	}
+	s.publish(t, meta)
+	return nil
+}
+
+func (s *Store) trash(meta *storage.FileMetadata, reason string) error {
+	period := time.Duration(s.trashPeriod.Load())
+	if period <= 0 {
+		return s.Delete(meta)
+	}
+
+	// A slug can be reused, so an older file with the same ID may still
+	// be in the trash. The newer one wins.
+	dir := s.trashPath(meta.ID)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	entry := &TrashEntry{
+		Metadata:  meta,
+		Reason:    reason,
+		TrashedAt: now,
+		PurgeAt:   now.Add(period),
+	}
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, trashEntryName), data, 0o644); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+
+	if err := os.Rename(s.Path(meta), filepath.Join(dir, trashBlob)); err != nil {
+		os.RemoveAll(dir)
+		if !os.IsNotExist(err) {
+			return err
+		}
+		// Nothing left to keep.
+		return s.Delete(meta)
+	}
+	if meta.Thumbnail {
+		if err := os.Rename(s.thumbnailPath(meta.ID), filepath.Join(dir, trashThumbnail)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to move thumbnail for %s to the trash: %v", meta.StoredName, err)
+		}
+	}
+
+	return s.db.DeleteMetadata(meta.ID)
+}
+
+// TrashList returns the files in the trash, most recently removed first.
+func (s *Store) TrashList() ([]*TrashEntry, error) {
+	dirs, err := os.ReadDir(filepath.Join(s.dir, trashDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*TrashEntry, 0, len(dirs))
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(s.dir, trashDir, d.Name(), trashEntryName))
+		if err != nil {
+			log.Printf("Skipping trash entry %s: %v", d.Name(), err)
+			continue
+		}
+		var entry TrashEntry
+		if err := json.Unmarshal(data, &entry); err != nil || entry.Metadata == nil {
+			log.Printf("Skipping trash entry %s: invalid %s", d.Name(), trashEntryName)
+			continue
+		}
+		entries = append(entries, &entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].TrashedAt.After(entries[j].TrashedAt)
+	})
+	return entries, nil
+}
+
+// Restore moves a file out of the trash by stored name or ID. A file whose
+// expiry has passed gets a fresh TTL from the current policy, counted from
+// now, so it is not collected again straight away.
+func (s *Store) Restore(name string) (*storage.FileMetadata, error) {
+	entries, err := s.TrashList()
+	if err != nil {
+		return nil, err
+	}
+	var meta *storage.FileMetadata
+	for _, e := range entries {
+		if e.Metadata.StoredName == name || e.Metadata.ID == name {
+			meta = e.Metadata
+			break
+		}
+	}
+	if meta == nil {
+		return nil, ErrNotInTrash
+	}
+	if _, ok := s.blocked(meta.SHA256); ok {
+		return nil, ErrBlocked
+	}
+	if meta.IsExpired() {
+		meta.ExpiresAt = time.Now().Add(storage.CalculateTTL(meta.Size, meta.ContentType))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.taken(meta.ID, meta.StoredName) {
+		return nil, ErrNameInUse
+	}
+	if _, err := os.Stat(s.Path(meta)); err == nil {
+		return nil, ErrNameInUse
+	}
+
+	dir := s.trashPath(meta.ID)
+	if err := os.Rename(filepath.Join(dir, trashBlob), s.Path(meta)); err != nil {
+		return nil, err
+	}
+	if meta.Thumbnail {
+		if err := os.Rename(filepath.Join(dir, trashThumbnail), s.thumbnailPath(meta.ID)); err != nil {
+			meta.Thumbnail = false
+		}
+	}
+	if err := s.db.SaveMetadata(meta); err != nil {
+		os.Rename(s.Path(meta), filepath.Join(dir, trashBlob))
+		return nil, err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		log.Printf("Failed to remove trash entry %s: %v", meta.ID, err)
+	}
+
+	s.expiry.push(meta.ID, meta.ExpiresAt)
+	return meta, nil
+}
+
+// PurgeTrash permanently deletes the files whose grace period has passed,
+// or everything in the trash if all is set, and returns how many it removed.
+func (s *Store) PurgeTrash(all bool) (int, error) {
+	entries, err := s.TrashList()
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	purged := 0
+	for _, e := range entries {
+		if !all && now.Before(e.PurgeAt) {
+			continue
+		}
+		if err := os.RemoveAll(s.trashPath(e.Metadata.ID)); err != nil {
+			log.Printf("Failed to purge %s from the trash: %v", e.Metadata.StoredName, err)
+			continue
+		}
+		purged++
+	}
+	return purged, nil
+}
@@ -0,0 +1,126 @@
+package upload
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/keircn/kcst/internal/storage"
+)
+
+func TestTrashRestore(t *testing.T) {
+	s := newTestStore(t)
+	s.SetTrashPeriod(time.Hour)
+	meta := importFile(t, s, "keep me")
+	os.WriteFile(s.thumbnailPath(meta.ID), []byte("jpeg"), 0o644)
+	s.db.Update(meta.ID, func(m *storage.FileMetadata) { m.Thumbnail = true })
+	meta, _ = s.db.GetMetadata(meta.ID)
+
+	if err := s.Trash(meta, TrashDeleted); err != nil {
+		t.Fatal(err)
+	}
+	if m, _ := s.db.GetMetadata(meta.ID); m != nil {
+		t.Error("record kept after trashing")
+	}
+	if _, err := os.Stat(s.Path(meta)); !os.IsNotExist(err) {
+		t.Error("blob left in place")
+	}
+
+	entries, err := s.TrashList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Reason != TrashDeleted || entries[0].Metadata.ID != meta.ID {
+		t.Fatalf("trash = %+v", entries)
+	}
+
+	restored, err := s.Restore(meta.StoredName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(s.Path(restored)); string(data) != "keep me" {
+		t.Errorf("restored blob = %q", data)
+	}
+	if _, err := os.Stat(s.thumbnailPath(meta.ID)); err != nil || !restored.Thumbnail {
+		t.Errorf("thumbnail not restored: %v", err)
+	}
+	if m, _ := s.db.GetMetadata(meta.ID); m == nil {
+		t.Error("record not restored")
+	}
+	if entries, _ := s.TrashList(); len(entries) != 0 {
+		t.Errorf("trash after restore = %+v", entries)
+	}
+	if _, err := s.Restore(meta.StoredName); !errors.Is(err, ErrNotInTrash) {
+		t.Errorf("second restore: err = %v, want ErrNotInTrash", err)
+	}
+}
+
+func TestTrashRestoreExpired(t *testing.T) {
+	s := newTestStore(t)
+	s.SetTrashPeriod(time.Hour)
+	meta := importFile(t, s, "old")
+	meta.ExpiresAt = time.Now().Add(-time.Minute)
+
+	if err := s.Trash(meta, TrashExpired); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := s.Restore(meta.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !restored.ExpiresAt.After(time.Now()) {
+		t.Errorf("restored file still expired at %s", restored.ExpiresAt)
+	}
+}
+
+func TestTrashRestoreNameInUse(t *testing.T) {
+	s := newTestStore(t)
+	s.SetTrashPeriod(time.Hour)
+	meta := importFile(t, s, "first")
+	if err := s.Trash(meta, TrashDeleted); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(s.Path(meta), []byte("second"), 0o644)
+
+	if _, err := s.Restore(meta.ID); !errors.Is(err, ErrNameInUse) {
+		t.Errorf("err = %v, want ErrNameInUse", err)
+	}
+	if data, _ := os.ReadFile(s.Path(meta)); string(data) != "second" {
+		t.Errorf("newer file overwritten: %q", data)
+	}
+}
+
+func TestTrashDisabled(t *testing.T) {
+	s := newTestStore(t)
+	meta := importFile(t, s, "gone")
+	if err := s.Trash(meta, TrashDeleted); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(s.Path(meta)); !os.IsNotExist(err) {
+		t.Error("blob kept")
+	}
+	if entries, _ := s.TrashList(); len(entries) != 0 {
+		t.Errorf("trash = %+v", entries)
+	}
+}
+
+func TestPurgeTrash(t *testing.T) {
+	s := newTestStore(t)
+	s.SetTrashPeriod(time.Hour)
+	for _, content := range []string{"a", "b"} {
+		if err := s.Trash(importFile(t, s, content), TrashDeleted); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n, err := s.PurgeTrash(false); err != nil || n != 0 {
+		t.Errorf("purge within the grace period = %d, %v", n, err)
+	}
+	if n, err := s.PurgeTrash(true); err != nil || n != 2 {
+		t.Errorf("purge all = %d, %v", n, err)
+	}
+	if entries, _ := s.TrashList(); len(entries) != 0 {
+		t.Errorf("trash after purge = %+v", entries)
+	}
+}
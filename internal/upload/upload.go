@@ -1,67 +1,347 @@
 package upload
 
 import (
-	"crypto/rand"
+	"context"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"io"
 	"log"
+	"mime"
 	"mime/multipart"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/keircn/kcst/internal/audit"
+	"github.com/keircn/kcst/internal/blocklist"
+	"github.com/keircn/kcst/internal/events"
+	"github.com/keircn/kcst/internal/imagemeta"
+	"github.com/keircn/kcst/internal/metrics"
+	"github.com/keircn/kcst/internal/scan"
 	"github.com/keircn/kcst/internal/storage"
+	"github.com/keircn/kcst/internal/thumbnail"
 )
 
+const (
+	thumbDir      = ".thumbs"
+	tempPrefix    = ".upload-"
+	maxSlugLength = 64
+	maxIDAttempts = 10
+)
+
+var (
+	ErrInvalidSlug = errors.New("invalid slug")
+	ErrSlugTaken   = errors.New("slug already in use")
+	ErrNoFreeID    = errors.New("could not find a free file id")
+)
+
+// reservedSlugs are top-level names that would shadow a route.
+var reservedSlugs = map[string]bool{
+	"f":       true,
+	"t":       true,
+	"admin":   true,
+	"api":     true,
+	"healthz": true,
+	"readyz":  true,
+	"metrics": true,
+	"debug":   true,
+}
+
 type Store struct {
 	dir             string
 	db              *storage.DB
-	cleanupInterval time.Duration
+	cleanupInterval atomic.Int64
+	intervalCh      chan time.Duration
+	lastCleanup     atomic.Int64
+	ids             IDGenerator
+
+	// pending maps the IDs of uploads that are still being written to
+	// their file names, so two concurrent uploads cannot be handed the
+	// same ID or name before either one reaches the DB.
+	mu      sync.Mutex
+	pending map[string]string
+
+	cleanupMu   sync.Mutex
+	trashPeriod atomic.Int64
+	// expiry wakes the cleanup routine when the next file is due. See
+	// expiry.go.
+	expiry *expiryQueue
+
+	// accessed holds expiry times extended by downloads until the next
+	// flush. See access.go.
+	extension atomic.Pointer[accessExtension]
+	accessMu  sync.Mutex
+	accessed  map[string]time.Time
+
+	// scanner checks new uploads before they are served. See scan.go.
+	scanner         scan.Scanner
+	scanTimeout     time.Duration
+	scanMaxAttempts int
+	scanOversize    string
+	scanInfected    string
+	scanSlots       chan struct{}
+	scanMu          sync.Mutex
+	scanning        map[string]bool
+
+	// blocklist rejects known content. See blocklist.go.
+	blocklist *blocklist.List
+	auditLog  *audit.Log
+
+	// events is told about uploads and removals. It is nil when nothing
+	// listens, as in the maintenance commands.
+	events events.Publisher
+
+	// thumbSlots bounds how many thumbnails are generated at once, since
+	// each may hold a large decoded image.
+	thumbSlots chan struct{}
+
+	// wg tracks background work: the cleanup routine, thumbnails and
+	// scans. ctx is cancelled by Stop to cut that work short.
+	wg     sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
-func NewStore(dir string, db *storage.DB, cleanupInterval time.Duration) (*Store, error) {
-	if err := os.MkdirAll(dir, 0o755); err != nil {
+const (
+	maxConcurrentThumbnails = 2
+	thumbnailTimeout        = time.Minute
+)
+
+func NewStore(dir string, db *storage.DB, cleanupInterval time.Duration, ids IDGenerator) (*Store, error) {
+	if err := os.MkdirAll(filepath.Join(dir, thumbDir), 0o755); err != nil {
 		return nil, err
 	}
-	return &Store{dir: dir, db: db, cleanupInterval: cleanupInterval}, nil
+	s := &Store{
+		dir:        dir,
+		db:         db,
+		intervalCh: make(chan time.Duration, 1),
+		ids:        ids,
+		pending:    make(map[string]string),
+		accessed:   make(map[string]time.Time),
+		expiry:     newExpiryQueue(),
+		thumbSlots: make(chan struct{}, maxConcurrentThumbnails),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.cleanupInterval.Store(int64(cleanupInterval))
+	return s, nil
+}
+
+type Options struct {
+	StripMetadata bool
+	Slug          string
+	// UploadedAt overrides the upload time; the zero value means now.
+	UploadedAt time.Time
+	// Client identifies the uploader in the audit log.
+	Client string
+}
+
+func (s *Store) Save(file multipart.File, header *multipart.FileHeader, opts Options) (string, *storage.FileMetadata, error) {
+	return s.save(file, header.Filename, header.Header.Get("Content-Type"), opts)
 }
 
-func (s *Store) Save(file multipart.File, header *multipart.FileHeader) (string, *storage.FileMetadata, error) {
-	randName, err := generateRandomName()
+// Import adds a file that already exists on disk, copying it into the
+// store. The content type is guessed from the extension and contents.
+func (s *Store) Import(path string, opts Options) (string, *storage.FileMetadata, error) {
+	file, err := os.Open(path)
 	if err != nil {
 		return "", nil, err
 	}
+	defer file.Close()
 
-	ext := getExtension(header.Filename)
-	filename := randName + ext
+	contentType := mime.TypeByExtension(filepath.Ext(path))
+	if contentType == "" {
+		head := make([]byte, 512)
+		n, err := io.ReadFull(file, head)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return "", nil, err
+		}
+		contentType = http.DetectContentType(head[:n])
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return "", nil, err
+		}
+	}
+
+	return s.save(file, filepath.Base(path), contentType, opts)
+}
 
-	dst, err := os.Create(filepath.Join(s.dir, filename))
+func (s *Store) save(file io.ReadSeeker, originalName, contentType string, opts Options) (string, *storage.FileMetadata, error) {
+	var id, filename string
+	var dst *os.File
+	var err error
+	if opts.Slug != "" {
+		if err := ValidateSlug(opts.Slug); err != nil {
+			return "", nil, err
+		}
+		id, filename = opts.Slug, opts.Slug
+		dst, err = s.create(id, filename)
+		if errors.Is(err, os.ErrExist) {
+			return "", nil, ErrSlugTaken
+		}
+	} else {
+		id, filename, dst, err = s.createRandom(getExtension(originalName))
+	}
 	if err != nil {
 		return "", nil, err
 	}
+	defer s.release(id)
 	defer dst.Close()
 
-	size, err := io.Copy(dst, file)
+	var size int64
+	var stripped bool
+	hash := sha256.New()
+	w := io.MultiWriter(dst, hash)
+	if opts.StripMetadata {
+		size, stripped, err = imagemeta.Strip(w, file)
+	} else {
+		size, err = io.Copy(w, file)
+	}
+	if err == nil {
+		err = dst.Close()
+	}
+	if err != nil {
+		os.Remove(dst.Name())
+		return "", nil, err
+	}
+
+	// Stripping changes the stored bytes, so check the original too.
+	sum := hex.EncodeToString(hash.Sum(nil))
+	hashes := []string{sum}
+	if stripped {
+		original := sha256.New()
+		if _, err := file.Seek(0, io.SeekStart); err == nil {
+			if _, err := io.Copy(original, file); err == nil {
+				hashes = append(hashes, hex.EncodeToString(original.Sum(nil)))
+			}
+		}
+	}
+	if entry, ok := s.blocked(hashes...); ok {
+		os.Remove(dst.Name())
+		s.audit(audit.Entry{Action: audit.UploadRejected, Hash: entry.Hash, File: originalName, Actor: opts.Client, Detail: entry.Reason})
+		return "", nil, ErrBlocked
+	}
+
+	// Only content that passed the blocklist gets its final name. Link,
+	// unlike rename, fails rather than replace a file that appeared under
+	// that name since create checked.
+	path := filepath.Join(s.dir, filename)
+	err = os.Link(dst.Name(), path)
+	os.Remove(dst.Name())
+	if errors.Is(err, os.ErrExist) && opts.Slug != "" {
+		return "", nil, ErrSlugTaken
+	}
 	if err != nil {
 		return "", nil, err
 	}
 
+	uploadedAt := opts.UploadedAt
+	if uploadedAt.IsZero() {
+		uploadedAt = time.Now()
+	}
+
 	meta := &storage.FileMetadata{
-		ID:           randName,
-		OriginalName: header.Filename,
+		ID:           id,
+		OriginalName: originalName,
 		StoredName:   filename,
 		Size:         size,
-		ContentType:  header.Header.Get("Content-Type"),
-		UploadedAt:   time.Now(),
+		ContentType:  contentType,
+		UploadedAt:   uploadedAt,
+		ExpiresAt:    uploadedAt.Add(storage.CalculateTTL(size, contentType)),
+		SHA256:       sum,
+		Stripped:     stripped,
+	}
+	if s.scanner != nil {
+		meta.Scan = storage.ScanPending
 	}
 	if err := s.db.SaveMetadata(meta); err != nil {
+		os.Remove(path)
 		return "", nil, err
 	}
+	s.expiry.push(meta.ID, meta.ExpiresAt)
+	// With a scanner the upload is announced and thumbnailed once it is
+	// found clean, so ffmpeg never sees malware.
+	if s.scanner != nil {
+		s.startScan(meta)
+	} else {
+		s.publish(events.FileUploaded, meta)
+		s.startThumbnail(meta)
+	}
 
 	return filename, meta, nil
 }
 
+func (s *Store) startThumbnail(meta *storage.FileMetadata) {
+	if thumbnail.Supported(meta.ContentType) {
+		s.wg.Go(func() {
+			s.generateThumbnail(meta)
+		})
+	}
+}
+
+func (s *Store) generateThumbnail(meta *storage.FileMetadata) {
+	select {
+	case s.thumbSlots <- struct{}{}:
+	case <-s.ctx.Done():
+		return
+	}
+	defer func() { <-s.thumbSlots }()
+
+	ctx, cancel := context.WithTimeout(s.ctx, thumbnailTimeout)
+	defer cancel()
+
+	src := filepath.Join(s.dir, meta.StoredName)
+	if err := thumbnail.Generate(ctx, src, s.thumbnailPath(meta.ID), meta.ContentType); err != nil {
+		log.Printf("Failed to generate thumbnail for %s: %v", meta.StoredName, err)
+		return
+	}
+
+	if err := s.db.Update(meta.ID, func(m *storage.FileMetadata) {
+		m.Thumbnail = true
+	}); err != nil {
+		log.Printf("Failed to record thumbnail for %s: %v", meta.StoredName, err)
+	}
+}
+
+func (s *Store) thumbnailPath(id string) string {
+	return ThumbnailPath(s.dir, id)
+}
+
+// ThumbnailPath returns where the thumbnail for the file with the given ID
+// is stored under the upload directory dir.
+func ThumbnailPath(dir, id string) string {
+	return filepath.Join(ThumbnailDir(dir), id+".jpg")
+}
+
+// ThumbnailDir returns the directory holding thumbnails under the upload
+// directory dir.
+func ThumbnailDir(dir string) string {
+	return filepath.Join(dir, thumbDir)
+}
+
+func (s *Store) GetThumbnail(filename string) (*os.File, *storage.FileMetadata, error) {
+	meta, err := s.db.GetMetadataByStoredName(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	if meta == nil || !meta.Thumbnail || s.isExpired(meta) || checkScan(meta) != nil {
+		return nil, nil, os.ErrNotExist
+	}
+
+	file, err := os.Open(s.thumbnailPath(meta.ID))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return file, meta, nil
+}
+
+// Get opens a file for serving. A file that is still being scanned, was
+// found infected or could not be scanned is not opened; ErrScanPending,
+// ErrInfected or ErrScanFailed is returned with its metadata instead.
 func (s *Store) Get(filename string) (*os.File, *storage.FileMetadata, error) {
 	meta, err := s.db.GetMetadataByStoredName(filename)
 	if err != nil {
@@ -70,9 +350,12 @@ func (s *Store) Get(filename string) (*os.File, *storage.FileMetadata, error) {
 	if meta == nil {
 		return nil, nil, os.ErrNotExist
 	}
-	if meta.IsExpired() {
+	if s.isExpired(meta) {
 		return nil, nil, os.ErrNotExist
 	}
+	if err := checkScan(meta); err != nil {
+		return nil, meta, err
+	}
 
 	file, err := os.Open(filepath.Join(s.dir, meta.StoredName))
 	if err != nil {
@@ -82,58 +365,293 @@ func (s *Store) Get(filename string) (*os.File, *storage.FileMetadata, error) {
 	return file, meta, nil
 }
 
-func (s *Store) Cleanup() error {
-	expired, err := s.db.GetExpired()
-	if err != nil {
+// Delete removes a file, its thumbnail and its metadata for good. Use Trash
+// to keep it restorable.
+func (s *Store) Delete(meta *storage.FileMetadata) error {
+	if err := os.Remove(s.Path(meta)); err != nil && !os.IsNotExist(err) {
 		return err
 	}
 
-	for _, meta := range expired {
-		filePath := filepath.Join(s.dir, meta.StoredName)
-		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
-			log.Printf("Failed to remove expired file %s: %v", filePath, err)
-			continue
+	if meta.Thumbnail {
+		if err := os.Remove(s.thumbnailPath(meta.ID)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove thumbnail for %s: %v", meta.StoredName, err)
 		}
+	}
 
-		if err := s.db.DeleteMetadata(meta.ID); err != nil {
-			log.Printf("Failed to delete metadata for %s: %v", meta.ID, err)
+	return s.db.DeleteMetadata(meta.ID)
+}
+
+// Path returns where the blob for meta is stored.
+func (s *Store) Path(meta *storage.FileMetadata) string {
+	return filepath.Join(s.dir, meta.StoredName)
+}
+
+// Cleanup removes expired files, retries failed scans, purges the trash of
+// files past their grace period and returns how many expired files were
+// removed.
+func (s *Store) Cleanup() (int, error) {
+	s.cleanupMu.Lock()
+	defer s.cleanupMu.Unlock()
+
+	now := time.Now().UnixNano()
+	s.lastCleanup.Store(now)
+	metrics.CleanupRuns.Add(1)
+	metrics.CleanupLastRunNS.Store(now)
+
+	// Files kept alive by recent downloads must not be collected.
+	if err := s.FlushAccess(); err != nil {
+		log.Printf("Failed to record access times: %v", err)
+	}
+
+	expired, err := s.db.GetExpired()
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, meta := range expired {
+		if err := s.Trash(meta, TrashExpired); err != nil {
+			log.Printf("Failed to remove expired file %s: %v", meta.StoredName, err)
 			continue
 		}
 
+		removed++
+		metrics.CleanupRemoved.Add(1)
 		log.Printf("Cleaned up expired file: %s (size: %d, uploaded: %s)",
 			meta.StoredName, meta.Size, meta.UploadedAt.Format(time.RFC3339))
 	}
 
-	return nil
+	if err := s.ScanPending(); err != nil {
+		log.Printf("Failed to rescan pending files: %v", err)
+	}
+
+	if purged, err := s.PurgeTrash(false); err != nil {
+		log.Printf("Failed to purge the trash: %v", err)
+	} else if purged > 0 {
+		log.Printf("Purged %d files from the trash", purged)
+	}
+
+	return removed, nil
 }
 
+// StartCleanupRoutine removes files as they expire. Each file is deleted
+// when its expiry comes up; a full sweep every cleanup interval catches
+// anything the queue missed.
 func (s *Store) StartCleanupRoutine(stop <-chan struct{}) {
-	ticker := time.NewTicker(s.cleanupInterval)
-	go func() {
-		if err := s.Cleanup(); err != nil {
+	ticker := time.NewTicker(s.CleanupInterval())
+	flush := time.NewTicker(accessFlushInterval)
+	timer := time.NewTimer(0)
+	s.wg.Go(func() {
+		if _, err := s.Cleanup(); err != nil {
 			log.Printf("Cleanup error: %v", err)
 		}
+		if err := s.Reschedule(); err != nil {
+			log.Printf("Failed to schedule expiry: %v", err)
+		}
 
 		for {
 			select {
+			case <-s.expiryTimer(timer):
+				s.expireDue()
+			case <-s.expiry.wake:
 			case <-ticker.C:
-				if err := s.Cleanup(); err != nil {
+				if _, err := s.Cleanup(); err != nil {
 					log.Printf("Cleanup error: %v", err)
 				}
+			case <-flush.C:
+				if err := s.FlushAccess(); err != nil {
+					log.Printf("Failed to record access times: %v", err)
+				}
+			case d := <-s.intervalCh:
+				ticker.Reset(d)
 			case <-stop:
 				ticker.Stop()
+				flush.Stop()
+				timer.Stop()
 				return
 			}
 		}
-	}()
+	})
+}
+
+// Wait blocks until the cleanup routine has stopped and pending thumbnails
+// and scans are done.
+func (s *Store) Wait() {
+	s.wg.Wait()
+}
+
+// Stop cancels running thumbnails and scans and makes queued ones give up,
+// so a following Wait returns promptly. Files whose scan was cut short
+// stay pending and are scanned after the next start.
+func (s *Store) Stop() {
+	s.cancel()
+}
+
+// RemoveIncomplete deletes blobs of uploads that are still being written.
+// It is called on shutdown after in-flight requests had their chance to
+// finish.
+func (s *Store) RemoveIncomplete() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, name := range s.pending {
+		for _, path := range []string{s.tempPath(id), filepath.Join(s.dir, name)} {
+			if err := os.Remove(path); err == nil {
+				log.Printf("Removed incomplete upload: %s", name)
+			} else if !os.IsNotExist(err) {
+				log.Printf("Failed to remove incomplete upload %s: %v", path, err)
+			}
+		}
+	}
+}
+
+// tempPath returns where the upload with the given ID is written until it
+// has passed the blocklist.
+func (s *Store) tempPath(id string) string {
+	return filepath.Join(s.dir, tempPrefix+id)
+}
+
+func (s *Store) CleanupInterval() time.Duration {
+	return time.Duration(s.cleanupInterval.Load())
+}
+
+// LastCleanup returns when Cleanup last started, or the zero time if it
+// has not run yet.
+func (s *Store) LastCleanup() time.Time {
+	ns := s.lastCleanup.Load()
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+// SetCleanupInterval changes how often the cleanup routine runs. The new
+// interval takes effect from the next tick.
+func (s *Store) SetCleanupInterval(d time.Duration) {
+	s.cleanupInterval.Store(int64(d))
+	select {
+	case <-s.intervalCh:
+	default:
+	}
+	s.intervalCh <- d
+}
+
+// SetPublisher sends upload, deletion and expiry events to p. Call it
+// before the store is used.
+func (s *Store) SetPublisher(p events.Publisher) {
+	s.events = p
+}
+
+func (s *Store) publish(t events.Type, meta *storage.FileMetadata) {
+	if s.events != nil {
+		s.events.Publish(t, meta)
+	}
+}
+
+func (s *Store) SetIDGenerator(ids IDGenerator) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ids = ids
+}
+
+// ValidateSlug accepts names made of letters, digits, '.', '_' and '-' that
+// do not start with a dot and do not collide with a route.
+func ValidateSlug(slug string) error {
+	if len(slug) == 0 || len(slug) > maxSlugLength {
+		return ErrInvalidSlug
+	}
+	if slug[0] == '.' || strings.Contains(slug, "..") {
+		return ErrInvalidSlug
+	}
+	for _, c := range slug {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '.' || c == '_' || c == '-':
+		default:
+			return ErrInvalidSlug
+		}
+	}
+
+	base := strings.ToLower(slug)
+	if i := strings.IndexByte(base, '.'); i >= 0 {
+		base = base[:i]
+	}
+	if reservedSlugs[base] {
+		return ErrInvalidSlug
+	}
+	return nil
 }
 
-func generateRandomName() (string, error) {
-	bytes := make([]byte, 4)
-	if _, err := rand.Read(bytes); err != nil {
-		return "", err
+func (s *Store) createRandom(ext string) (string, string, *os.File, error) {
+	for range maxIDAttempts {
+		s.mu.Lock()
+		ids := s.ids
+		s.mu.Unlock()
+
+		id, err := ids.Generate()
+		if err != nil {
+			return "", "", nil, err
+		}
+
+		filename := id + ext
+		dst, err := s.create(id, filename)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return "", "", nil, err
+		}
+		return id, filename, dst, nil
+	}
+	return "", "", nil, ErrNoFreeID
+}
+
+// create reserves id and filename and opens a temporary file for the
+// blob. The caller renames it to filename once it is complete. It fails
+// with os.ErrExist if the id or name is already known to the DB, is being
+// written by another upload, or if a file already exists on disk.
+func (s *Store) create(id, filename string) (*os.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.taken(id, filename) {
+		return nil, os.ErrExist
+	}
+	if _, err := os.Lstat(filepath.Join(s.dir, filename)); err == nil {
+		return nil, os.ErrExist
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	dst, err := os.OpenFile(s.tempPath(id), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	s.pending[id] = filename
+	return dst, nil
+}
+
+// taken reports whether id or filename belongs to a stored file or an
+// upload in progress. The caller must hold s.mu.
+func (s *Store) taken(id, filename string) bool {
+	for pendingID, pendingName := range s.pending {
+		if pendingID == id || pendingName == filename {
+			return true
+		}
+	}
+	if meta, _ := s.db.GetMetadata(id); meta != nil {
+		return true
 	}
-	return hex.EncodeToString(bytes), nil
+	meta, _ := s.db.GetMetadataByStoredName(filename)
+	return meta != nil
+}
+
+func (s *Store) release(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.pending, id)
 }
 
 func getExtension(filename string) string {